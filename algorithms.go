@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// validCiphers and validKexAlgorithms are the algorithms the ssh client
+// implements and that can be chosen with --ssh-ciphers and --ssh-kex.
+var (
+	validCiphers = []string{
+		"aes128-gcm@openssh.com",
+		"aes256-gcm@openssh.com",
+		"chacha20-poly1305@openssh.com",
+		"aes128-ctr",
+		"aes192-ctr",
+		"aes256-ctr",
+		"aes128-cbc",
+		"3des-cbc",
+		"arcfour256",
+		"arcfour128",
+		"arcfour",
+	}
+	validKexAlgorithms = []string{
+		"curve25519-sha256",
+		"curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256",
+		"ecdh-sha2-nistp384",
+		"ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256",
+		"diffie-hellman-group14-sha1",
+		"diffie-hellman-group1-sha1",
+	}
+)
+
+// parseAlgorithms splits a comma separated list of algorithm names and
+// checks each is in valid.  An empty list keeps the client defaults.
+func parseAlgorithms(kind, v string, valid []string) ([]string, error) {
+	algorithms := []string{}
+	for _, a := range strings.Split(v, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+
+		ok := false
+		for _, name := range valid {
+			ok = ok || name == a
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown %s %s (must be one of %s)", kind, a, strings.Join(valid, ", "))
+		}
+		algorithms = append(algorithms, a)
+	}
+
+	if len(algorithms) == 0 {
+		return nil, nil
+	}
+
+	return algorithms, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var validAuthMethods = []string{"key", "agent", "password"}
+
+func parseAuthMethods(v string) ([]string, error) {
+	methods := []string{}
+	for _, m := range strings.Split(v, ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+
+		valid := false
+		for _, a := range validAuthMethods {
+			valid = valid || a == m
+		}
+		if !valid {
+			return nil, fmt.Errorf("unknown auth method %s (must be one of %s)", m, strings.Join(validAuthMethods, ", "))
+		}
+		methods = append(methods, m)
+	}
+
+	if len(methods) == 0 {
+		return nil, errors.New("at least one auth method is required")
+	}
+
+	return methods, nil
+}
+
+// buildAuthMethods returns the ssh auth methods in the order given.
+// Methods that can't be set up are skipped as long as another remains.
+func buildAuthMethods(methods []string, keyPath string) ([]ssh.AuthMethod, error) {
+	auth := []ssh.AuthMethod{}
+	for _, m := range methods {
+		switch m {
+		case "key":
+			kc := &keychain{}
+			if err := kc.loadPEM(keyPath); err != nil {
+				log.Warnf("unable to load key %s: %s", keyPath, err)
+				continue
+			}
+			auth = append(auth, ssh.PublicKeys(kc))
+		case "agent":
+			sock := os.Getenv("SSH_AUTH_SOCK")
+			if sock == "" {
+				log.Warn("SSH_AUTH_SOCK is not set; skipping agent auth")
+				continue
+			}
+			conn, err := net.Dial("unix", sock)
+			if err != nil {
+				log.Warnf("unable to connect to ssh agent: %s", err)
+				continue
+			}
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		case "password":
+			// only prompts if the server gets as far as asking
+			auth = append(auth, ssh.PasswordCallback(promptPassword))
+		}
+	}
+
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no usable auth methods out of %s", strings.Join(methods, ", "))
+	}
+
+	return auth, nil
+}
+
+func promptPassword() (string, error) {
+	fmt.Fprintf(os.Stderr, "%s@%s password: ", machineUser, machineName)
+
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		pw, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(pw), err
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var (
+	// askBecomePass prompts for the sudo password of the user on the
+	// machine so writes sftp isn't allowed to make are done through sudo.
+	askBecomePass bool
+	becomePass    []byte
+	// becomeNoPass is set when sudo on the machine doesn't ask for a
+	// password, as with NOPASSWD in sudoers.  The password is then never
+	// sent since nothing would read it before the command's input.
+	becomeNoPass bool
+)
+
+// promptBecomePass reads the sudo password and checks it on the machine.
+func promptBecomePass() error {
+	if !askBecomePass || becomePass != nil || becomeNoPass {
+		return nil
+	}
+
+	if runSudo("sudo -n true", nil) == nil {
+		becomeNoPass = true
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "[sudo] password for %s@%s: ", machineUser, machineName)
+	fd := int(os.Stdin.Fd())
+	var pw []byte
+	if terminal.IsTerminal(fd) {
+		p, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return err
+		}
+		pw = p
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return err
+		}
+		pw = []byte(strings.TrimRight(line, "\r\n"))
+	}
+
+	becomePass = pw
+	if err := becomeRun("true", nil); err != nil {
+		becomePass = nil
+		return fmt.Errorf("sudo on %s failed: %s", machineName, err)
+	}
+
+	return nil
+}
+
+// becomeRun runs cmd through sudo on the machine with stdin.  When sudo
+// wants a password it goes ahead of stdin, and -k makes sudo always read
+// it so a cached login can't leave it to be read by cmd.
+func becomeRun(cmd string, stdin io.Reader) error {
+	if becomeNoPass {
+		return runSudo("sudo -n sh -c "+shellQuote(cmd), stdin)
+	}
+	if becomePass == nil {
+		return errors.New("no sudo password")
+	}
+
+	input := io.Reader(bytes.NewReader(append(append([]byte{}, becomePass...), '\n')))
+	if stdin != nil {
+		input = io.MultiReader(input, stdin)
+	}
+
+	return runSudo("sudo -k -S -p '' sh -c "+shellQuote(cmd), input)
+}
+
+func runSudo(cmd string, stdin io.Reader) error {
+	session, err := newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stdin = stdin
+	session.Stderr = &stderr
+	if err := session.Run(cmd); err != nil {
+		return fmt.Errorf("%s: %s", err, strip(stderr.String()))
+	}
+
+	return nil
+}
+
+// canBecome reports whether err from sftp can be worked around with sudo.
+func canBecome(err error) bool {
+	return (becomePass != nil || becomeNoPass) && err != nil && isPermissionDenied(err)
+}
+
+// becomeWrite writes data to filePath through sudo, replacing it with a
+// rename so a failed write doesn't leave it truncated.
+func becomeWrite(filePath string, data []byte) error {
+	tmp := shellQuote(filePath + tempSuffix)
+	cmd := fmt.Sprintf("mkdir -p -- %s && cat > %s && mv -f -- %s %s", shellQuote(path.Dir(filePath)), tmp, tmp, shellQuote(filePath))
+	if err := becomeRun(cmd, &progressReader{bytes.NewReader(data)}); err != nil {
+		return fmt.Errorf("error writing %s with sudo: %s", filePath, err)
+	}
+	syncStats.addBytes(int64(len(data)))
+
+	return nil
+}
+
+// remoteMkdirAll creates filePath and its parents, through sudo when the
+// user isn't allowed to.
+func remoteMkdirAll(filePath string) error {
+	err := rsftp.MkdirAll(filePath)
+	if canBecome(err) {
+		return becomeRun("mkdir -p -- "+shellQuote(filePath), nil)
+	}
+
+	return err
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// branchPrefix is the directory on the machine that each git branch of
+// srcPath is synced to a subdirectory of.
+var (
+	branchPrefix  string
+	currentBranch string
+	branchMu      sync.Mutex
+)
+
+// gitHeadPath returns the HEAD file of the repository at dir, following
+// the .git file of worktrees and submodules.
+func gitHeadPath(dir string) (string, error) {
+	gitPath := filepath.Join(dir, ".git")
+	fi, err := os.Stat(gitPath)
+	if err != nil {
+		return "", fmt.Errorf("%s is not a git repository: %s", dir, err)
+	}
+	if fi.IsDir() {
+		return filepath.Join(gitPath, "HEAD"), nil
+	}
+
+	data, err := ioutil.ReadFile(gitPath)
+	if err != nil {
+		return "", err
+	}
+
+	line := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(line, "gitdir:") {
+		return "", fmt.Errorf("unable to find git directory in %s", gitPath)
+	}
+	gitDir := strings.TrimSpace(strings.TrimPrefix(line, "gitdir:"))
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(dir, gitDir)
+	}
+
+	return filepath.Join(gitDir, "HEAD"), nil
+}
+
+// gitBranch returns the branch checked out in dir.  A detached HEAD is
+// named after its commit.
+func gitBranch(dir string) (string, error) {
+	head, err := gitHeadPath(dir)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadFile(head)
+	if err != nil {
+		return "", err
+	}
+
+	ref := strings.TrimSpace(string(data))
+	if strings.HasPrefix(ref, "ref:") {
+		ref = strings.TrimSpace(strings.TrimPrefix(ref, "ref:"))
+		return strings.TrimPrefix(ref, "refs/heads/"), nil
+	}
+
+	if len(ref) < 7 {
+		return "", fmt.Errorf("unable to read the branch from %s", head)
+	}
+	branch := "detached-" + ref[:7]
+	log.Warnf("%s has a detached HEAD; using %s as the branch", dir, branch)
+
+	return branch, nil
+}
+
+// branchDest returns the destination for branch, with --under applied.
+// Branches like feature/x are kept in a single directory.
+func branchDest(branch string) string {
+	return underDest(chrootPath(path.Join(branchPrefix, strings.Replace(branch, "/", "-", -1))))
+}
+
+// updateBranch re-reads the branch and, if it changed, points destPath at
+// the new branch's directory and syncs the tree there.  Transfers are held
+// while the destination changes.
+func updateBranch() {
+	branchMu.Lock()
+	defer branchMu.Unlock()
+
+	branch, err := gitBranch(srcPath)
+	if err != nil {
+		log.Errorf("unable to read the git branch: %s", err)
+		return
+	}
+	if branch == currentBranch {
+		return
+	}
+
+	// transfers to the old destination finish before switching.  The
+	// limiter isn't held through the sync, which may have to reconnect.
+	transferLimiter.hold()
+	currentBranch = branch
+	destPath = branchDest(branch)
+	transferLimiter.unhold()
+	log.Infof("branch changed to %s; syncing to %s", branch, destPath)
+
+	if err := ensureDestPath(); err != nil {
+		log.Error(err)
+		return
+	}
+	if err := initialSync(); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+var transferBreaker = newBreaker()
+
+// breaker stops transfers after threshold consecutive failures.  Once the
+// cooldown has passed a single transfer is let through as a probe; if it
+// succeeds transfers resume, otherwise the breaker opens again.
+type breaker struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	state     string
+	openedAt  time.Time
+}
+
+func newBreaker() *breaker {
+	b := &breaker{
+		state: breakerClosed,
+	}
+	b.cond = sync.NewCond(&b.mu)
+
+	return b
+}
+
+// wait blocks until a transfer is allowed.  It reports whether the
+// transfer is the probe, which must be passed to finish.
+func (b *breaker) wait() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for {
+		switch b.state {
+		case breakerClosed:
+			return false
+		case breakerOpen:
+			remaining := b.cooldown - time.Since(b.openedAt)
+			if remaining <= 0 {
+				log.Info("circuit breaker half-open; probing machine")
+				b.state = breakerHalfOpen
+				return true
+			}
+			b.mu.Unlock()
+			time.Sleep(remaining)
+			b.mu.Lock()
+		case breakerHalfOpen:
+			b.cond.Wait()
+		}
+	}
+}
+
+// record updates the breaker with the result of a transfer.
+func (b *breaker) record(err error) {
+	if b.threshold < 1 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		if b.state != breakerClosed {
+			log.Info("circuit breaker closed; resuming transfers")
+			b.state = breakerClosed
+			b.cond.Broadcast()
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		log.Warnf("circuit breaker open after %d consecutive failures; pausing transfers for %s", b.failures, b.cooldown)
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		b.cond.Broadcast()
+	}
+}
+
+// isLocalError reports whether err came from reading or transforming the
+// local file at localPath rather than from the machine.  Those failures say
+// nothing about the machine so they aren't recorded.
+func isLocalError(err error, localPath string) bool {
+	switch e := err.(type) {
+	case *transformError:
+		return true
+	case *os.PathError:
+		return e.Path == localPath
+	}
+
+	return err == errFileChanged
+}
+
+// finish ends a transfer let through by wait.  A probe that returned
+// without recording a result, such as a skipped or requeued event, lets
+// the next transfer probe instead so the others aren't left waiting.
+func (b *breaker) finish(probe bool) {
+	if !probe {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+		b.openedAt = time.Now().Add(-b.cooldown)
+		b.cond.Broadcast()
+	}
+}
+
+func (b *breaker) currentState() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/howeyc/fsnotify"
+)
+
+func TestIsLocalError(t *testing.T) {
+	local := filepath.Join("src", "file")
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{&transformError{local, errors.New("exit status 1")}, true},
+		{errFileChanged, true},
+		{&os.PathError{Op: "open", Path: local, Err: os.ErrPermission}, true},
+		{&os.PathError{Op: "open", Path: "/dst/src/file", Err: os.ErrPermission}, false},
+		{errors.New("connection lost"), false},
+	}
+
+	for _, test := range tests {
+		if got := isLocalError(test.err, local); got != test.want {
+			t.Errorf("isLocalError(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+// TestTransformFailuresDontOpenBreaker fails the transform of a file more
+// times than the breaker allows; other files must still be synced.
+func TestTransformFailuresDontOpenBreaker(t *testing.T) {
+	s := startTestServer(t)
+	defer s.kill()
+	dest, cleanup := testTree(t)
+	defer cleanup()
+	connectTestServer(t, s)
+
+	defer func(b *breaker, fns []TransformFunc) {
+		transferBreaker, transforms = b, fns
+	}(transferBreaker, transforms)
+	transferBreaker = newBreaker()
+	transferBreaker.threshold, transferBreaker.cooldown = 2, time.Minute
+	transforms = []TransformFunc{func(p string, r io.Reader) (io.Reader, error) {
+		if filepath.Base(p) == "bad" {
+			return nil, errors.New("exit status 1")
+		}
+		return r, nil
+	}}
+
+	bad, good := filepath.Join("src", "bad"), filepath.Join("src", "good")
+	writeTestFile(t, bad, []byte("bad"))
+	writeTestFile(t, good, []byte("good"))
+	for i := 0; i < transferBreaker.threshold; i++ {
+		handleEvent(&fsnotify.FileEvent{Name: bad}, nil)
+	}
+	if state := transferBreaker.currentState(); state != breakerClosed {
+		t.Fatalf("breaker is %s after failed transforms", state)
+	}
+
+	handleEvent(&fsnotify.FileEvent{Name: good}, nil)
+	if _, err := os.Stat(filepath.Join(dest, good)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// chunkSize is the size of the buffers used to copy file content
+// (--chunk-size).
+var chunkSize = 32 * 1024
+
+// copyBuffers reuses copy buffers across transfers so syncing many files
+// doesn't allocate one per file.
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, chunkSize)
+		return &b
+	},
+}
+
+// copyBuffer copies src to dst with a buffer from the pool.
+func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	b := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(b)
+
+	return io.CopyBuffer(dst, src, *b)
+}
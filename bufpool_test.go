@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// onlyReader hides WriterTo so copies go through the buffer.
+type onlyReader struct {
+	io.Reader
+}
+
+// benchmarkCopy copies a workload of many small files with copy.
+func benchmarkCopy(b *testing.B, copy func(io.Writer, io.Reader) (int64, error)) {
+	data := randomData(7, 8*1024)
+	r := bytes.NewReader(data)
+	src := io.Reader(onlyReader{r})
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)) * 100)
+	for i := 0; i < b.N; i++ {
+		for file := 0; file < 100; file++ {
+			r.Reset(data)
+			if _, err := copy(ioutil.Discard, src); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkCopyPooledBuffer(b *testing.B) {
+	benchmarkCopy(b, copyBuffer)
+}
+
+func BenchmarkCopyNewBuffer(b *testing.B) {
+	benchmarkCopy(b, func(dst io.Writer, src io.Reader) (int64, error) {
+		return io.CopyBuffer(dst, src, make([]byte, chunkSize))
+	})
+}
+
+// TestCopyBufferReturnedOnError checks that failed copies give their
+// buffer back to the pool rather than allocating a new one each time.
+func TestCopyBufferReturnedOnError(t *testing.T) {
+	data := []byte("data")
+	r := bytes.NewReader(data)
+	src := io.Reader(onlyReader{r})
+
+	allocs := testing.AllocsPerRun(100, func() {
+		r.Reset(data)
+		if _, err := copyBuffer(failingWriter{}, src); err != errWrite {
+			t.Fatalf("got %v, want %v", err, errWrite)
+		}
+	})
+	if allocs >= 1 {
+		t.Errorf("%v allocations per failed copy", allocs)
+	}
+}
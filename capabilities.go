@@ -0,0 +1,31 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+// sftp extensions that optional features depend on.
+const (
+	extHardlink    = "hardlink@openssh.com"
+	extPosixRename = "posix-rename@openssh.com"
+	extStatvfs     = "statvfs@openssh.com"
+	extFsync       = "fsync@openssh.com"
+)
+
+// serverExtensions records which extensions the sftp server advertised.
+var serverExtensions = map[string]bool{}
+
+// detectCapabilities reads the extensions the sftp server supports and
+// turns off the features it can't handle so they don't fail on every file.
+func detectCapabilities() {
+	for _, ext := range []string{extHardlink, extPosixRename, extStatvfs, extFsync} {
+		_, ok := rsftp.HasExtension(ext)
+		serverExtensions[ext] = ok
+		log.Debugf("sftp extension %s supported: %t", ext, ok)
+	}
+
+	if syncHardlinks && !serverExtensions[extHardlink] {
+		log.Warnf("the sftp server on %s doesn't support %s; hardlinks will be uploaded as separate files", machineName, extHardlink)
+		syncHardlinks = false
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	// onCaseCollision is what to do with a file whose name only differs in
+	// case from another one on a case-insensitive machine (warn or refuse).
+	onCaseCollision   = "warn"
+	remoteCaseFolding bool
+	caseCheckOnce     sync.Once
+	caseNames         = &caseIndex{paths: map[string]string{}}
+)
+
+// caseIndex maps the lower cased remote paths uploaded to the local paths
+// they came from.
+type caseIndex struct {
+	mu    sync.Mutex
+	paths map[string]string
+}
+
+// collision records localPath as the source of filePath and returns the
+// other existing local file already uploaded to the same remote name, if
+// any.
+func (c *caseIndex) collision(localPath, filePath string) string {
+	key := strings.ToLower(filePath)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// a rename that only changes the case is the same file on a
+	// case-insensitive local filesystem
+	other, ok := c.paths[key]
+	if ok && other != localPath {
+		ofi, err := os.Lstat(other)
+		if fi, lerr := os.Lstat(localPath); err == nil && (lerr != nil || !os.SameFile(ofi, fi)) {
+			return other
+		}
+	}
+	c.paths[key] = localPath
+
+	return ""
+}
+
+// checkCaseSensitivity creates a test file in dir on the machine and looks
+// it up with a different case to find out whether names are case
+// insensitive there.
+func checkCaseSensitivity(dir string) {
+	caseCheckOnce.Do(func() {
+		name := path.Join(dir, fmt.Sprintf(".Machinesync-Case-%d%s", os.Getpid(), tempSuffix))
+		f, err := rsftp.Create(name)
+		if err != nil {
+			log.Debugf("unable to check case sensitivity on %s: %s", machineName, err)
+			return
+		}
+		f.Close()
+		defer rsftp.Remove(name)
+
+		// only the test file's name changes case; dir may have upper case
+		if _, err := rsftp.Lstat(path.Join(dir, strings.ToLower(path.Base(name)))); err == nil {
+			remoteCaseFolding = true
+			log.Warnf("%s on %s is case insensitive; files whose names only differ in case will collide", dir, machineName)
+		}
+	})
+}
+
+// checkCaseCollision returns an error for localPath when it would overwrite
+// another file on a case-insensitive machine and collisions are refused.
+func checkCaseCollision(localPath, filePath string) error {
+	if !remoteCaseFolding {
+		return nil
+	}
+
+	other := caseNames.collision(localPath, filePath)
+	if other == "" {
+		return nil
+	}
+	if onCaseCollision == "refuse" {
+		return fmt.Errorf("not uploading %s: it would overwrite %s on the case-insensitive machine", localPath, other)
+	}
+	log.Warnf("%s and %s only differ in case and overwrite each other on %s", localPath, other, machineName)
+
+	return nil
+}
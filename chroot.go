@@ -0,0 +1,54 @@
+package main
+
+import (
+	"path"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// chrootBase is the directory on the machine the sftp user is chrooted to.
+// Destinations given as full paths on the machine are resolved inside it.
+var chrootBase string
+
+// chrootPath returns p as seen from inside the chroot.  Paths outside
+// chrootBase are assumed to already be relative to the chroot.
+func chrootPath(p string) string {
+	if chrootBase == "" {
+		return p
+	}
+
+	base := path.Clean(chrootBase)
+	p = path.Clean(p)
+	if p == base {
+		return "/"
+	}
+	if strings.HasPrefix(p, base+"/") {
+		return strings.TrimPrefix(p, base)
+	}
+
+	return p
+}
+
+// checkChroot warns when the session can see chrootBase, which means the
+// user is most likely not chrooted and paths will resolve against the real
+// root instead.
+func checkChroot() {
+	if chrootBase == "" || chrootBase == "/" {
+		return
+	}
+
+	if _, err := rsftp.Stat(chrootBase); err == nil {
+		log.Warnf("%s is visible to %s; the user may not be chrooted and --chroot-base should not be set", chrootBase, machineUser)
+	}
+}
+
+// chrootHint explains a permission error on destPath in terms of the
+// chroot.
+func chrootHint() string {
+	if chrootBase == "" {
+		return " (if the sftp user is chrooted use --chroot-base)"
+	}
+
+	return " (resolved inside the chroot at " + chrootBase + "; check --chroot-base)"
+}
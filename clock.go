@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// clockSkewWarning is how far the machine's clock may be from the local
+// one before a warning is logged.
+const clockSkewWarning = time.Minute
+
+// checkClockSkew compares the machine's clock with the local one and warns
+// when they are far apart, since modification times copied to the machine
+// (e.g. by --tar) will look wrong there.  Nothing is compared by mtime
+// across machines so the skew doesn't affect what is synced.
+func checkClockSkew() {
+	session, err := newSession()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	var stdout bytes.Buffer
+	session.Stdout = &stdout
+	start := time.Now()
+	if err := session.Run("date +%s"); err != nil {
+		log.Debugf("unable to read the clock on %s: %s", machineName, err)
+		return
+	}
+	// the remote time was read somewhere during the round trip
+	local := start.Add(time.Since(start) / 2)
+
+	secs, err := strconv.ParseInt(strip(stdout.String()), 10, 64)
+	if err != nil {
+		log.Debugf("unable to read the clock on %s: %q", machineName, stdout.String())
+		return
+	}
+
+	skew := time.Unix(secs, 0).Sub(local).Round(time.Second)
+	log.Debugf("clock on %s is %s from the local clock", machineName, skew)
+	if skew > clockSkewWarning || skew < -clockSkewWarning {
+		log.Warnf("clock on %s is off by %s from the local clock; modification times on the machine will be misleading", machineName, skew)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/codegangsta/cli"
+)
+
+// bashCompletion completes commands and flags, and machine names after
+// --machine, by asking machine-sync for the words.  zsh uses it through
+// bashcompinit.
+const bashCompletion = `_machine_sync() {
+	local cur="${COMP_WORDS[COMP_CWORD]}"
+	local prev="${COMP_WORDS[COMP_CWORD-1]}"
+	case "$prev" in
+	-m|--machine)
+		COMPREPLY=($(compgen -W "$(machine-sync completion machines 2>/dev/null)" -- "$cur"))
+		return
+		;;
+	esac
+	COMPREPLY=($(compgen -W "$(machine-sync completion words 2>/dev/null)" -- "$cur"))
+}
+complete -o default -F _machine_sync machine-sync
+`
+
+const zshCompletion = `autoload -U +X bashcompinit && bashcompinit
+` + bashCompletion
+
+// completion prints a completion script for a shell, or the words the
+// scripts complete: machines for the names of the docker machines and
+// words for the commands and flags.
+func completion(c *cli.Context) {
+	switch c.Args().First() {
+	case "bash":
+		fmt.Print(bashCompletion)
+	case "zsh":
+		fmt.Print(zshCompletion)
+	case "fish":
+		fmt.Print(fishCompletion(c.App))
+	case "machines":
+		for _, name := range listMachines(c.GlobalString("machine-path")) {
+			fmt.Println(name)
+		}
+	case "words":
+		for _, cmd := range c.App.Commands {
+			fmt.Println(cmd.Name)
+		}
+		for _, f := range c.App.Flags {
+			long, short := flagNames(f)
+			fmt.Println("--" + long)
+			if short != "" {
+				fmt.Println("-" + short)
+			}
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "usage: machine-sync completion bash|zsh|fish")
+		os.Exit(1)
+	}
+}
+
+// fishCompletion returns the fish completions for the commands and flags
+// of app.  Machine names are looked up when --machine is completed.
+func fishCompletion(app *cli.App) string {
+	var b strings.Builder
+	b.WriteString("complete -c machine-sync -f\n")
+	for _, cmd := range app.Commands {
+		fmt.Fprintf(&b, "complete -c machine-sync -n __fish_use_subcommand -a %s -d %s\n", cmd.Name, fishQuote(cmd.Usage))
+	}
+	for _, f := range app.Flags {
+		long, short := flagNames(f)
+		fmt.Fprintf(&b, "complete -c machine-sync -l %s", long)
+		if short != "" {
+			fmt.Fprintf(&b, " -s %s", short)
+		}
+		if long == "machine" {
+			b.WriteString(" -x -a '(machine-sync completion machines 2>/dev/null)'")
+		} else if _, ok := f.(cli.BoolFlag); !ok {
+			b.WriteString(" -r -F")
+		}
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+// flagNames splits a flag's "name, n" into its long and short names.
+func flagNames(f cli.Flag) (string, string) {
+	names := strings.Split(f.GetName(), ",")
+	long := strings.TrimSpace(names[0])
+	if len(names) > 1 {
+		return long, strings.TrimSpace(names[1])
+	}
+
+	return long, ""
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.Replace(strings.Replace(s, `\`, `\\`, -1), "'", `\'`, -1) + "'"
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// compressMinSize is the smallest file worth compressing; below it the
+// extra round trip of running gzip costs more than it saves.
+const compressMinSize = 4096
+
+var (
+	compressUploads bool
+	gzipOnce        sync.Once
+	gzipAvailable   bool
+
+	// compressedExts are formats that are already compressed.
+	compressedExts = map[string]bool{
+		".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true,
+		".zip": true, ".jar": true, ".7z": true, ".rar": true,
+		".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+		".mp3": true, ".mp4": true, ".mkv": true, ".mov": true, ".webm": true,
+		".woff": true, ".woff2": true, ".pdf": true,
+	}
+
+	// compressedMagic are the leading bytes of compressed formats, for
+	// files without a telling extension.
+	compressedMagic = [][]byte{
+		{0x1f, 0x8b},                       // gzip
+		{'P', 'K', 0x03, 0x04},             // zip
+		{0x89, 'P', 'N', 'G'},              // png
+		{0xff, 0xd8, 0xff},                 // jpeg
+		{'G', 'I', 'F', '8'},               // gif
+		{'B', 'Z', 'h'},                    // bzip2
+		{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+		{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+		{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+	}
+)
+
+// shouldCompress decides whether the content of localPath is worth
+// compressing and why.
+func shouldCompress(localPath string, data []byte) (bool, string) {
+	if len(data) < compressMinSize {
+		return false, "too small"
+	}
+
+	ext := strings.ToLower(filepath.Ext(localPath))
+	if compressedExts[ext] {
+		return false, "compressed format " + ext
+	}
+	for _, magic := range compressedMagic {
+		if bytes.HasPrefix(data, magic) {
+			return false, "compressed content"
+		}
+	}
+	// mp4 and mov have the box type after the size
+	if len(data) > 8 && string(data[4:8]) == "ftyp" {
+		return false, "compressed video"
+	}
+
+	binary, err := isBinaryFile(localPath)
+	if err != nil {
+		binary = isBinary(data)
+	}
+	if binary {
+		return true, "binary"
+	}
+
+	return true, "text"
+}
+
+// uploadCompressed sends data gzipped and has gzip on the machine write
+// it to a temporary file that is renamed over filePath.  It returns false,
+// without writing anything, when the content isn't worth compressing or
+// the machine has no gzip.
+func uploadCompressed(localPath, filePath string, data []byte) (bool, error) {
+	compress, reason := shouldCompress(localPath, data)
+	log.Debugf("compress %s: %t (%s)", localPath, compress, reason)
+	if !compress {
+		return false, nil
+	}
+
+	gzipOnce.Do(func() {
+		session, err := newSession()
+		if err != nil {
+			return
+		}
+		defer session.Close()
+
+		gzipAvailable = session.Run("command -v gzip >/dev/null") == nil
+		if !gzipAvailable {
+			log.Warn("gzip is not available on the machine; uploading uncompressed")
+		}
+	})
+	if !gzipAvailable {
+		return false, nil
+	}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(data); err != nil {
+		return false, err
+	}
+	if err := gw.Close(); err != nil {
+		return false, err
+	}
+
+	defer remoteStats.invalidate(filePath)
+
+	// the buffer is drained by sending it
+	compressed := int64(buf.Len())
+	err := timeOp("write", filePath, func() error {
+		session, err := newSession()
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+
+		var stderr bytes.Buffer
+		session.Stdin = &progressReader{&buf}
+		session.Stderr = &stderr
+		tmp := filePath + tempSuffix
+		if err := session.Run(fmt.Sprintf("gzip -dc > %s && mv -f %s %s", shellQuote(tmp), shellQuote(tmp), shellQuote(filePath))); err != nil {
+			return fmt.Errorf("error writing %s: %s: %s", filePath, err, strip(stderr.String()))
+		}
+		return nil
+	})
+	if err != nil {
+		return true, err
+	}
+
+	log.Debugf("sent %s as %s compressed", formatBytes(int64(len(data))), formatBytes(compressed))
+	syncStats.addBytes(compressed)
+
+	return true, nil
+}
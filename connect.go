@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+)
+
+var machineIPCommand string
+
+// machineAddr returns the host:port of the machine's ssh server.  A config
+// without an address is an error rather than a guess.  When
+// --machine-ip-command is set it is run on every call so a reconnect picks
+// up a changed address.
+func machineAddr(c *MachineConfig) (string, error) {
+	if machineIPCommand != "" {
+		return runIPCommand(machineIPCommand)
+	}
+
+	sshPort := 22
+	if c.Driver.SSHPort != 0 {
+		sshPort = c.Driver.SSHPort
+	}
+
+	// docker machine clears the address of a stopped machine
+	if c.Driver.IPAddress == "" {
+		return "", fmt.Errorf("machine %s has no IP address in its config and appears to be stopped; start it with docker-machine start %s or use --machine-ip-command", machineName, machineName)
+	}
+
+	return net.JoinHostPort(c.Driver.IPAddress, strconv.Itoa(sshPort)), nil
+}
+
+func runIPCommand(command string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("machine ip command failed: %s", err)
+	}
+
+	addr := strip(string(out))
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return "", fmt.Errorf("machine ip command returned %q; expected IP:PORT", addr)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return "", fmt.Errorf("machine ip command returned invalid port %q", port)
+	}
+
+	return addr, nil
+}
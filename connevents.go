@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Connection events written to --events-out with the connection state as
+// the op:
+//
+//	connected     the first connection to the machine
+//	lost          the connection dropped or stopped making progress; the
+//	              error says why
+//	reconnecting  a new connection is being made
+//	restored      a later connection succeeded
+//
+// They are written in the order they happen.  lost is written once per
+// connection and comes before the first reconnecting.  Each attempt writes
+// reconnecting followed by restored, or by lost again if it failed.
+const (
+	connConnected    = "connected"
+	connLost         = "lost"
+	connReconnecting = "reconnecting"
+	connRestored     = "restored"
+)
+
+var connEvents = &connectionEvents{}
+
+type connectionEvents struct {
+	mu        sync.Mutex
+	client    *ssh.Client
+	connected bool
+	seen      bool
+}
+
+// up records client as the current connection and watches it for drops.
+func (c *connectionEvents) up(client *ssh.Client) {
+	c.mu.Lock()
+	state := connConnected
+	if c.seen {
+		state = connRestored
+	}
+	c.client = client
+	c.connected = true
+	c.seen = true
+	c.mu.Unlock()
+
+	syncEvents.connection(state, nil)
+
+	go func() {
+		err := client.Wait()
+		c.lost(client, err)
+	}()
+}
+
+// lost records that client is no longer usable.  Anything but the current
+// connection, or one already reported, is ignored.
+func (c *connectionEvents) lost(client *ssh.Client, err error) {
+	c.mu.Lock()
+	if client != c.client || !c.connected {
+		c.mu.Unlock()
+		return
+	}
+	c.connected = false
+	c.mu.Unlock()
+
+	syncEvents.connection(connLost, err)
+}
+
+func (c *connectionEvents) reconnecting() {
+	syncEvents.connection(connReconnecting, nil)
+}
+
+// failed records a reconnect that didn't succeed.
+func (c *connectionEvents) failed(err error) {
+	syncEvents.connection(connLost, err)
+}
+
+// isUp reports whether the current connection hasn't been lost.
+func (c *connectionEvents) isUp() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.connected
+}
+
+func (c *connectionEvents) current() *ssh.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.client
+}
+
+// connection writes a connection event.
+func (e *eventWriter) connection(state string, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.w == nil {
+		return
+	}
+
+	ev := &syncEvent{
+		Time:    time.Now(),
+		Machine: machineName,
+		Op:      state,
+		Result:  "ok",
+	}
+	if err != nil {
+		ev.Result = "error"
+		ev.Error = err.Error()
+	}
+
+	e.write(ev)
+}
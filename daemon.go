@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+)
+
+// daemonEnv is set in the environment of the detached child so it knows
+// not to detach again.
+const daemonEnv = "_MACHINE_SYNC_DAEMON_CHILD"
+
+func isDaemonChild() bool {
+	return os.Getenv(daemonEnv) != ""
+}
+
+func logFilePath(c *cli.Context) string {
+	if p := c.GlobalString("log-file"); p != "" {
+		return p
+	}
+
+	if c.GlobalBool("daemon") {
+		return filepath.Join(os.TempDir(), fmt.Sprintf("machine-sync-%s.log", c.GlobalString("machine")))
+	}
+
+	return ""
+}
+
+// daemonize re-executes the current command in a new session with its
+// output going to logFile and returns once the child has started.
+func daemonize(logFile string) error {
+	attr, err := daemonSysProcAttr()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout = f
+	cmd.Stderr = f
+	cmd.SysProcAttr = attr
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	log.Infof("started daemon pid=%d log=%s", cmd.Process.Pid, logFile)
+
+	return nil
+}
+
+func writePidfile(p string) error {
+	return ioutil.WriteFile(p, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+func stopDaemon(c *cli.Context) {
+	pidfile := c.String("pidfile")
+	if pidfile == "" {
+		pidfile = c.GlobalString("pidfile")
+	}
+	if pidfile == "" {
+		log.Fatal("you must specify a pidfile")
+	}
+
+	data, err := ioutil.ReadFile(pidfile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		log.Fatalf("invalid pidfile %s: %s", pidfile, err)
+	}
+
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		log.Fatal(err)
+	}
+
+	// the daemon removes its pidfile once it has shut down
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(pidfile); os.IsNotExist(err) {
+			log.Infof("stopped pid=%d", pid)
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	log.Fatalf("pid %d did not exit", pid)
+}
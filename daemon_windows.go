@@ -0,0 +1,10 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func daemonSysProcAttr() (*syscall.SysProcAttr, error) {
+	return nil, errors.New("--daemon is not supported on windows")
+}
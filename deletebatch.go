@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/howeyc/fsnotify"
+)
+
+const (
+	// deleteBatchWindow is how long deletes are collected before they are
+	// sent to the machine together.
+	deleteBatchWindow = 100 * time.Millisecond
+	// deleteBatchMax is the most paths passed to one rm.
+	deleteBatchMax = 200
+)
+
+var (
+	batchDeletes bool
+	deletes      = &deleteBatcher{}
+	// noDelete keeps every remote path even when it is deleted locally.
+	// It takes precedence over any other option that removes files.
+	noDelete bool
+)
+
+// isRemoval reports whether ev removes its path: a delete, or any other
+// event for a path that no longer exists locally such as the old name of a
+// rename or a spilled event.
+func isRemoval(ev *fsnotify.FileEvent) bool {
+	if ev.IsDelete() {
+		return true
+	}
+
+	_, err := os.Lstat(ev.Name)
+	return os.IsNotExist(err)
+}
+
+// pendingDelete is a deleted local path.  remote is filled in once the
+// batch is running since the destination can change while it waits.
+type pendingDelete struct {
+	local  string
+	remote string
+	start  time.Time
+}
+
+// deleteBatcher collects delete events so a burst of them, such as from a
+// make clean, is removed with a single rm on the machine instead of one
+// sftp round trip per file.
+type deleteBatcher struct {
+	mu      sync.Mutex
+	pending []pendingDelete
+	timer   *time.Timer
+}
+
+func (b *deleteBatcher) add(ev *fsnotify.FileEvent) {
+	if noDelete {
+		logSkip(ev.Name, skipNoDelete)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pending = append(b.pending, pendingDelete{
+		local: ev.Name,
+		start: time.Now(),
+	})
+
+	if len(b.pending) >= deleteBatchMax {
+		if b.timer != nil {
+			b.timer.Stop()
+			b.timer = nil
+		}
+		batch := b.pending
+		b.pending = nil
+		go removeBatch(batch)
+		return
+	}
+
+	if b.timer == nil {
+		b.timer = time.AfterFunc(deleteBatchWindow, b.flush)
+	}
+}
+
+func (b *deleteBatcher) flush() {
+	b.mu.Lock()
+	batch := b.pending
+	b.pending = nil
+	b.timer = nil
+	b.mu.Unlock()
+
+	if len(batch) > 0 {
+		removeBatch(batch)
+	}
+}
+
+func removeBatch(batch []pendingDelete) {
+	defer transferBreaker.finish(transferBreaker.wait())
+	transferLimiter.acquire()
+	defer transferLimiter.release()
+
+	// a path created again since it was deleted must not be removed
+	remaining := batch[:0]
+	for _, d := range batch {
+		d.remote = remotePath(d.local)
+		if _, err := os.Lstat(d.local); err == nil {
+			logSkip(d.local, skipRecreated)
+			continue
+		}
+		remaining = append(remaining, d)
+	}
+	batch = remaining
+	if len(batch) == 0 {
+		return
+	}
+
+	var err error
+	if len(batch) > 1 && batchQuotable(batch) {
+		start := time.Now()
+		err = timeOp("rm-batch", destPath, func() error {
+			return rmBatch(batch)
+		})
+		if err == nil {
+			elapsed := time.Since(start)
+			log.Debugf("deleted %d paths in %s (%s per path)", len(batch), elapsed, elapsed/time.Duration(len(batch)))
+			for _, d := range batch {
+				log.Infof("deleting %s", d.remote)
+				finishDelete(d, nil)
+			}
+			return
+		}
+		log.Debugf("batch delete failed, deleting one at a time: %s", err)
+	}
+
+	for _, d := range batch {
+		log.Infof("deleting %s", d.remote)
+		finishDelete(d, removeFile(d.remote))
+	}
+}
+
+func finishDelete(d pendingDelete, err error) {
+	if isConnectionLost(err) && reconnects.requeue(&fsnotify.FileEvent{Name: d.local}, err) {
+		return
+	}
+	remoteStats.invalidate(d.remote)
+	if err != nil {
+		err = &syncError{op: "delete", local: d.local, remote: d.remote, err: err}
+	}
+	syncEvents.emit("delete", d.local, d.remote, 0, d.start, err)
+	transferBreaker.record(err)
+	syncStats.record(d.remote, err)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	postSync.trigger()
+}
+
+// batchQuotable reports whether every path can be passed safely through
+// the remote shell.  Anything with invalid utf-8 or control characters is
+// left to sftp.
+func batchQuotable(batch []pendingDelete) bool {
+	for _, d := range batch {
+		if !utf8.ValidString(d.remote) {
+			return false
+		}
+		for _, r := range d.remote {
+			if unicode.IsControl(r) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func rmBatch(batch []pendingDelete) error {
+	session, err := newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	args := []string{}
+	for _, d := range batch {
+		args = append(args, shellQuote(d.remote))
+		if encryptionKey != nil {
+			args = append(args, shellQuote(d.remote+encryptedExt))
+		}
+	}
+
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	if err := session.Run("rm -f -- " + strings.Join(args, " ")); err != nil {
+		return fmt.Errorf("%s: %s", err, strip(stderr.String()))
+	}
+
+	return nil
+}
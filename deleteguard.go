@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/howeyc/fsnotify"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var deleteGuard = &deletionGuard{}
+
+// deletionGuard holds back deletions once more than max are seen within
+// window, so an accidental rm -rf locally doesn't empty the machine too.
+// Held deletions are only made once confirmed, on the terminal or through
+// the status endpoint, and are dropped otherwise.
+type deletionGuard struct {
+	mu      sync.Mutex
+	max     int
+	window  time.Duration
+	times   []time.Time
+	tripped bool
+	held    []*fsnotify.FileEvent
+}
+
+// hold reports whether the deletion ev was held back.
+func (g *deletionGuard) hold(ev *fsnotify.FileEvent) bool {
+	if g.max < 1 || forceSync || noDelete || !isRemoval(ev) {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.tripped {
+		now := time.Now()
+		recent := g.times[:0]
+		for _, t := range g.times {
+			if now.Sub(t) < g.window {
+				recent = append(recent, t)
+			}
+		}
+		g.times = append(recent, now)
+		if len(g.times) <= g.max {
+			return false
+		}
+
+		g.tripped = true
+		log.Warnf("more than %d deletions within %s; holding back deletions until they are confirmed", g.max, g.window)
+		go confirmDeletes()
+	}
+
+	log.Warnf("holding back deletion of %s", ev.Name)
+	g.held = append(g.held, ev)
+
+	return true
+}
+
+// release lets deletions through again and returns the held ones, or
+// drops them when they weren't confirmed.
+func (g *deletionGuard) release(confirmed bool) []*fsnotify.FileEvent {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	held := g.held
+	g.held = nil
+	g.times = nil
+	g.tripped = false
+
+	if !confirmed {
+		log.Warnf("dropped %d held back deletions; the files remain on %s", len(held), machineName)
+		return nil
+	}
+	log.Infof("deleting %d held back paths", len(held))
+
+	return held
+}
+
+func (g *deletionGuard) heldCount() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return len(g.held)
+}
+
+// releaseDeletes makes or drops the held deletions.  Paths that exist
+// again, such as after a git checkout, are left alone.
+func releaseDeletes(confirmed bool) {
+	for _, ev := range deleteGuard.release(confirmed) {
+		if _, err := os.Lstat(ev.Name); err == nil {
+			logSkip(ev.Name, skipRecreated)
+			continue
+		}
+		enqueue(ev)
+	}
+}
+
+// canConfirmDeletes reports whether held deletions can be confirmed, on
+// the terminal or through the status endpoint.  A daemon has no terminal.
+func canConfirmDeletes(c *cli.Context) bool {
+	if c.GlobalString("status-addr") != "" {
+		return true
+	}
+
+	return !c.GlobalBool("daemon") && terminal.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// confirmDeletes asks on the terminal whether to make the held deletions
+// once they have settled.  Without a terminal they wait for the status
+// endpoint.
+func confirmDeletes() {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		log.Warn("confirm the held back deletions with POST /deletes/release on --status-addr, or drop them with POST /deletes/drop")
+		return
+	}
+
+	// let the burst finish so the count is complete
+	for n := -1; n != deleteGuard.heldCount(); {
+		n = deleteGuard.heldCount()
+		time.Sleep(time.Second)
+	}
+
+	fmt.Fprintf(os.Stderr, "delete %d paths on %s? [y/N] ", deleteGuard.heldCount(), machineName)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer := strings.ToLower(strings.TrimSpace(line))
+	releaseDeletes(answer == "y" || answer == "yes")
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// deltaBlockSize is the unit files are compared in with --delta.
+	deltaBlockSize = 128 * 1024
+	// deltaBase and deltaPrime define the polynomial hash confirming the
+	// blocks the weak checksum matches.  Every intermediate value stays
+	// below 2^53 so awk on the machine computes it exactly.
+	deltaBase  = 257
+	deltaPrime = 17592186044399
+)
+
+var deltaUploads bool
+
+// blockSig is the checksum of a block of the remote file.  weak is the
+// rsync checksum and strong the polynomial hash; both roll over the data
+// a byte at a time.
+type blockSig struct {
+	weak   uint32
+	strong uint64
+}
+
+// rollingSum computes the checksums of a deltaBlockSize window of data.
+type rollingSum struct {
+	a, b   uint32
+	strong uint64
+}
+
+// deltaPow is deltaBase to the power of deltaBlockSize-1, the weight of
+// the byte leaving the window.
+var deltaPow = func() uint64 {
+	p := uint64(1)
+	for i := 1; i < deltaBlockSize; i++ {
+		p = p * deltaBase % deltaPrime
+	}
+	return p
+}()
+
+func newRollingSum(block []byte) *rollingSum {
+	r := &rollingSum{}
+	for i, c := range block {
+		r.a += uint32(c)
+		r.b += uint32(len(block)-i) * uint32(c)
+		r.strong = (r.strong*deltaBase + uint64(c)) % deltaPrime
+	}
+	return r
+}
+
+// roll moves the window a byte forward, dropping out and adding in.
+func (r *rollingSum) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - deltaBlockSize*uint32(out)
+	r.strong = ((r.strong+deltaPrime-uint64(out)*deltaPow%deltaPrime)*deltaBase + uint64(in)) % deltaPrime
+}
+
+func (r *rollingSum) sig() blockSig {
+	return blockSig{weak: r.a&0xffff | r.b<<16, strong: r.strong}
+}
+
+// deltaOp is a step in rebuilding a file: n bytes copied from off in the
+// old file, or taken from the literal data when literal is set.
+type deltaOp struct {
+	literal bool
+	off     int64
+	n       int64
+}
+
+// computeDelta finds the blocks of the old file, given by their
+// signatures, at any offset of data.  It returns the steps rebuilding data
+// and the literal data they need; bytes inserted or removed only add to
+// the literal data around them.
+func computeDelta(sigs []blockSig, data []byte) ([]deltaOp, []byte) {
+	index := map[blockSig]int64{}
+	for i := len(sigs) - 1; i >= 0; i-- {
+		index[sigs[i]] = int64(i)
+	}
+
+	ops := []deltaOp{}
+	literal := []byte{}
+	addLiteral := func(b []byte) {
+		if len(b) == 0 {
+			return
+		}
+		if n := len(ops); n > 0 && ops[n-1].literal {
+			ops[n-1].n += int64(len(b))
+		} else {
+			ops = append(ops, deltaOp{literal: true, off: int64(len(literal)), n: int64(len(b))})
+		}
+		literal = append(literal, b...)
+	}
+
+	start, off := 0, 0
+	var r *rollingSum
+	if len(data) >= deltaBlockSize {
+		r = newRollingSum(data[:deltaBlockSize])
+	}
+	for off+deltaBlockSize <= len(data) {
+		i, ok := index[r.sig()]
+		if !ok {
+			if off+deltaBlockSize < len(data) {
+				r.roll(data[off], data[off+deltaBlockSize])
+			}
+			off++
+			continue
+		}
+
+		addLiteral(data[start:off])
+		old := i * deltaBlockSize
+		if n := len(ops); n > 0 && !ops[n-1].literal && ops[n-1].off+ops[n-1].n == old {
+			ops[n-1].n += deltaBlockSize
+		} else {
+			ops = append(ops, deltaOp{off: old, n: deltaBlockSize})
+		}
+
+		off += deltaBlockSize
+		start = off
+		if off+deltaBlockSize <= len(data) {
+			r = newRollingSum(data[off : off+deltaBlockSize])
+		}
+	}
+	addLiteral(data[start:])
+
+	return ops, literal
+}
+
+// blockSigCommand prints the signature of each whole block of filePath.
+// It only needs od and awk so it runs on any machine with a shell.
+func blockSigCommand(filePath string) string {
+	return fmt.Sprintf(`od -An -v -tu1 %s | awk -v L=%d -v B=%d -v P=%d '{
+	for (i = 1; i <= NF; i++) {
+		x = $i; a = (a + x) %% 65536; b = (b + (L - n) * x) %% 65536; h = (h * B + x) %% P
+		if (++n == L) { printf "%%.0f %%.0f %%.0f\n", a, b, h; a = b = h = n = 0 }
+	}
+}'`, shellQuote(filePath), deltaBlockSize, deltaBase, deltaPrime)
+}
+
+func parseBlockSigs(r io.Reader) ([]blockSig, error) {
+	sigs := []blockSig{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected block signature %q", scanner.Text())
+		}
+		var v [3]uint64
+		for i, f := range fields {
+			n, err := strconv.ParseUint(f, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = n
+		}
+		sigs = append(sigs, blockSig{weak: uint32(v[0] | v[1]<<16), strong: v[2]})
+	}
+
+	return sigs, scanner.Err()
+}
+
+// remoteBlockSigs computes the signatures of filePath on the machine.
+func remoteBlockSigs(filePath string, size int64) ([]blockSig, error) {
+	session, err := newSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	// the signatures trickle out as the file is read
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &progressWriter{&stdout}
+	session.Stderr = &stderr
+	if err := session.Run(blockSigCommand(filePath)); err != nil {
+		return nil, fmt.Errorf("%s: %s", err, strip(stderr.String()))
+	}
+
+	sigs, err := parseBlockSigs(&stdout)
+	if err != nil {
+		return nil, err
+	}
+	if n := size / deltaBlockSize; int64(len(sigs)) != n {
+		return nil, fmt.Errorf("expected %d block signatures, got %d", n, len(sigs))
+	}
+
+	return sigs, nil
+}
+
+// deltaScript is the shell script writing tmp from the old file and the
+// literal data as ops describe.
+func deltaScript(oldPath, literalPath, tmp string, ops []deltaOp) string {
+	var b strings.Builder
+	b.WriteString("{\n")
+	for _, op := range ops {
+		src := oldPath
+		if op.literal {
+			src = literalPath
+		}
+		fmt.Fprintf(&b, "tail -c +%d %s | head -c %d\n", op.off+1, shellQuote(src), op.n)
+	}
+	fmt.Fprintf(&b, "} > %s\n", shellQuote(tmp))
+
+	return b.String()
+}
+
+// uploadDelta updates an existing file on the machine by sending only the
+// data it doesn't already have.  Blocks of the remote file are found in
+// data with a rolling checksum, so inserting or removing bytes doesn't
+// resend the rest of the file.  The new file is rebuilt on the machine
+// next to the old one, checked and renamed over it.  It returns false
+// without changing anything when the file has to be uploaded in full.
+func uploadDelta(filePath string, data []byte) (bool, error) {
+	fi, err := remoteStats.stat(filePath)
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() < deltaBlockSize {
+		return false, nil
+	}
+	defer remoteStats.invalidate(filePath)
+
+	sigs, err := remoteBlockSigs(filePath, fi.Size())
+	if err != nil {
+		log.Debugf("delta not available for %s: %s", filePath, err)
+		return false, nil
+	}
+
+	ops, literal := computeDelta(sigs, data)
+	if len(literal) == len(data) {
+		log.Debugf("delta %s: no blocks in common", filePath)
+		return false, nil
+	}
+
+	literalPath := filePath + ".delta" + tempSuffix
+	tmp := filePath + tempSuffix
+	defer rsftp.Remove(literalPath)
+	if err := writeRemote(literalPath, literal); err != nil {
+		log.Debugf("delta %s: %s", filePath, err)
+		return false, nil
+	}
+
+	if err := timeOp("write", filePath, func() error {
+		session, err := newSession()
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+
+		var stderr bytes.Buffer
+		session.Stdin = strings.NewReader(deltaScript(filePath, literalPath, tmp, ops))
+		session.Stderr = &stderr
+		if err := session.Run("sh"); err != nil {
+			return fmt.Errorf("%s: %s", err, strip(stderr.String()))
+		}
+		return nil
+	}); err != nil {
+		rsftp.Remove(tmp)
+		log.Debugf("delta %s: %s", filePath, err)
+		return false, nil
+	}
+
+	sum := sha256.Sum256(data)
+	if err := verifyRemote(map[string]string{tmp: hex.EncodeToString(sum[:])}); err != nil {
+		rsftp.Remove(tmp)
+		log.Debugf("delta %s: %s", filePath, err)
+		return false, nil
+	}
+
+	if err := rsftp.Chmod(tmp, fi.Mode().Perm()); err != nil {
+		log.Debugf("unable to set mode on %s: %s", tmp, err)
+	}
+	// mv renames within the directory, replacing the old file atomically
+	if err := timeOp("rename", filePath, func() error {
+		return runRemote(fmt.Sprintf("mv -f -- %s %s", shellQuote(tmp), shellQuote(filePath)))
+	}); err != nil {
+		rsftp.Remove(tmp)
+		return true, err
+	}
+
+	log.Debugf("delta %s: sent %s of %s", filePath, formatBytes(int64(len(literal))), formatBytes(int64(len(data))))
+
+	return true, nil
+}
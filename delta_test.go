@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func blockSigs(data []byte) []blockSig {
+	sigs := []blockSig{}
+	for off := 0; off+deltaBlockSize <= len(data); off += deltaBlockSize {
+		sigs = append(sigs, newRollingSum(data[off:off+deltaBlockSize]).sig())
+	}
+	return sigs
+}
+
+func requireShell(t *testing.T) {
+	for _, cmd := range []string{"sh", "od", "awk", "tail", "head"} {
+		if _, err := exec.LookPath(cmd); err != nil {
+			t.Skipf("%s not available", cmd)
+		}
+	}
+}
+
+func TestRollingSum(t *testing.T) {
+	data := randomData(1, deltaBlockSize+1000)
+
+	r := newRollingSum(data[:deltaBlockSize])
+	for off := 1; off <= 1000; off++ {
+		r.roll(data[off-1], data[off+deltaBlockSize-1])
+		if want := newRollingSum(data[off : off+deltaBlockSize]).sig(); r.sig() != want {
+			t.Fatalf("offset %d: rolled %v, want %v", off, r.sig(), want)
+		}
+	}
+}
+
+func TestBlockSigCommand(t *testing.T) {
+	requireShell(t)
+
+	data := randomData(2, 3*deltaBlockSize+100)
+	dir, err := ioutil.TempDir("", "delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := filepath.Join(dir, "old")
+	if err := ioutil.WriteFile(f, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command("sh", "-c", blockSigCommand(f)).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigs, err := parseBlockSigs(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := blockSigs(data)
+	if len(sigs) != len(want) {
+		t.Fatalf("got %d signatures, want %d", len(sigs), len(want))
+	}
+	for i := range want {
+		if sigs[i] != want[i] {
+			t.Errorf("block %d: got %v, want %v", i, sigs[i], want[i])
+		}
+	}
+}
+
+// TestDeltaMatchesFullUpload rebuilds the file the way the machine does and
+// checks it against the content a full upload would write.
+func TestDeltaMatchesFullUpload(t *testing.T) {
+	requireShell(t)
+
+	dir, err := ioutil.TempDir("", "delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := randomData(3, 8*deltaBlockSize+500)
+	oldPath := filepath.Join(dir, "old")
+	literalPath := filepath.Join(dir, "literal")
+	tmp := filepath.Join(dir, "new")
+	if err := ioutil.WriteFile(oldPath, old, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	edit := func(f func([]byte) []byte) []byte {
+		return f(append([]byte{}, old...))
+	}
+
+	tests := []struct {
+		name       string
+		data       []byte
+		maxLiteral int
+	}{
+		{"unchanged", old, 500},
+		{"inserted at start", edit(func(b []byte) []byte {
+			return append([]byte("inserted"), b...)
+		}), deltaBlockSize + 600},
+		{"changed in middle", edit(func(b []byte) []byte {
+			copy(b[3*deltaBlockSize+10:], "changed")
+			return b
+		}), deltaBlockSize + 500},
+		{"removed from middle", edit(func(b []byte) []byte {
+			return append(b[:2*deltaBlockSize+7], b[2*deltaBlockSize+1007:]...)
+		}), deltaBlockSize + 500},
+		{"appended", edit(func(b []byte) []byte {
+			return append(b, randomData(4, 1000)...)
+		}), 1500},
+		{"truncated", old[:5*deltaBlockSize+20], 20},
+		{"blocks reordered", edit(func(b []byte) []byte {
+			return append(append([]byte{}, b[4*deltaBlockSize:]...), b[:4*deltaBlockSize]...)
+		}), 500},
+		{"replaced", randomData(5, len(old)), len(old)},
+	}
+
+	for _, test := range tests {
+		ops, literal := computeDelta(blockSigs(old), test.data)
+		if len(literal) > test.maxLiteral {
+			t.Errorf("%s: sent %d bytes, want at most %d", test.name, len(literal), test.maxLiteral)
+		}
+		if err := ioutil.WriteFile(literalPath, literal, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		cmd := exec.Command("sh")
+		cmd.Stdin = bytes.NewReader([]byte(deltaScript(oldPath, literalPath, tmp, ops)))
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		got, err := ioutil.ReadFile(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, test.data) {
+			t.Errorf("%s: rebuilt file differs from a full upload", test.name)
+		}
+	}
+}
+
+func TestUploadDelta(t *testing.T) {
+	requireExec(t)
+	requireShell(t)
+
+	s := startTestServer(t)
+	defer s.kill()
+	dest, cleanup := testTree(t)
+	defer cleanup()
+	connectTestServer(t, s)
+
+	local := filepath.Join("src", "large")
+	old := randomData(6, 16*deltaBlockSize)
+	writeTestFile(t, local, old)
+	if err := uploadFile(local, remotePath(local)); err != nil {
+		t.Fatal(err)
+	}
+
+	delta := deltaUploads
+	deltaUploads = true
+	defer func() { deltaUploads = delta }()
+
+	data := append(append([]byte{}, old[:5*deltaBlockSize]...), "inserted"...)
+	data = append(data, old[5*deltaBlockSize:]...)
+	writeTestFile(t, local, data)
+
+	sent := syncStats.snapshot().Bytes
+	if err := uploadFile(local, remotePath(local)); err != nil {
+		t.Fatal(err)
+	}
+	if n := syncStats.snapshot().Bytes - sent; n > deltaBlockSize {
+		t.Errorf("sent %d bytes, want at most %d", n, deltaBlockSize)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(dest, local))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("file differs on the machine")
+	}
+	if _, err := os.Stat(filepath.Join(dest, local) + tempSuffix); !os.IsNotExist(err) {
+		t.Error("temporary file left on the machine")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/howeyc/fsnotify"
+)
+
+// destMarkerName is the file that sets the destination of the directory it
+// is in and everything below it.  It holds a single path on the machine;
+// a relative one is below the destination.  The nearest marker above a
+// path wins.
+const destMarkerName = ".machinesync-dest"
+
+var destMarkers = &markerIndex{dests: map[string]string{}}
+
+// markerIndex maps the local directories with a marker to their
+// destinations as written in the marker.
+type markerIndex struct {
+	mu    sync.RWMutex
+	dests map[string]string
+}
+
+// loadTree reads every marker below root.
+func (m *markerIndex) loadTree(root string) error {
+	return walkTree(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() && fi.Name() == destMarkerName {
+			return m.load(p)
+		}
+
+		return nil
+	})
+}
+
+// load (re)reads the marker at p, dropping it when it no longer exists.
+func (m *markerIndex) load(p string) error {
+	dir := filepath.Clean(filepath.Dir(p))
+
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			m.mu.Lock()
+			delete(m.dests, dir)
+			m.mu.Unlock()
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	dest := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			dest = line
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if dest == "" {
+		log.Warnf("%s is empty; ignoring it", p)
+		delete(m.dests, dir)
+		return nil
+	}
+	log.Debugf("syncing %s to %s", dir, dest)
+	m.dests[dir] = dest
+
+	return nil
+}
+
+// resolve returns the destination on the machine for a marker's path.
+func (m *markerIndex) resolve(dest string) string {
+	if path.IsAbs(dest) {
+		return chrootPath(path.Clean(dest))
+	}
+
+	return path.Join(destPath, dest)
+}
+
+// route returns the remote path of localPath when a marker above it sets
+// its destination.
+func (m *markerIndex) route(localPath string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if len(m.dests) == 0 {
+		return "", false
+	}
+
+	p := filepath.Clean(localPath)
+	for dir := p; ; dir = filepath.Dir(dir) {
+		if dest, ok := m.dests[dir]; ok {
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return "", false
+			}
+			return path.Join(m.resolve(dest), filepath.ToSlash(rel)), true
+		}
+		if next := filepath.Dir(dir); next == dir || dir == filepath.Clean(srcPath) {
+			return "", false
+		}
+	}
+}
+
+func (m *markerIndex) empty() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.dests) == 0
+}
+
+// owns reports whether filePath on the machine is inside a marker's
+// destination, which mirroring the directory leaves alone.
+func (m *markerIndex) owns(filePath string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, dest := range m.dests {
+		d := m.resolve(dest)
+		if filePath == d || strings.HasPrefix(filePath, d+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reloadMarker rereads a changed marker and resyncs its directory to the
+// new destination.
+func reloadMarker(p string) {
+	if err := destMarkers.load(p); err != nil {
+		log.Errorf("unable to load %s: %s", p, err)
+		return
+	}
+
+	dir := filepath.Dir(p)
+	log.Infof("destination of %s changed to %s; resyncing it", dir, remotePath(dir))
+	walkTree(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if isExcluded(p, fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		dispatch(&fsnotify.FileEvent{Name: p})
+		return nil
+	})
+}
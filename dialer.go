@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/codegangsta/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+// Transports the ssh connection can run over (--dialer):
+//
+//	direct        a tcp connection to the machine
+//	http-connect  a tunnel through the HTTP proxy given by --http-proxy,
+//	              opened with CONNECT.  An https:// proxy is reached over
+//	              TLS and credentials in the url are sent as basic auth.
+const (
+	dialerDirect      = "direct"
+	dialerHTTPConnect = "http-connect"
+)
+
+var (
+	dialerName = dialerDirect
+	httpProxy  *url.URL
+)
+
+// parseHTTPProxy checks a --http-proxy url.
+func parseHTTPProxy(v string) (*url.URL, error) {
+	u, err := url.Parse(v)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("http proxy %s must be an http:// or https:// url", v)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("http proxy %s has no host", v)
+	}
+
+	return u, nil
+}
+
+// dialSSH opens an ssh connection to addr over the --dialer transport.
+func dialSSH(addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := dialMachine(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+func dialMachine(addr string) (net.Conn, error) {
+	if dialerName == dialerHTTPConnect {
+		if httpProxy == nil {
+			return nil, fmt.Errorf("--dialer %s requires a valid --http-proxy", dialerHTTPConnect)
+		}
+		return dialHTTPConnect(httpProxy, addr)
+	}
+
+	return net.Dial("tcp", addr)
+}
+
+// dialHTTPConnect asks the proxy for a tunnel to addr.
+func dialHTTPConnect(proxy *url.URL, addr string) (net.Conn, error) {
+	host := proxy.Host
+	if proxy.Port() == "" {
+		port := "80"
+		if proxy.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(proxy.Hostname(), port)
+	}
+
+	var conn net.Conn
+	var err error
+	if proxy.Scheme == "https" {
+		conn, err = tls.Dial("tcp", host, &tls.Config{ServerName: proxy.Hostname()})
+	} else {
+		conn, err = net.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach http proxy %s: %s", host, err)
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if proxy.User != nil {
+		pass, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s: %s", host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s refused the tunnel to %s: %s", host, addr, resp.Status)
+	}
+
+	// the machine may have sent its banner along with the response
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn reads what was buffered while reading the proxy response
+// before the rest of the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func configureDialer(c *cli.Context) {
+	dialerName = c.GlobalString("dialer")
+	if dialerName == dialerHTTPConnect {
+		httpProxy, _ = parseHTTPProxy(c.GlobalString("http-proxy"))
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+)
+
+// Kinds of change in a dry run plan.
+const (
+	changeNew       = "new"
+	changeUpdate    = "update"
+	changeDelete    = "delete"
+	changeUnchanged = "unchanged"
+	changeUpload    = "upload"
+)
+
+// plannedChange is what a sync would do to one path on the machine.
+type plannedChange struct {
+	kind     string
+	filePath string
+}
+
+// dryRun prints what the initial sync would change and exits without
+// writing anything.  A local dry run lists what would be uploaded; a
+// remote one connects and compares against the files on the machine.
+func dryRun(c *cli.Context, mode string) {
+	if err := configure(c); err != nil {
+		log.Fatal(err)
+	}
+
+	paths, err := syncPaths()
+	if err != nil {
+		log.Fatal(err)
+	}
+	paths = orderPaths(paths)
+
+	var plan []plannedChange
+	if mode == "remote" {
+		if err := connect(c); err != nil {
+			log.Fatal(err)
+		}
+		if plan, err = remotePlan(paths); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		for _, p := range paths {
+			plan = append(plan, plannedChange{changeUpload, remotePath(p)})
+		}
+	}
+
+	printPlan(plan)
+}
+
+// remotePlan compares the local paths with the machine.  Files that
+// exist on both are compared by sha256.
+func remotePlan(paths []string) ([]plannedChange, error) {
+	plan := []plannedChange{}
+	expected := map[string]string{}
+	for _, p := range paths {
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return nil, err
+		}
+
+		filePath := remotePath(p)
+		if encryptionKey != nil && fi.Mode().IsRegular() {
+			filePath += encryptedExt
+		}
+		rfi, err := remoteStats.stat(filePath)
+		if err != nil {
+			if !isNotExist(err) {
+				return nil, err
+			}
+			plan = append(plan, plannedChange{changeNew, filePath})
+			continue
+		}
+
+		switch {
+		case fi.IsDir():
+			if !rfi.IsDir() {
+				plan = append(plan, plannedChange{changeUpdate, filePath})
+			}
+		case fi.Mode().IsRegular():
+			if !rfi.Mode().IsRegular() {
+				plan = append(plan, plannedChange{changeUpdate, filePath})
+				continue
+			}
+			hash, err := localHash(p)
+			if err != nil {
+				return nil, err
+			}
+			expected[filePath] = hash
+		}
+	}
+
+	if len(expected) > 0 {
+		filePaths := make([]string, 0, len(expected))
+		for p := range expected {
+			filePaths = append(filePaths, p)
+		}
+		sort.Strings(filePaths)
+
+		hashes := remoteHashes
+		if encryptionKey != nil {
+			hashes = decryptedHashes
+		}
+		actual, err := hashes(filePaths)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range filePaths {
+			kind := changeUnchanged
+			if actual[p] != expected[p] {
+				kind = changeUpdate
+			}
+			plan = append(plan, plannedChange{kind, p})
+		}
+	}
+
+	// only a mirror deletes what isn't local
+	if mirrorMode && singleFile == "" {
+		extra, err := extraRemotePaths()
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range extra {
+			plan = append(plan, plannedChange{changeDelete, p})
+		}
+	}
+
+	return plan, nil
+}
+
+func printPlan(plan []plannedChange) {
+	counts := map[string]int{}
+	for _, c := range plan {
+		counts[c.kind]++
+		if c.kind != changeUnchanged {
+			fmt.Printf("%-9s %s\n", c.kind, c.filePath)
+		}
+	}
+
+	if n, ok := counts[changeUpload]; ok {
+		fmt.Printf("%d paths would be uploaded\n", n)
+		return
+	}
+	fmt.Printf("%d new, %d updated, %d deleted, %d unchanged\n", counts[changeNew], counts[changeUpdate], counts[changeDelete], counts[changeUnchanged])
+}
+
+// decryptedHashes returns the sha256 of the decrypted content of each
+// encrypted remote path.  Encryption uses a new nonce every time so the
+// stored files can't be compared as they are.
+func decryptedHashes(filePaths []string) (map[string]string, error) {
+	hashes := map[string]string{}
+	for _, p := range filePaths {
+		f, err := rsftp.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		// a file that doesn't decrypt with the key is different
+		plain, err := decrypt(encryptionKey, data)
+		if err != nil {
+			hashes[p] = ""
+			continue
+		}
+		sum := sha256.Sum256(plain)
+		hashes[p] = hex.EncodeToString(sum[:])
+	}
+
+	return hashes, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+)
+
+// encryptedExt is appended to the name of every file written encrypted.
+const encryptedExt = ".enc"
+
+// encryptedMagic starts every encrypted file.  It is followed by a version
+// byte and the nonce, and the whole header is authenticated along with the
+// content.
+const (
+	encryptedMagic   = "MSENC"
+	encryptedVersion = 1
+)
+
+// encryptionKey is the AES-256 key files are encrypted with before upload
+// when --encrypt is set.
+var encryptionKey []byte
+
+// loadEncryptionKey reads a hex encoded 32 byte key from keyPath.  The key
+// is read from a file rather than taken on the command line so it doesn't
+// show up in the process list.
+func loadEncryptionKey(keyPath string) ([]byte, error) {
+	fi, err := os.Stat(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm()&0077 != 0 {
+		log.Warnf("encryption key %s is readable by other users; chmod 600 it", keyPath)
+	}
+
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("encryption key %s must be 32 bytes hex encoded (e.g. from openssl rand -hex 32)", keyPath)
+	}
+
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// encrypt seals data with AES-GCM under a random nonce.
+func encrypt(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(encryptedMagic)+1+gcm.NonceSize())
+	copy(header, encryptedMagic)
+	header[len(encryptedMagic)] = encryptedVersion
+	nonce := header[len(encryptedMagic)+1:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(header, nonce, data, header), nil
+}
+
+// decrypt opens data written by encrypt.
+func decrypt(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(encryptedMagic) + 1 + gcm.NonceSize()
+	if len(data) < n || !bytes.HasPrefix(data, []byte(encryptedMagic)) {
+		return nil, errors.New("not an encrypted file")
+	}
+	if v := data[len(encryptedMagic)]; v != encryptedVersion {
+		return nil, fmt.Errorf("unsupported encryption version %d", v)
+	}
+
+	header := data[:n]
+	plain, err := gcm.Open(nil, header[len(encryptedMagic)+1:], data[n:], header)
+	if err != nil {
+		return nil, errors.New("unable to decrypt: wrong key or corrupted file")
+	}
+
+	return plain, nil
+}
+
+// decryptFiles decrypts each file copied back from the machine next to
+// it, without the .enc extension.
+func decryptFiles(c *cli.Context) {
+	keyPath := c.GlobalString("encryption-key")
+	if keyPath == "" {
+		log.Fatal("you must specify --encryption-key")
+	}
+	if len(c.Args()) == 0 {
+		log.Fatal("you must specify the files to decrypt")
+	}
+
+	key, err := loadEncryptionKey(keyPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := false
+	for _, p := range c.Args() {
+		if !strings.HasSuffix(p, encryptedExt) {
+			log.Errorf("%s does not end in %s", p, encryptedExt)
+			failed = true
+			continue
+		}
+
+		data, err := ioutil.ReadFile(p)
+		if err == nil {
+			data, err = decrypt(key, data)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(strings.TrimSuffix(p, encryptedExt), data, 0600)
+		}
+		if err != nil {
+			log.Errorf("%s: %s", p, err)
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
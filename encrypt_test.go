@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	key := testKey(1)
+
+	for _, data := range [][]byte{nil, []byte("secret"), randomData(6, 1<<20)} {
+		sealed, err := encrypt(key, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(sealed, []byte(encryptedMagic)) || sealed[len(encryptedMagic)] != encryptedVersion {
+			t.Errorf("missing header")
+		}
+		if len(data) > 0 && bytes.Contains(sealed, data) {
+			t.Errorf("content was not encrypted")
+		}
+
+		plain, err := decrypt(key, sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plain, data) {
+			t.Errorf("decrypted %d bytes differ from the %d encrypted", len(plain), len(data))
+		}
+	}
+}
+
+func TestEncryptUsesFreshNonces(t *testing.T) {
+	a, _ := encrypt(testKey(1), []byte("same"))
+	b, _ := encrypt(testKey(1), []byte("same"))
+	if bytes.Equal(a, b) {
+		t.Error("encrypting twice gave the same output")
+	}
+}
+
+func TestDecryptRejects(t *testing.T) {
+	sealed, err := encrypt(testKey(1), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := func(i int) []byte {
+		b := append([]byte{}, sealed...)
+		b[i] ^= 1
+		return b
+	}
+
+	tests := []struct {
+		name string
+		key  []byte
+		data []byte
+	}{
+		{"wrong key", testKey(2), sealed},
+		{"changed content", testKey(1), corrupt(len(sealed) - 1)},
+		{"changed nonce", testKey(1), corrupt(len(encryptedMagic) + 1)},
+		{"unknown version", testKey(1), corrupt(len(encryptedMagic))},
+		{"not encrypted", testKey(1), []byte("plain text that is long enough")},
+		{"truncated", testKey(1), sealed[:len(encryptedMagic)+4]},
+	}
+
+	for _, test := range tests {
+		if _, err := decrypt(test.key, test.data); err == nil {
+			t.Errorf("%s: decrypted", test.name)
+		}
+	}
+}
+
+func TestLoadEncryptionKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		content string
+		valid   bool
+	}{
+		{hex.EncodeToString(testKey(3)) + "\n", true},
+		{hex.EncodeToString(testKey(3)[:16]), false},
+		{"not hex", false},
+	}
+
+	for i, test := range tests {
+		p := filepath.Join(dir, string(rune('a'+i)))
+		if err := ioutil.WriteFile(p, []byte(test.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		key, err := loadEncryptionKey(p)
+		if (err == nil) != test.valid {
+			t.Errorf("loading %q: unexpected error %v", test.content, err)
+		}
+		if test.valid && !bytes.Equal(key, testKey(3)) {
+			t.Errorf("loading %q gave the wrong key", test.content)
+		}
+	}
+}
+
+// TestEncryptedUpload uploads a file with --encrypt and decrypts what was
+// written on the machine.
+func TestEncryptedUpload(t *testing.T) {
+	s := startTestServer(t)
+	defer s.kill()
+	dest, cleanup := testTree(t)
+	defer cleanup()
+	connectTestServer(t, s)
+
+	defer func(key []byte) { encryptionKey = key }(encryptionKey)
+	encryptionKey = testKey(4)
+
+	local := filepath.Join("src", "secret.txt")
+	data := []byte("top secret\n")
+	writeTestFile(t, local, data)
+	if err := uploadFile(local, remotePath(local)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dest, local)); !os.IsNotExist(err) {
+		t.Error("the file was written unencrypted")
+	}
+	sealed, err := ioutil.ReadFile(filepath.Join(dest, local+encryptedExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := decrypt(encryptionKey, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, data) {
+		t.Errorf("decrypted %q, want %q", plain, data)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+)
+
+var (
+	normalizeEOL       bool
+	eolStyle           = "lf"
+	eolPatterns        []string
+	defaultEOLPatterns = []string{
+		"*.sh", "*.bash", "*.py", "*.pl", "*.rb",
+		"*.conf", "*.cfg", "*.ini", "*.yml", "*.yaml",
+		"Dockerfile", "Makefile",
+	}
+)
+
+func matchesEOLPattern(p string) bool {
+	name := filepath.Base(p)
+	for _, pattern := range eolPatterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// convertEOL returns data with its line endings converted to eolStyle when
+// normalization is enabled and p is a text file matching eolPatterns.
+// Anything else is returned untouched.
+func convertEOL(p string, data []byte) []byte {
+	if !normalizeEOL || !matchesEOLPattern(p) {
+		return data
+	}
+
+	binary, err := isBinaryFile(p)
+	if err != nil {
+		binary = isBinary(data)
+	}
+	if binary {
+		return data
+	}
+
+	lf := bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	if eolStyle == "crlf" {
+		return bytes.Replace(lf, []byte("\n"), []byte("\r\n"), -1)
+	}
+
+	return lf
+}
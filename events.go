@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var syncEvents = &eventWriter{}
+
+// syncEvent is written to --events-out as a line of json for every action
+// and connection change.
+type syncEvent struct {
+	Time     time.Time `json:"time"`
+	Machine  string    `json:"machine"`
+	Op       string    `json:"op"`
+	Path     string    `json:"path"`
+	Remote   string    `json:"remote"`
+	Bytes    int64     `json:"bytes"`
+	Duration float64   `json:"duration_ms"`
+	Result   string    `json:"result"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type eventWriter struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// openEventsOut opens the events destination.  unix: and tcp: prefixes
+// connect to a socket, anything else is a file that is appended to.
+func openEventsOut(dest string) (io.WriteCloser, error) {
+	switch {
+	case strings.HasPrefix(dest, "unix:"):
+		return net.Dial("unix", strings.TrimPrefix(dest, "unix:"))
+	case strings.HasPrefix(dest, "tcp:"):
+		return net.Dial("tcp", strings.TrimPrefix(dest, "tcp:"))
+	default:
+		return os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	}
+}
+
+func (e *eventWriter) open(dest string) error {
+	w, err := openEventsOut(dest)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	e.w = w
+	e.mu.Unlock()
+
+	return nil
+}
+
+// emit writes an event for an action on localPath that started at start.
+func (e *eventWriter) emit(op, localPath, filePath string, bytes int64, start time.Time, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.w == nil {
+		return
+	}
+
+	ev := &syncEvent{
+		Time:     time.Now(),
+		Machine:  machineName,
+		Op:       op,
+		Path:     localPath,
+		Remote:   filePath,
+		Bytes:    bytes,
+		Duration: float64(time.Since(start)) / float64(time.Millisecond),
+		Result:   "ok",
+	}
+	if err != nil {
+		ev.Result = "error"
+		ev.Error = err.Error()
+	}
+
+	e.write(ev)
+}
+
+// write sends ev as a json line.  It is called with e.mu held.
+func (e *eventWriter) write(ev *syncEvent) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	if _, err := e.w.Write(append(data, '\n')); err != nil {
+		log.Warnf("unable to write to events output; disabling: %s", err)
+		e.w.Close()
+		e.w = nil
+	}
+}
+
+func fileSize(p string) int64 {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return 0
+	}
+
+	return fi.Size()
+}
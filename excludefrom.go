@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// excludeFrom holds the patterns read from --exclude-from files.
+var excludeFrom = &excludeLists{rules: map[string][]ignoreRule{}}
+
+// excludeLists are pattern files given with --exclude-from, like rsync's
+// option of the same name.  Patterns use .gitignore syntax and are
+// relative to the synced directory wherever the file itself is; later
+// files take precedence over earlier ones and ! includes a path again.
+type excludeLists struct {
+	mu    sync.RWMutex
+	paths []string
+	rules map[string][]ignoreRule
+}
+
+// add reads the pattern file p and keeps it for reloading.
+func (e *excludeLists) add(p string) error {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	e.paths = append(e.paths, abs)
+	e.mu.Unlock()
+
+	return e.load(abs)
+}
+
+// load (re)reads the pattern file p.  A file that has been removed keeps
+// no rules until it is created again.
+func (e *excludeLists) load(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			e.mu.Lock()
+			delete(e.rules, p)
+			e.mu.Unlock()
+		}
+		return err
+	}
+	defer f.Close()
+
+	rules, err := readIgnoreRules(p, f)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	e.rules[p] = rules
+	e.mu.Unlock()
+
+	return nil
+}
+
+// has reports whether p is one of the pattern files, so a change to it
+// can be picked up.
+func (e *excludeLists) has(p string) (string, bool) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", false
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	for _, f := range e.paths {
+		if f == abs {
+			return abs, true
+		}
+	}
+
+	return "", false
+}
+
+// match reports whether the local path p is excluded.  Nothing below an
+// excluded directory is included again.
+func (e *excludeLists) match(p string, isDir bool) bool {
+	rel := relPath(p)
+	if rel == "." || strings.HasPrefix(rel, "../") {
+		return false
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if len(e.paths) == 0 {
+		return false
+	}
+
+	parts := strings.Split(rel, "/")
+	for i := 1; i < len(parts); i++ {
+		if e.matchRel(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+
+	return e.matchRel(rel, isDir)
+}
+
+func (e *excludeLists) matchRel(rel string, isDir bool) bool {
+	excluded := false
+	for _, p := range e.paths {
+		for _, rule := range e.rules[p] {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			if rule.re.MatchString(rel) {
+				excluded = !rule.negate
+			}
+		}
+	}
+
+	return excluded
+}
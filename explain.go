@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+// explainPath prints how the sync decides what to do with p, step by step:
+// the exclusion rules that apply, the remote path and, when the machine
+// can be reached, how it compares with the copy there.
+func explainPath(c *cli.Context, p string) {
+	if err := configure(c); err != nil {
+		fmt.Printf("configuration: %s\n", err)
+		os.Exit(exitFlags)
+	}
+
+	step := func(format string, args ...interface{}) {
+		fmt.Printf("  "+format+"\n", args...)
+	}
+
+	// a relative path may be given relative to the directory
+	p = filepath.Clean(p)
+	if rel := relPath(p); !filepath.IsAbs(p) && (rel == ".." || strings.HasPrefix(rel, "../")) {
+		p = filepath.Join(srcPath, p)
+	}
+	fmt.Printf("%s\n", p)
+
+	fi, err := os.Lstat(p)
+	dir := false
+	switch {
+	case err != nil:
+		step("local: %s; a sync would delete it on the machine", err)
+	case fi.IsDir():
+		dir = true
+		step("local: directory")
+	case fi.Mode().IsRegular():
+		step("local: file, %s, modified %s", formatBytes(fi.Size()), fi.ModTime().Format(time.RFC3339))
+	default:
+		step("local: %s; special files are skipped", fi.Mode().Type())
+	}
+
+	rel := relPath(p)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		step("outside %s: not synced", srcPath)
+		return
+	}
+	step("relative path: %s", rel)
+
+	excluded := explainExclusion(p, rel, dir, step)
+	if isExcluded(p, dir) != excluded {
+		// a rule this trace doesn't know about decided
+		excluded = isExcluded(p, dir)
+		step("excluded by the combined rules")
+	}
+	if fi != nil && !dir {
+		if skipOlderThan > 0 && time.Since(fi.ModTime()) > skipOlderThan {
+			step("older than --skip-older-than %s: left out of the initial sync", skipOlderThan)
+		}
+		if !syncSince.IsZero() && !fi.ModTime().After(syncSince) {
+			step("not modified since --since: left out of a one-shot sync")
+		}
+	}
+	if maxDepth > 0 && pathDepth(p) > maxDepth {
+		step("deeper than --max-depth %d: not synced", maxDepth)
+		excluded = true
+	}
+
+	filePath := remotePath(p)
+	if fp, ok := destMarkers.route(p); ok {
+		step("routed by a %s file to %s", destMarkerName, fp)
+	} else if fp, ok := routeByExt(p); ok {
+		step("routed by --route %s to %s", filepath.Ext(p), fp)
+	}
+	if encryptionKey != nil && !dir {
+		filePath += encryptedExt
+	}
+	step("remote path: %s", filePath)
+
+	if excluded {
+		step("decision: skip (excluded)")
+		return
+	}
+
+	if fi != nil && fi.Mode().IsRegular() {
+		if data, err := uploadContent(p); err != nil {
+			step("content: %s", err)
+		} else {
+			binary, _ := isBinaryFile(p)
+			step("content: %s, binary %t", formatBytes(int64(len(data))), binary)
+			if compressUploads {
+				compress, reason := shouldCompress(p, data)
+				step("compress: %t (%s)", compress, reason)
+			}
+		}
+	}
+
+	if err := connect(c); err != nil {
+		step("remote: not connected: %s", err)
+		step("decision: transfer")
+		return
+	}
+	explainRemote(p, filePath, fi, step)
+}
+
+// explainExclusion reports the rules that include or exclude p and
+// returns whether it is excluded.
+func explainExclusion(p, rel string, dir bool, step func(string, ...interface{})) bool {
+	excluded := false
+	note := func(matched bool, format string, args ...interface{}) {
+		if matched {
+			step(format, args...)
+			excluded = true
+		}
+	}
+
+	note(strings.HasSuffix(p, tempSuffix), "excluded: %s files are never synced", tempSuffix)
+	note(filepath.Base(p) == destMarkerName, "excluded: %s files set destinations and aren't synced", destMarkerName)
+	note(outsideWatchList(p), "excluded: not in --watch-list")
+	note(gitignore != nil && gitignore.match(p, dir), "excluded by .gitignore")
+	note(excludeFrom.match(p, dir), "excluded by an --exclude-from file")
+	note(!dir && growingTracker.excluded(p), "excluded: a large file that is still growing")
+
+	parts := strings.Split(rel, "/")
+	for i := 1; i < len(parts); i++ {
+		parent := strings.Join(parts[:i], "/")
+		note(len(filterRules) > 0 && filtered(parent, true), "excluded: parent %s is excluded by --filter", parent)
+	}
+	for _, f := range filterRules {
+		if f.rule.dirOnly && !dir {
+			continue
+		}
+		if f.rule.re.MatchString(rel) {
+			step("--filter %q matches", f.text)
+			if firstFilterWins {
+				break
+			}
+		}
+	}
+	note(len(filterRules) > 0 && filtered(rel, dir), "excluded by --filter")
+
+	if !excluded {
+		step("included: no rule excludes it")
+	}
+
+	return excluded
+}
+
+// explainRemote compares p with filePath on the machine.
+func explainRemote(p, filePath string, fi os.FileInfo, step func(string, ...interface{})) {
+	rfi, err := remoteStats.stat(filePath)
+	switch {
+	case err != nil && isNotExist(err):
+		if fi == nil {
+			step("remote: missing")
+			step("decision: nothing to do")
+			return
+		}
+		step("remote: missing")
+		step("decision: transfer")
+		return
+	case err != nil:
+		step("remote: %s", err)
+		step("decision: transfer")
+		return
+	}
+
+	if fi == nil {
+		step("remote: exists")
+		step("decision: delete")
+		return
+	}
+	if rfi.IsDir() && fi.IsDir() {
+		step("remote: directory")
+		step("decision: nothing to do")
+		return
+	}
+	if rfi.IsDir() != fi.IsDir() {
+		step("remote: %s", rfi.Mode().Type())
+		step("decision: transfer, replacing it")
+		return
+	}
+
+	step("remote: file, %s, modified %s", formatBytes(rfi.Size()), rfi.ModTime().Format(time.RFC3339))
+	if encryptionKey != nil {
+		step("decision: transfer (encrypted content can't be compared)")
+		return
+	}
+
+	local, err := localHash(p)
+	if err != nil {
+		step("local sha256: %s", err)
+		return
+	}
+	hashes, err := remoteHashes([]string{filePath})
+	if err != nil {
+		step("remote sha256: %s", err)
+		return
+	}
+	step("local sha256:  %s", local)
+	step("remote sha256: %s", hashes[filePath])
+	if local == hashes[filePath] {
+		step("decision: up to date; a change event would upload it again")
+		return
+	}
+	step("decision: transfer")
+}
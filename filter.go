@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// tempSuffix marks the temporary files uploads are written to before being
+// renamed into place.  They are never watched or synced, whatever the
+// filters say, so they can't feed back into the watcher.
+const tempSuffix = ".machinesync.tmp"
+
+// gitignore holds the rules from .gitignore files when --use-gitignore is
+// set.
+var gitignore *ignoreMatcher
+
+// filterRules are the --filter rules and firstFilterWins is whether the
+// first or the last matching rule decides (--filter-order).
+var (
+	filterRules     []filterRule
+	firstFilterWins = true
+)
+
+// filterRule includes or excludes the paths matching a pattern.  Rules are
+// written like rsync filter rules: "+ pattern" includes and "- pattern"
+// excludes, with patterns in .gitignore syntax.  As with rsync, a directory
+// that is excluded is never descended into, so "exclude everything except
+// *.go" is written as:
+//
+//	--filter "+ */" --filter "+ *.go" --filter "- *"
+type filterRule struct {
+	text    string
+	include bool
+	rule    ignoreRule
+}
+
+func parseFilterRules(rules []string) ([]filterRule, error) {
+	filters := []filterRule{}
+	for _, r := range rules {
+		r = strings.TrimSpace(r)
+		if len(r) < 3 || (r[0] != '+' && r[0] != '-') || r[1] != ' ' {
+			return nil, fmt.Errorf("invalid filter rule %q: must be \"+ pattern\" or \"- pattern\"", r)
+		}
+
+		pattern := strings.TrimSpace(r[2:])
+		if strings.HasPrefix(pattern, "!") || strings.HasPrefix(pattern, "#") {
+			pattern = `\` + pattern
+		}
+		rule, ok, err := parseIgnoreRule(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter rule %q: %s", r, err)
+		}
+		if !ok {
+			return nil, fmt.Errorf("invalid filter rule %q: missing pattern", r)
+		}
+
+		filters = append(filters, filterRule{text: r, include: r[0] == '+', rule: rule})
+	}
+
+	return filters, nil
+}
+
+// filtered reports whether the filter rules exclude the path relative to
+// srcPath.  Paths no rule matches are included.
+func filtered(rel string, isDir bool) bool {
+	excluded := false
+	for _, f := range filterRules {
+		if f.rule.dirOnly && !isDir {
+			continue
+		}
+		if !f.rule.re.MatchString(rel) {
+			continue
+		}
+
+		excluded = !f.include
+		if firstFilterWins {
+			break
+		}
+	}
+
+	return excluded
+}
+
+// isExcluded reports whether the local path p should be left out of the
+// sync.
+func isExcluded(p string, isDir bool) bool {
+	if strings.HasSuffix(p, tempSuffix) || filepath.Base(p) == destMarkerName {
+		return true
+	}
+
+	if outsideWatchList(p) {
+		return true
+	}
+
+	if gitignore != nil && gitignore.match(p, isDir) {
+		return true
+	}
+
+	if excludeFrom.match(p, isDir) {
+		return true
+	}
+
+	if !isDir && growingTracker.excluded(p) {
+		return true
+	}
+
+	if len(filterRules) > 0 {
+		rel := relPath(p)
+		if rel == "." || strings.HasPrefix(rel, "../") {
+			return false
+		}
+
+		// nothing below an excluded directory is synced
+		parts := strings.Split(rel, "/")
+		for i := 1; i < len(parts); i++ {
+			if filtered(strings.Join(parts[:i], "/"), true) {
+				return true
+			}
+		}
+		if filtered(rel, isDir) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestParseFilterRules(t *testing.T) {
+	for _, r := range []string{"", "x", "* foo", "+foo", "+ ", "-\tfoo"} {
+		if _, err := parseFilterRules([]string{r}); err == nil {
+			t.Errorf("parseFilterRules(%q) succeeded", r)
+		}
+	}
+
+	rules, err := parseFilterRules([]string{"+ !keep", "- #tmp", "  - *.log  "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 || !rules[0].include || rules[1].include || rules[2].include {
+		t.Fatalf("unexpected rules %+v", rules)
+	}
+	// ! and # are literal in filter rules
+	if !rules[0].rule.re.MatchString("!keep") || !rules[1].rule.re.MatchString("#tmp") {
+		t.Error("! or # was not taken literally")
+	}
+}
+
+func TestFilterOrder(t *testing.T) {
+	defer func(rules []filterRule, first bool, src string) {
+		filterRules, firstFilterWins, srcPath = rules, first, src
+	}(filterRules, firstFilterWins, srcPath)
+	srcPath = "src"
+
+	type check struct {
+		path     string
+		dir      bool
+		excluded bool
+	}
+	tests := []struct {
+		name   string
+		rules  []string
+		first  bool
+		checks []check
+	}{
+		{"exclude everything except", []string{"+ */", "+ *.go", "- *"}, true, []check{
+			{"main.go", false, false},
+			{"pkg", true, false},
+			{"pkg/util.go", false, false},
+			{"README", false, true},
+			{"pkg/data.json", false, true},
+		}},
+		{"include everything except", []string{"- *.log"}, true, []check{
+			{"app.log", false, true},
+			{"logs/app.log", false, true},
+			{"app.txt", false, false},
+			{"app.log.txt", false, false},
+		}},
+		{"first rule wins", []string{"- *.go", "+ main.go"}, true, []check{
+			{"main.go", false, true},
+			{"util.go", false, true},
+		}},
+		{"last rule wins", []string{"- *.go", "+ main.go"}, false, []check{
+			{"main.go", false, false},
+			{"util.go", false, true},
+		}},
+		{"excluded directory", []string{"- vendor/", "+ *.go"}, false, []check{
+			{"vendor", true, true},
+			{"vendor/lib.go", false, true},
+			{"lib.go", false, false},
+		}},
+		{"directory only rule", []string{"- tmp/"}, true, []check{
+			{"tmp", true, true},
+			{"tmp", false, false},
+		}},
+		{"anchored rule", []string{"- /build"}, true, []check{
+			{"build", true, true},
+			{"cmd/build", true, false},
+		}},
+		{"no rule matches", []string{"- *.log", "+ *.go"}, true, []check{
+			{"Makefile", false, false},
+		}},
+	}
+
+	for _, test := range tests {
+		rules, err := parseFilterRules(test.rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filterRules, firstFilterWins = rules, test.first
+
+		for _, c := range test.checks {
+			p := filepath.Join("src", filepath.FromSlash(c.path))
+			if got := isExcluded(p, c.dir); got != c.excluded {
+				t.Errorf("%s: isExcluded(%s, %v) = %v, want %v", test.name, c.path, c.dir, got, c.excluded)
+			}
+		}
+	}
+}
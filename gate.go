@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// gatePollInterval is how often the gate file is checked.
+const gatePollInterval = time.Second
+
+// gateFile, when set, only lets transfers happen while the file exists, or
+// with gateWhenAbsent while it doesn't, so other tooling can control when
+// syncing happens.
+var (
+	gateFile       string
+	gateWhenAbsent bool
+)
+
+// gateClosed reports whether the gate file currently holds back syncing.
+func gateClosed() bool {
+	_, err := os.Stat(gateFile)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("unable to check gate file %s: %s", gateFile, err)
+	}
+
+	return exists == gateWhenAbsent
+}
+
+// waitGate blocks until the gate is open.
+func waitGate() {
+	if gateFile == "" || !gateClosed() {
+		return
+	}
+
+	log.Infof("waiting for gate file %s", gateFile)
+	for gateClosed() {
+		time.Sleep(gatePollInterval)
+	}
+}
+
+// pollGate opens and closes the gate as the gate file changes.
+func pollGate() {
+	for {
+		for _, ev := range syncPause.gate(gateClosed()) {
+			dispatch(ev)
+		}
+		time.Sleep(gatePollInterval)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// growingMinChanges is how many changes within the window it takes before
+// a file is considered to be growing rather than just written once.
+const growingMinChanges = 3
+
+var (
+	excludeGrowing bool
+	growingLimit   int64
+	growingWindow  time.Duration
+	growingTracker = &growthTracker{files: map[string]*growth{}}
+)
+
+type growth struct {
+	windowStart time.Time
+	startSize   int64
+	lastSize    int64
+	changes     int
+	flagged     bool
+}
+
+// growthTracker detects files such as logs that keep being appended to,
+// which would otherwise be uploaded again on every write.
+type growthTracker struct {
+	mu    sync.Mutex
+	files map[string]*growth
+}
+
+// check records a change to p.  It warns the first time p has only grown,
+// by more than growingLimit, within growingWindow and reports whether p
+// is now excluded for the rest of the session.
+func (t *growthTracker) check(p string) bool {
+	if growingLimit <= 0 {
+		return false
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	size := fi.Size()
+	g, ok := t.files[p]
+	if !ok || size < g.lastSize || now.Sub(g.windowStart) > growingWindow {
+		if ok && g.flagged {
+			return excludeGrowing
+		}
+		t.files[p] = &growth{
+			windowStart: now,
+			startSize:   size,
+			lastSize:    size,
+			changes:     1,
+		}
+		return false
+	}
+
+	g.lastSize = size
+	g.changes++
+	if g.flagged || g.changes < growingMinChanges || size-g.startSize < growingLimit {
+		return g.flagged && excludeGrowing
+	}
+
+	g.flagged = true
+	if excludeGrowing {
+		log.Warnf("%s grew by %s in %s; excluding it for this session (add an exclude rule to make this permanent)", p, formatBytes(size-g.startSize), now.Sub(g.windowStart).Truncate(time.Second))
+	} else {
+		log.Warnf("%s grew by %s in %s and keeps being uploaded; consider excluding it or using --exclude-larger-growing", p, formatBytes(size-g.startSize), now.Sub(g.windowStart).Truncate(time.Second))
+	}
+
+	return excludeGrowing
+}
+
+// excluded reports whether p was auto excluded.
+func (t *growthTracker) excluded(p string) bool {
+	if !excludeGrowing {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	g, ok := t.files[p]
+	return ok && g.flagged
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGrowthTracker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "growth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(exclude bool, limit int64, window time.Duration) {
+		excludeGrowing, growingLimit, growingWindow = exclude, limit, window
+	}(excludeGrowing, growingLimit, growingWindow)
+	excludeGrowing, growingLimit, growingWindow = true, 100, time.Minute
+
+	tr := &growthTracker{files: map[string]*growth{}}
+	grow := func(p string, size int) bool {
+		if err := ioutil.WriteFile(p, []byte(strings.Repeat("x", size)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return tr.check(p)
+	}
+
+	appLog := filepath.Join(dir, "app.log")
+	for i, size := range []int{10, 60, 150} {
+		// excluded on the change that takes it past the limit
+		if got, want := grow(appLog, size), i == 2; got != want {
+			t.Errorf("change %d to %d bytes: excluded = %v, want %v", i+1, size, got, want)
+		}
+	}
+	if !tr.excluded(appLog) {
+		t.Error("app.log is not excluded")
+	}
+	// it stays excluded even once truncated
+	if !grow(appLog, 0) {
+		t.Error("app.log was let back in after being truncated")
+	}
+
+	// a file rewritten at a similar size isn't growing
+	data := filepath.Join(dir, "data.json")
+	for _, size := range []int{100, 90, 300, 280} {
+		if grow(data, size) {
+			t.Errorf("data.json excluded at %d bytes", size)
+		}
+	}
+
+	// growing too slowly to pass the limit within the window
+	growingWindow = 0
+	slow := filepath.Join(dir, "slow.log")
+	for _, size := range []int{10, 100, 200, 300} {
+		if grow(slow, size) {
+			t.Errorf("slow.log excluded at %d bytes", size)
+		}
+	}
+
+	// only warned about without --exclude-larger-growing
+	excludeGrowing, growingWindow = false, time.Minute
+	warned := filepath.Join(dir, "warned.log")
+	for _, size := range []int{10, 60, 150, 300} {
+		if grow(warned, size) {
+			t.Errorf("warned.log excluded at %d bytes", size)
+		}
+	}
+	if tr.excluded(warned) {
+		t.Error("warned.log is excluded")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// maxTreeFiles and maxTreeSize stop a directory pointed at by mistake,
+// such as a home directory, from being synced unless forceSync is set.
+// Zero disables a limit.
+var (
+	maxTreeFiles int
+	maxTreeSize  int64
+	forceSync    bool
+	// checkInodes compares the paths to sync with the free inodes on the
+	// machine, which run out before space does with many small files.
+	checkInodes bool
+)
+
+// checkTreeSize counts the regular files in paths and refuses to continue
+// when they exceed the limits.
+func checkTreeSize(paths []string) error {
+	if forceSync {
+		return nil
+	}
+
+	files, size := 0, int64(0)
+	for _, p := range paths {
+		if fi, err := os.Lstat(p); err == nil && fi.Mode().IsRegular() {
+			files++
+			size += fi.Size()
+		}
+	}
+
+	if (maxTreeFiles > 0 && files > maxTreeFiles) || (maxTreeSize > 0 && size > maxTreeSize) {
+		return fmt.Errorf("%s has %d files (%s), more than the limit of %d files (%s); check --directory or use --force", srcPath, files, formatBytes(size), maxTreeFiles, formatBytes(maxTreeSize))
+	}
+
+	return nil
+}
+
+// checkFreeInodes refuses to sync more paths than the destination has
+// free inodes, or only warns with forceSync.  Every path is counted even
+// though some may exist already, so the estimate errs on the safe side.
+func checkFreeInodes(paths []string) error {
+	if !checkInodes {
+		return nil
+	}
+
+	free, err := remoteFreeInodes(destPath)
+	if err != nil {
+		log.Warnf("unable to check free inodes on %s: %s", machineName, err)
+		return nil
+	}
+	if free < 0 {
+		log.Debugf("%s on %s doesn't report inodes", destPath, machineName)
+		return nil
+	}
+
+	log.Debugf("syncing %d paths to %s with %d free inodes", len(paths), destPath, free)
+	if int64(len(paths)) <= free {
+		return nil
+	}
+
+	err = fmt.Errorf("%s on %s has %d free inodes, fewer than the %d paths to sync", destPath, machineName, free, len(paths))
+	if forceSync {
+		log.Warn(err)
+		return nil
+	}
+
+	return fmt.Errorf("%s; use --force to sync anyway", err)
+}
+
+// remoteFreeInodes returns the free inodes of the filesystem holding dir
+// on the machine, or -1 when the filesystem doesn't have a fixed number.
+func remoteFreeInodes(dir string) (int64, error) {
+	session, err := newSession()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err := session.Run("df -Pi " + shellQuote(dir)); err != nil {
+		return 0, fmt.Errorf("%s: %s", err, strip(stderr.String()))
+	}
+
+	// Filesystem Inodes IUsed IFree IUse% Mounted on
+	lines := strings.Split(strip(stdout.String()), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 4 {
+		return 0, fmt.Errorf("unexpected df output %q", stdout.String())
+	}
+	if fields[1] == "0" || fields[1] == "-" {
+		return -1, nil
+	}
+
+	return strconv.ParseInt(fields[3], 10, 64)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	syncHardlinks bool
+	hardlinks     = &hardlinkTracker{paths: map[fileKey][]linkedPath{}}
+)
+
+// fileKey identifies a local file independent of the path it was reached
+// through.
+type fileKey struct {
+	dev uint64
+	ino uint64
+}
+
+// linkedPath is a local link of a file and the path it was synced to.
+type linkedPath struct {
+	local  string
+	remote string
+}
+
+// hardlinkTracker remembers the remote paths of local files with more than
+// one link so their content is only uploaded once.
+type hardlinkTracker struct {
+	mu    sync.Mutex
+	paths map[fileKey][]linkedPath
+	// failed is set once the machine refuses a link so the rest are
+	// uploaded separately.
+	failed bool
+}
+
+func hardlinkKey(localPath string) (fileKey, bool) {
+	if !syncHardlinks {
+		return fileKey{}, false
+	}
+
+	fi, err := os.Lstat(localPath)
+	if err != nil || !fi.Mode().IsRegular() {
+		return fileKey{}, false
+	}
+
+	return fileLinkKey(fi)
+}
+
+// link creates filePath as a hardlink to an already uploaded copy of
+// localPath.  It returns false if there is no copy to link to and the file
+// has to be uploaded.
+func (h *hardlinkTracker) link(localPath, filePath string) bool {
+	key, ok := hardlinkKey(localPath)
+	if !ok {
+		return false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.failed {
+		return false
+	}
+	existing := h.current(key)
+	if len(existing) == 0 {
+		return false
+	}
+
+	remoteStats.invalidate(filePath)
+	_ = rsftp.Remove(filePath)
+	if err := rsftp.Link(existing[0].remote, filePath); err != nil {
+		log.Warnf("unable to create hardlink %s: %s; uploading separately", filePath, err)
+		h.failed = true
+		return false
+	}
+	log.Debugf("linked %s to %s", filePath, existing[0].remote)
+
+	h.add(key, localPath, filePath)
+	return true
+}
+
+// uploaded records that filePath holds new content for localPath and
+// relinks the other remote paths of the file to it so they all share the
+// new content.
+func (h *hardlinkTracker) uploaded(localPath, filePath string) {
+	key, ok := hardlinkKey(localPath)
+	if !ok {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.failed {
+		return
+	}
+	h.add(key, localPath, filePath)
+	for _, p := range h.current(key) {
+		if p.remote == filePath {
+			continue
+		}
+
+		remoteStats.invalidate(p.remote)
+		_ = rsftp.Remove(p.remote)
+		if err := rsftp.Link(filePath, p.remote); err != nil {
+			log.Warnf("unable to relink %s: %s", p.remote, err)
+		}
+	}
+}
+
+func (h *hardlinkTracker) add(key fileKey, localPath, filePath string) {
+	for _, p := range h.paths[key] {
+		if p.remote == filePath {
+			return
+		}
+	}
+
+	h.paths[key] = append(h.paths[key], linkedPath{localPath, filePath})
+}
+
+// current returns the recorded paths of key whose local link still exists
+// and forgets the rest, so a link deleted locally isn't brought back on the
+// machine by relinking.
+func (h *hardlinkTracker) current(key fileKey) []linkedPath {
+	paths := []linkedPath{}
+	for _, p := range h.paths[key] {
+		if k, ok := hardlinkKey(p.local); ok && k == key {
+			paths = append(paths, p)
+		}
+	}
+	h.paths[key] = paths
+
+	return paths
+}
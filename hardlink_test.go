@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// TestHardlinkDeletedLinkStaysDeleted removes one of three links of a
+// file, then uploads new content through another.  Relinking must not bring the
+// removed link back on the machine.
+func TestHardlinkDeletedLinkStaysDeleted(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hardlinks are only tracked on unix")
+	}
+
+	s := startTestServer(t)
+	defer s.kill()
+	dest, cleanup := testTree(t)
+	defer cleanup()
+	connectTestServer(t, s)
+
+	defer func(sync bool, h *hardlinkTracker) {
+		syncHardlinks, hardlinks = sync, h
+	}(syncHardlinks, hardlinks)
+	syncHardlinks = true
+	hardlinks = &hardlinkTracker{paths: map[fileKey][]linkedPath{}}
+
+	a, b, c := filepath.Join("src", "a"), filepath.Join("src", "b"), filepath.Join("src", "c")
+	writeTestFile(t, a, []byte("old"))
+	for _, p := range []string{b, c} {
+		if err := os.Link(a, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := initialSync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, b)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeFile(remotePath(a)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(b, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := uploadFile(b, remotePath(b)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dest, a)); !os.IsNotExist(err) {
+		t.Errorf("the deleted link is back on the machine")
+	}
+	for _, p := range []string{b, c} {
+		if got, err := ioutil.ReadFile(filepath.Join(dest, p)); err != nil || string(got) != "new" {
+			t.Errorf("%s has %q, %v on the machine; want %q", p, got, err, "new")
+		}
+	}
+}
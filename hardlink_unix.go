@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileLinkKey returns the device and inode of fi if it has more than one
+// link.
+func fileLinkKey(fi os.FileInfo) (fileKey, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return fileKey{}, false
+	}
+
+	return fileKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
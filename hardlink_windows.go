@@ -0,0 +1,10 @@
+package main
+
+import (
+	"os"
+)
+
+// inodes are not exposed through os.FileInfo on windows
+func fileLinkKey(fi os.FileInfo) (fileKey, bool) {
+	return fileKey{}, false
+}
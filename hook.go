@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var postSync = &syncHook{}
+
+// syncHook runs a command on the machine after changes are synced.  A
+// burst of changes is coalesced into a single run once no change has been
+// synced for delay, plus up to jitter so several machines don't all run it
+// at the same moment.  A change during a run triggers another run after
+// it.
+type syncHook struct {
+	mu      sync.Mutex
+	command string
+	delay   time.Duration
+	jitter  time.Duration
+	timer   *time.Timer
+	running bool
+	pending bool
+}
+
+// trigger schedules a run, postponing one already scheduled.
+func (h *syncHook) trigger() {
+	if h.command == "" {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.running {
+		h.pending = true
+		return
+	}
+
+	wait := h.delay
+	if h.jitter > 0 {
+		wait += time.Duration(rand.Int63n(int64(h.jitter)))
+	}
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+	h.timer = time.AfterFunc(wait, h.run)
+}
+
+func (h *syncHook) run() {
+	h.mu.Lock()
+	h.running = true
+	h.timer = nil
+	h.mu.Unlock()
+
+	log.Infof("running post sync command: %s", h.command)
+	if err := runRemote(h.command); err != nil {
+		log.Errorf("post sync command failed: %s", err)
+	}
+
+	h.mu.Lock()
+	h.running = false
+	pending := h.pending
+	h.pending = false
+	h.mu.Unlock()
+
+	if pending {
+		h.trigger()
+	}
+}
+
+// runRemote runs command on the machine.
+func runRemote(command string) error {
+	session, err := newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	if err := session.Run(command); err != nil {
+		return fmt.Errorf("%s: %s", err, strip(stderr.String()))
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// assumeYes answers yes to confirmations: trusting unknown host keys and
+// the deletes of --mirror.
+var assumeYes bool
+
+func knownHostsPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+}
+
+// checkHostKey verifies the machine's key against known_hosts.  Unknown
+// hosts are trusted after confirmation like the OpenSSH client does and a
+// changed key is always refused.
+func checkHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	p := knownHostsPath()
+
+	check, err := knownhosts.New(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		err = check(hostname, remote, key)
+		keyErr, ok := err.(*knownhosts.KeyError)
+		if !ok {
+			return err
+		}
+		if len(keyErr.Want) > 0 {
+			return fmt.Errorf("host key for %s does not match %s:%d; remove the old key if the machine was recreated", hostname, keyErr.Want[0].Filename, keyErr.Want[0].Line)
+		}
+	}
+
+	fingerprint := ssh.FingerprintSHA256(key)
+	if !assumeYes {
+		if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+			return fmt.Errorf("unknown host key for %s (%s %s); use --yes to trust it", hostname, key.Type(), fingerprint)
+		}
+
+		fmt.Fprintf(os.Stderr, "The authenticity of host '%s' can't be established.\n", hostname)
+		fmt.Fprintf(os.Stderr, "%s key fingerprint is %s.\n", key.Type(), fingerprint)
+		fmt.Fprint(os.Stderr, "Are you sure you want to continue connecting (yes/no)? ")
+
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(strings.ToLower(answer)) != "yes" {
+			return fmt.Errorf("host key for %s not trusted", hostname)
+		}
+	}
+
+	log.Infof("adding %s key %s for %s to %s", key.Type(), fingerprint, hostname, p)
+	return addKnownHost(p, hostname, key)
+}
+
+func addKnownHost(p, hostname string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	// expectedMachineID is the content the marker file must have on the
+	// machine; empty disables the check.
+	expectedMachineID string
+	machineIDFile     string
+)
+
+// checkMachineID reads the marker file on the machine and refuses the
+// connection when it doesn't match, so a recycled IP that now belongs to a
+// different machine is never synced to.
+func checkMachineID() error {
+	if expectedMachineID == "" {
+		return nil
+	}
+
+	session, err := newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err := session.Run(fmt.Sprintf("cat %s", shellQuote(machineIDFile))); err != nil {
+		return fmt.Errorf("unable to read %s on %s to check its identity: %s", machineIDFile, machineName, strip(stderr.String()))
+	}
+
+	id := strip(stdout.String())
+	if id != expectedMachineID {
+		return fmt.Errorf("%s on %s is %q, expected %q; refusing to sync to what may be a different machine", machineIDFile, machineName, id, expectedMachineID)
+	}
+	log.Debugf("machine identity %s matches", id)
+
+	return nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreFile holds the rules of one ignore file.  dir is the slash
+// separated directory it was found in relative to srcPath.
+type ignoreFile struct {
+	dir   string
+	rules []ignoreRule
+}
+
+// ignoreMatcher applies ignore files with gitignore syntax and precedence:
+// rules in deeper files win over shallower ones, later rules win over
+// earlier ones, ! negates a rule and nothing below an ignored directory can
+// be included again.
+type ignoreMatcher struct {
+	mu    sync.RWMutex
+	name  string
+	files map[string]*ignoreFile
+}
+
+func newIgnoreMatcher(name string) *ignoreMatcher {
+	return &ignoreMatcher{
+		name:  name,
+		files: map[string]*ignoreFile{},
+	}
+}
+
+// relPath returns p relative to srcPath with slash separators.
+func relPath(p string) string {
+	rel, err := filepath.Rel(srcPath, p)
+	if err != nil {
+		return filepath.ToSlash(p)
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+// loadTree reads every ignore file below root.
+func (m *ignoreMatcher) loadTree(root string) error {
+	return walkTree(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() && fi.Name() == m.name {
+			return m.loadFile(p)
+		}
+
+		return nil
+	})
+}
+
+// loadFile (re)reads the ignore file at p.  If it no longer exists its
+// rules are dropped.
+func (m *ignoreMatcher) loadFile(p string) error {
+	dir := relPath(filepath.Dir(p))
+	if dir == "." {
+		dir = ""
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			m.mu.Lock()
+			delete(m.files, dir)
+			m.mu.Unlock()
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	rules, err := readIgnoreRules(p, f)
+	if err != nil {
+		return err
+	}
+	file := &ignoreFile{dir: dir, rules: rules}
+
+	m.mu.Lock()
+	m.files[dir] = file
+	m.mu.Unlock()
+
+	return nil
+}
+
+// readIgnoreRules reads the rules of the ignore file p from r.  Invalid
+// patterns are logged and skipped.
+func readIgnoreRules(p string, r io.Reader) ([]ignoreRule, error) {
+	rules := []ignoreRule{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		rule, ok, err := parseIgnoreRule(scanner.Text())
+		if err != nil {
+			log.Warnf("ignoring invalid pattern in %s: %s", p, err)
+			continue
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	log.Debugf("loaded %d rules from %s", len(rules), p)
+
+	return rules, nil
+}
+
+func parseIgnoreRule(line string) (ignoreRule, bool, error) {
+	rule := ignoreRule{}
+
+	line = strings.TrimRight(line, "\r")
+	if !strings.HasSuffix(line, "\\ ") {
+		line = strings.TrimRight(line, " ")
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false, nil
+	}
+
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return rule, false, nil
+	}
+
+	// patterns with a slash are relative to the ignore file's directory,
+	// anything else matches at any depth
+	prefix := "^(.*/)?"
+	if strings.Contains(line, "/") {
+		prefix = "^"
+		line = strings.TrimPrefix(line, "/")
+	}
+
+	re, err := regexp.Compile(prefix + globToRegexp(line) + "$")
+	if err != nil {
+		return rule, false, err
+	}
+	rule.re = re
+
+	return rule, true, nil
+}
+
+func globToRegexp(pattern string) string {
+	var buf strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			switch {
+			case strings.HasPrefix(pattern[i:], "**/"):
+				// any number of directories, including none
+				buf.WriteString("(.*/)?")
+				i += 2
+			case strings.HasPrefix(pattern[i:], "**"):
+				buf.WriteString(".*")
+				i++
+			default:
+				buf.WriteString("[^/]*")
+			}
+		case '?':
+			buf.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end == -1 {
+				buf.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				buf.WriteString(regexp.QuoteMeta(string(pattern[i+1])))
+				i++
+			}
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return buf.String()
+}
+
+// match reports whether the local path p is ignored.
+func (m *ignoreMatcher) match(p string, isDir bool) bool {
+	rel := relPath(p)
+	if rel == "." || strings.HasPrefix(rel, "../") {
+		return false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	files := m.sortedFiles()
+
+	// a file can't be included again once a parent directory is ignored
+	parts := strings.Split(rel, "/")
+	for i := 1; i < len(parts); i++ {
+		if m.matchRel(files, strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+
+	return m.matchRel(files, rel, isDir)
+}
+
+func (m *ignoreMatcher) matchRel(files []*ignoreFile, rel string, isDir bool) bool {
+	ignored := false
+	for _, f := range files {
+		sub := rel
+		if f.dir != "" {
+			if !strings.HasPrefix(rel, f.dir+"/") {
+				continue
+			}
+			sub = rel[len(f.dir)+1:]
+		}
+
+		for _, rule := range f.rules {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			if rule.re.MatchString(sub) {
+				ignored = !rule.negate
+			}
+		}
+	}
+
+	return ignored
+}
+
+// sortedFiles returns the ignore files from shallowest to deepest so
+// deeper rules are applied last and take precedence.
+func (m *ignoreMatcher) sortedFiles() []*ignoreFile {
+	files := make([]*ignoreFile, 0, len(m.files))
+	for _, f := range m.files {
+		files = append(files, f)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		di, dj := depth(files[i].dir), depth(files[j].dir)
+		if di != dj {
+			return di < dj
+		}
+		return files[i].dir < files[j].dir
+	})
+
+	return files
+}
+
+func depth(dir string) int {
+	if dir == "" {
+		return 0
+	}
+
+	return strings.Count(dir, "/") + 1
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// maxUserWatches returns the inotify watch limit for the user.
+func maxUserWatches() (int, bool) {
+	data, err := ioutil.ReadFile("/proc/sys/fs/inotify/max_user_watches")
+	if err != nil {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(strip(string(data)))
+	if err != nil {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// watchLimitError explains how to raise the limit when err was caused by
+// running out of inotify watches.
+func watchLimitError(err error) error {
+	if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENOSPC {
+		limit, _ := maxUserWatches()
+		return fmt.Errorf("unable to watch %s: the inotify watch limit (%d) has been reached; raise it with `sudo sysctl fs.inotify.max_user_watches=%d` or use --max-depth", pe.Path, limit, limit*2)
+	}
+
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// only inotify has a per user watch limit
+
+func maxUserWatches() (int, bool) {
+	return 0, false
+}
+
+func watchLimitError(err error) error {
+	return err
+}
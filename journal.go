@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	resumeInitialSync bool
+	journal           *syncJournal
+)
+
+type journalEntry struct {
+	size    int64
+	modTime int64
+}
+
+// syncJournal records the files the initial sync has transferred so an
+// interrupted sync can pick up where it stopped.  Each line holds the
+// quoted path, size and modification time of a transferred file.
+type syncJournal struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	entries map[string]journalEntry
+}
+
+// journalPath returns the journal for the machine and destination.
+func journalPath() string {
+	sum := sha256.Sum256([]byte(machineName + ":" + destPath))
+	return filepath.Join(os.Getenv("HOME"), ".machine-sync", "journal", hex.EncodeToString(sum[:8]))
+}
+
+func openJournal(p string) (*syncJournal, error) {
+	j := &syncJournal{
+		path:    p,
+		entries: map[string]journalEntry{},
+	}
+
+	if f, err := os.Open(p); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Split(scanner.Text(), "\t")
+			if len(fields) != 3 {
+				continue
+			}
+			name, err := strconv.Unquote(fields[0])
+			if err != nil {
+				continue
+			}
+			size, _ := strconv.ParseInt(fields[1], 10, 64)
+			modTime, _ := strconv.ParseInt(fields[2], 10, 64)
+			j.entries[name] = journalEntry{size: size, modTime: modTime}
+		}
+		f.Close()
+		if len(j.entries) > 0 {
+			log.Infof("resuming initial sync; %d files already transferred", len(j.entries))
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j.f = f
+
+	return j, nil
+}
+
+// done reports whether p was transferred and hasn't changed since.
+func (j *syncJournal) done(p string, fi os.FileInfo) bool {
+	if j == nil {
+		return false
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	e, ok := j.entries[p]
+	return ok && e.size == fi.Size() && e.modTime == fi.ModTime().UnixNano()
+}
+
+// record adds a transferred file to the journal.
+func (j *syncJournal) record(p string, fi os.FileInfo) {
+	if j == nil {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.entries[p] = journalEntry{size: fi.Size(), modTime: fi.ModTime().UnixNano()}
+	if _, err := fmt.Fprintf(j.f, "%s\t%d\t%d\n", strconv.Quote(p), fi.Size(), fi.ModTime().UnixNano()); err != nil {
+		log.Warnf("unable to write %s: %s", j.path, err)
+	}
+}
+
+// close closes the journal, keeping it for the next run.
+func (j *syncJournal) close() {
+	if j == nil {
+		return
+	}
+
+	j.f.Close()
+}
+
+// finish removes the journal once the initial sync has completed.
+func (j *syncJournal) finish() {
+	if j == nil {
+		return
+	}
+
+	j.f.Close()
+	os.Remove(j.path)
+}
@@ -5,9 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
@@ -18,13 +24,20 @@ import (
 
 type (
 	MachineConfig struct {
-		Driver struct {
-			IPAddress string `json:"IPAddress,omitempty"`
-			SSHPort   int    `json:"SSHPort,omitempty"`
+		DriverName string `json:"DriverName,omitempty"`
+		Driver     struct {
+			IPAddress  string `json:"IPAddress,omitempty"`
+			SSHPort    int    `json:"SSHPort,omitempty"`
+			SSHKeyPath string `json:"SSHKeyPath,omitempty"`
 		}
 	}
 )
 
+const (
+	configAttempts   = 3
+	configRetryDelay = 250 * time.Millisecond
+)
+
 var (
 	errFlagError      = errors.New("flag error")
 	srcPath           string
@@ -32,7 +45,12 @@ var (
 	machineName       string
 	machineConfigPath string
 	machineUser       string
+	useTar            bool
+	ignoreBusyDeletes bool
+	concurrency       int
+	maxRuntime        time.Duration
 	mutex             = &sync.Mutex{}
+	rssh              *ssh.Client
 	rsftp             *sftp.Client
 )
 
@@ -47,20 +65,284 @@ func checkFlags(c *cli.Context) error {
 		return errFlagError
 	}
 
-	if c.GlobalString("destination") == "" {
+	if c.GlobalString("destination") == "" && c.GlobalString("branch-prefix") == "" {
 		log.Error("you must specify a destination path")
 		return errFlagError
 	}
 
+	if c.GlobalString("destination") != "" && c.GlobalString("branch-prefix") != "" {
+		log.Error("--destination and --branch-prefix cannot be used together")
+		return errFlagError
+	}
+
 	if c.GlobalString("user") == "" {
 		log.Error("you must specify a user")
 		return errFlagError
 	}
 
+	if c.GlobalBool("encrypt") {
+		if c.GlobalString("encryption-key") == "" {
+			log.Error("--encrypt requires --encryption-key")
+			return errFlagError
+		}
+		for _, f := range []string{"tar", "verify"} {
+			if c.GlobalBool(f) {
+				log.Errorf("--encrypt cannot be used with --%s", f)
+				return errFlagError
+			}
+		}
+	}
+
+	if _, err := parseAuthMethods(c.GlobalString("auth-methods")); err != nil {
+		log.Error(err)
+		return errFlagError
+	}
+
+	if _, err := parseAlgorithms("cipher", c.GlobalString("ssh-ciphers"), validCiphers); err != nil {
+		log.Error(err)
+		return errFlagError
+	}
+
+	if _, err := parseAlgorithms("key exchange", c.GlobalString("ssh-kex"), validKexAlgorithms); err != nil {
+		log.Error(err)
+		return errFlagError
+	}
+
+	if c.GlobalBool("mirror") && c.GlobalBool("no-delete") {
+		log.Error("--mirror and --no-delete cannot be used together")
+		return errFlagError
+	}
+
+	if c.GlobalInt("max-depth") < 0 {
+		log.Error("max depth cannot be negative")
+		return errFlagError
+	}
+
+	if c.GlobalInt("max-files") < 0 {
+		log.Error("max files cannot be negative")
+		return errFlagError
+	}
+
+	if _, err := parseSize(c.GlobalString("max-size")); err != nil {
+		log.Error(err)
+		return errFlagError
+	}
+
+	if c.GlobalInt("initial-concurrency") < 0 {
+		log.Error("initial concurrency cannot be negative")
+		return errFlagError
+	}
+
+	if c.GlobalInt("max-deletes") < 0 {
+		log.Error("max deletes must not be negative")
+		return errFlagError
+	}
+
+	// held deletions would wait forever with no way to confirm them
+	if c.GlobalInt("max-deletes") > 0 && !canConfirmDeletes(c) {
+		log.Error("--max-deletes needs a terminal or --status-addr to confirm held deletions")
+		return errFlagError
+	}
+
+	if c.GlobalInt("max-deletes") > 0 && c.GlobalDuration("max-deletes-window") <= 0 {
+		log.Error("max deletes window must be positive")
+		return errFlagError
+	}
+
+	if c.GlobalInt("concurrency") < 1 {
+		log.Error("concurrency must be at least 1")
+		return errFlagError
+	}
+
+	if c.GlobalBool("enforce-modes") && !c.GlobalBool("preserve-mode") && c.GlobalString("file-mode") == "" {
+		log.Error("--enforce-modes requires --preserve-mode or --file-mode")
+		return errFlagError
+	}
+
+	if c.GlobalBool("preserve-mode") && c.GlobalString("file-mode") != "" {
+		log.Error("--preserve-mode and --file-mode cannot be used together")
+		return errFlagError
+	}
+
+	if m := c.GlobalString("file-mode"); m != "" {
+		if _, err := parseFileMode(m); err != nil {
+			log.Errorf("invalid file mode %s: must be octal (e.g. 0644)", m)
+			return errFlagError
+		}
+	}
+
+	if l := c.GlobalString("remote-symlink"); l != "" {
+		if _, _, err := parseRemoteSymlink(l); err != nil {
+			log.Error(err)
+			return errFlagError
+		}
+	}
+
+	if _, err := parseFilterRules(c.GlobalStringSlice("filter")); err != nil {
+		log.Error(err)
+		return errFlagError
+	}
+
+	switch c.GlobalString("dry-run") {
+	case "", "local", "remote":
+	default:
+		log.Error("dry run must be local or remote")
+		return errFlagError
+	}
+
+	switch c.GlobalString("filter-order") {
+	case "first", "last":
+	default:
+		log.Error("filter order must be first or last")
+		return errFlagError
+	}
+
+	switch c.GlobalString("on-permission-denied") {
+	case "log", "skip", "fail", "retry":
+	default:
+		log.Error("on permission denied must be log, skip, fail or retry")
+		return errFlagError
+	}
+
+	if c.GlobalInt("queue-size") < 1 {
+		log.Error("queue size must be at least 1")
+		return errFlagError
+	}
+
+	switch c.GlobalString("queue-overflow") {
+	case "backpressure", "spill":
+	default:
+		log.Error("queue overflow must be backpressure or spill")
+		return errFlagError
+	}
+
+	if err := parseRemoteEnv(c.GlobalStringSlice("remote-env")); err != nil {
+		log.Error(err)
+		return errFlagError
+	}
+
+	for _, f := range []string{"uid-offset", "gid-offset"} {
+		n := c.GlobalInt(f)
+		if n < 0 || n > math.MaxUint32/2 {
+			log.Errorf("--%s must be between 0 and %d", f, math.MaxUint32/2)
+			return errFlagError
+		}
+		if n != 0 && c.GlobalString("owner-map") == "" {
+			log.Errorf("--%s only applies to owners set with --owner-map", f)
+			return errFlagError
+		}
+	}
+
+	if n, err := parseSize(c.GlobalString("sftp-packet-size")); err != nil || n < 512 || n > 256*1024 {
+		log.Error("sftp packet size must be between 512 and 256K")
+		return errFlagError
+	}
+
+	if c.GlobalInt("sftp-requests") < 1 {
+		log.Error("sftp requests must be at least 1")
+		return errFlagError
+	}
+
+	switch c.GlobalString("dialer") {
+	case dialerDirect:
+	case dialerHTTPConnect:
+		if c.GlobalString("http-proxy") == "" {
+			log.Error("--dialer http-connect requires --http-proxy")
+			return errFlagError
+		}
+		if _, err := parseHTTPProxy(c.GlobalString("http-proxy")); err != nil {
+			log.Error(err)
+			return errFlagError
+		}
+	default:
+		log.Error("dialer must be direct or http-connect")
+		return errFlagError
+	}
+
+	if c.GlobalBool("rename-detection") && c.GlobalDuration("rename-window") <= 0 {
+		log.Error("rename window must be positive")
+		return errFlagError
+	}
+
+	for _, f := range []string{"auto-tar-avg-size", "auto-delta-size", "rename-min-size"} {
+		if _, err := parseSize(c.GlobalString(f)); err != nil {
+			log.Errorf("invalid %s %s", f, c.GlobalString(f))
+			return errFlagError
+		}
+	}
+
+	if c.GlobalBool("auto-strategy") && (c.GlobalBool("tar") || c.GlobalBool("delta")) {
+		log.Error("--auto-strategy picks --tar and --delta itself")
+		return errFlagError
+	}
+
+	if n, err := parseSize(c.GlobalString("chunk-size")); err != nil || n < 1 {
+		log.Errorf("invalid chunk size %s", c.GlobalString("chunk-size"))
+		return errFlagError
+	}
+
+	if _, err := parseSize(c.GlobalString("growing-threshold")); err != nil {
+		log.Error(err)
+		return errFlagError
+	}
+
+	switch c.GlobalString("on-case-collision") {
+	case "warn", "refuse":
+	default:
+		log.Error("on case collision must be warn or refuse")
+		return errFlagError
+	}
+
+	switch c.GlobalString("gate-mode") {
+	case "queue", "drop":
+	default:
+		log.Error("gate mode must be queue or drop")
+		return errFlagError
+	}
+
+	switch c.GlobalString("pause-mode") {
+	case "queue", "drop":
+	default:
+		log.Error("pause mode must be queue or drop")
+		return errFlagError
+	}
+
+	binary := extSet(c.GlobalStringSlice("binary-ext"))
+	for ext := range extSet(c.GlobalStringSlice("text-ext")) {
+		if binary[ext] {
+			log.Errorf("%s cannot be both a text and a binary extension", ext)
+			return errFlagError
+		}
+	}
+
+	switch c.GlobalString("eol") {
+	case "lf", "crlf":
+	default:
+		log.Error("eol must be lf or crlf")
+		return errFlagError
+	}
+
+	return nil
+}
+
+func setupLogging(c *cli.Context) error {
 	if c.GlobalBool("debug") == true {
 		log.SetLevel(log.DebugLevel)
 	}
 
+	// a process that is about to detach keeps logging to the terminal
+	if c.GlobalBool("daemon") && !isDaemonChild() {
+		return nil
+	}
+
+	if p := logFilePath(c); p != "" {
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(f)
+	}
+
 	return nil
 }
 
@@ -68,149 +350,906 @@ func getMachineConfigDir() string {
 	return filepath.Join(machineConfigPath, machineName)
 }
 
+// getSSHKeyPath returns the key referenced by the driver config, falling
+// back to the id_rsa in the machine config dir.
+func getSSHKeyPath(c *MachineConfig) string {
+	keyPath := c.Driver.SSHKeyPath
+	if keyPath == "" {
+		return filepath.Join(getMachineConfigDir(), "id_rsa")
+	}
+
+	if !filepath.IsAbs(keyPath) {
+		keyPath = filepath.Join(getMachineConfigDir(), keyPath)
+	}
+
+	return keyPath
+}
+
+// detectMachinePath returns the first known docker machine storage layout
+// that contains a config for the named machine.
+func detectMachinePath() (string, error) {
+	candidates := machineStorePaths()
+	for _, p := range candidates {
+		if _, err := os.Stat(filepath.Join(p, machineName, "config.json")); err == nil {
+			return p, nil
+		}
+	}
+
+	return "", fmt.Errorf("unable to find config for machine %s; checked %s (use --machine-path to specify)", machineName, strings.Join(candidates, ", "))
+}
+
+// machineStorePaths returns the directories docker machine may keep its
+// machines in, in the order they are searched.
+func machineStorePaths() []string {
+	home := os.Getenv("HOME")
+	candidates := []string{
+		filepath.Join(home, ".docker", "machine", "machines"),
+		filepath.Join(home, ".docker", "machines"),
+	}
+	if storagePath := os.Getenv("MACHINE_STORAGE_PATH"); storagePath != "" {
+		candidates = append([]string{filepath.Join(storagePath, "machines")}, candidates...)
+	}
+
+	return candidates
+}
+
+// listMachines returns the names of the machines with a config in the
+// machine path, or in any of the default locations when it isn't set.
+func listMachines(machinePath string) []string {
+	dirs := machineStorePaths()
+	if machinePath != "" {
+		dirs = []string{machinePath}
+	}
+
+	seen := map[string]bool{}
+	names := []string{}
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if seen[e.Name()] {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(dir, e.Name(), "config.json")); err == nil {
+				seen[e.Name()] = true
+				names = append(names, e.Name())
+			}
+		}
+	}
+
+	return names
+}
+
+// loadConfig reads the machine config.  docker machine may be rewriting it
+// so a config that fails to decode or validate is read again a couple of
+// times before giving up.
 func loadConfig() (*MachineConfig, error) {
+	conf := filepath.Join(getMachineConfigDir(), "config.json")
+
+	var err error
+	for i := 0; i < configAttempts; i++ {
+		if i > 0 {
+			log.Debugf("unable to load %s: %s; retrying", conf, err)
+			time.Sleep(configRetryDelay)
+		}
+
+		var c *MachineConfig
+		if c, err = readConfig(conf); err == nil {
+			return c, nil
+		}
+		if os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("unable to load machine config %s after %d attempts: %s", conf, configAttempts, err)
+}
+
+func readConfig(conf string) (*MachineConfig, error) {
 	c := &MachineConfig{}
 
-	conf := filepath.Join(getMachineConfigDir(), "config.json")
 	data, err := os.Open(conf)
 	if err != nil {
 		return nil, err
 	}
+	defer data.Close()
 
 	if err := json.NewDecoder(data).Decode(&c); err != nil {
 		return nil, err
 	}
 
+	if c.DriverName == "" {
+		return nil, errors.New("config is missing DriverName")
+	}
+
 	return c, nil
 }
 
-func watch(c *cli.Context) {
+// configure reads the flags shared by all commands into the globals.
+func configure(c *cli.Context) error {
 	srcPath = c.GlobalString("directory")
-	destPath = c.GlobalString("destination")
+	if fi, err := os.Stat(srcPath); err == nil && fi.Mode().IsRegular() {
+		singleFile = filepath.Clean(srcPath)
+		srcPath = filepath.Dir(singleFile)
+	}
+	if paths := c.GlobalStringSlice("watch-list"); len(paths) > 0 {
+		if singleFile != "" {
+			return errors.New("--watch-list can't be used when --directory is a file")
+		}
+		list, err := parseWatchList(paths)
+		if err != nil {
+			return err
+		}
+		watchList = list
+	}
+	chrootBase = c.GlobalString("chroot-base")
+	expectedMachineID = c.GlobalString("expect-machine-id")
+	machineIDFile = c.GlobalString("machine-id-file")
+	under, err := parseUnder(c.GlobalString("under"))
+	if err != nil {
+		return err
+	}
+	underDir = under
+	if extRoutes, err = parseRoutes(c.GlobalStringSlice("route")); err != nil {
+		return err
+	}
+	destPath = underDest(chrootPath(c.GlobalString("destination")))
 	machineName = c.GlobalString("machine")
 	machineUser = c.GlobalString("user")
 	machineConfigPath = c.GlobalString("machine-path")
+	machineIPCommand = c.GlobalString("machine-ip-command")
+	useTar = c.GlobalBool("tar")
+	skipOlderThan = c.GlobalDuration("skip-older-than")
+	maxDepth = c.GlobalInt("max-depth")
+	preserveMode = c.GlobalBool("preserve-mode")
+	enforceModes = c.GlobalBool("enforce-modes")
+	verifyUploads = c.GlobalBool("verify")
+	deltaUploads = c.GlobalBool("delta")
+	resumeUploads = c.GlobalBool("resume-uploads")
+	compressUploads = c.GlobalBool("compress")
+	syncHardlinks = c.GlobalBool("hardlinks")
+	if c.GlobalBool("encrypt") {
+		key, err := loadEncryptionKey(c.GlobalString("encryption-key"))
+		if err != nil {
+			return err
+		}
+		encryptionKey = key
+		// links would be named without the .enc extension
+		syncHardlinks = false
+	}
+	ignoreBusyDeletes = c.GlobalBool("ignore-busy-deletes")
+	batchDeletes = c.GlobalBool("batch-deletes")
+	noDelete = c.GlobalBool("no-delete")
+	mirrorMode = c.GlobalBool("mirror")
+	onPermissionDenied = c.GlobalString("on-permission-denied")
+	maxRequeues = c.GlobalInt("max-requeues")
+	verboseTransfers = c.GlobalBool("verbose-transfers")
+	remoteSymlink = c.GlobalString("remote-symlink")
+	remoteEnv = c.GlobalStringSlice("remote-env")
+	excludeGrowing = c.GlobalBool("exclude-larger-growing")
+	growingLimit, _ = parseSize(c.GlobalString("growing-threshold"))
+	chunk, _ := parseSize(c.GlobalString("chunk-size"))
+	autoStrategy = c.GlobalBool("auto-strategy")
+	configureDialer(c)
+	detectRenames = c.GlobalBool("rename-detection")
+	renames.window = c.GlobalDuration("rename-window")
+	renameMinSize, _ = parseSize(c.GlobalString("rename-min-size"))
+	autoTarFiles = c.GlobalInt("auto-tar-files")
+	autoTarAvgSize, _ = parseSize(c.GlobalString("auto-tar-avg-size"))
+	autoDeltaSize, _ = parseSize(c.GlobalString("auto-delta-size"))
+	packet, _ := parseSize(c.GlobalString("sftp-packet-size"))
+	sftpPacketSize = int(packet)
+	sftpRequests = c.GlobalInt("sftp-requests")
+	sftpConcurrentWrites = c.GlobalBool("sftp-concurrent-writes")
+	chunkSize = int(chunk)
+	growingWindow = c.GlobalDuration("growing-window")
+	showProgress = c.GlobalBool("progress")
+	logSkips = c.GlobalBool("log-skips")
+	resumeInitialSync = c.GlobalBool("resume")
+	maxTreeFiles = c.GlobalInt("max-files")
+	maxTreeSize, _ = parseSize(c.GlobalString("max-size"))
+	forceSync = c.GlobalBool("force")
+	checkInodes = c.GlobalBool("check-inodes")
+	followRemounts = c.GlobalBool("follow-remounts")
+	assumeYes = c.GlobalBool("yes")
+	if m := c.GlobalString("file-mode"); m != "" {
+		fileMode, _ = parseFileMode(m)
+	}
+	concurrency = c.GlobalInt("concurrency")
+	watchdogTimeout = c.GlobalDuration("watchdog")
+	initialConcurrency = c.GlobalInt("initial-concurrency")
+	if initialConcurrency == 0 {
+		initialConcurrency = concurrency
+	}
+	queueSize = c.GlobalInt("queue-size")
+	spillEvents = c.GlobalString("queue-overflow") == "spill"
+	syncPause.queue = c.GlobalString("pause-mode") == "queue"
+	syncPause.gateQueue = c.GlobalString("gate-mode") == "queue"
+	gateFile = c.GlobalString("gate-file")
+	postSync.command = c.GlobalString("post-sync")
+	askBecomePass = c.GlobalBool("ask-become-pass")
+	maxRuntime = c.GlobalDuration("max-runtime")
+	deleteGuard.max = c.GlobalInt("max-deletes")
+	deleteGuard.window = c.GlobalDuration("max-deletes-window")
+	postSync.delay = c.GlobalDuration("post-sync-delay")
+	postSync.jitter = c.GlobalDuration("post-sync-jitter")
+	onCaseCollision = c.GlobalString("on-case-collision")
+	gateWhenAbsent = c.GlobalBool("gate-absent")
+	transferBreaker.threshold = c.GlobalInt("breaker-threshold")
+	transferBreaker.cooldown = c.GlobalDuration("breaker-cooldown")
+	preserveXattrs = c.GlobalBool("preserve-xattrs")
+	normalizeEOL = c.GlobalBool("normalize-eol")
+	transforms = nil
+	for _, command := range c.GlobalStringSlice("transform") {
+		transforms = append(transforms, commandTransform(command))
+	}
+	eolStyle = c.GlobalString("eol")
+	eolPatterns = c.GlobalStringSlice("eol-pattern")
+	if len(eolPatterns) == 0 {
+		eolPatterns = defaultEOLPatterns
+	}
+	textExts = extSet(c.GlobalStringSlice("text-ext"))
+	binaryExts = extSet(c.GlobalStringSlice("binary-ext"))
 
-	done := make(chan bool)
-	errorChan := make(chan error)
+	filterRules, _ = parseFilterRules(c.GlobalStringSlice("filter"))
+	firstFilterWins = c.GlobalString("filter-order") == "first"
 
-	machineConfig, err := loadConfig()
-	if err != nil {
-		log.Fatal(err)
+	branchPrefix = c.GlobalString("branch-prefix")
+	if branchPrefix != "" {
+		branch, err := gitBranch(srcPath)
+		if err != nil {
+			return err
+		}
+		currentBranch = branch
+		destPath = branchDest(branch)
 	}
 
-	keyPath := filepath.Join(getMachineConfigDir(), "id_rsa")
-
-	kc := &keychain{}
-	if err := kc.loadPEM(keyPath); err != nil {
-		log.Fatal(err)
+	uidOffset = c.GlobalInt("uid-offset")
+	gidOffset = c.GlobalInt("gid-offset")
+	if p := c.GlobalString("owner-map"); p != "" {
+		rules, err := loadOwnerMap(p)
+		if err != nil {
+			return err
+		}
+		ownerRules = rules
 	}
 
-	sshConfig := &ssh.ClientConfig{
-		User: machineUser,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(kc),
-		},
+	for _, p := range c.GlobalStringSlice("exclude-from") {
+		if err := excludeFrom.add(p); err != nil {
+			return err
+		}
 	}
 
-	sshPort := 22
+	if singleFile == "" {
+		if err := destMarkers.loadTree(srcPath); err != nil {
+			return err
+		}
+	}
 
-	if machineConfig.Driver.SSHPort != 0 {
-		sshPort = machineConfig.Driver.SSHPort
+	if c.GlobalBool("use-gitignore") {
+		gitignore = newIgnoreMatcher(".gitignore")
+		if err := gitignore.loadTree(srcPath); err != nil {
+			return err
+		}
 	}
 
-	ip := "127.0.0.1"
-	if machineConfig.Driver.IPAddress != "" {
-		ip = machineConfig.Driver.IPAddress
+	if machineConfigPath == "" {
+		p, err := detectMachinePath()
+		if err != nil {
+			// with --machine-ip-command there may be no machine config;
+			// the key is still looked for in the default store
+			if machineIPCommand == "" {
+				return err
+			}
+			p = machineStorePaths()[0]
+		}
+		machineConfigPath = p
 	}
 
-	log.Debugf("connecting host=%s:%d user=%s", ip, sshPort, machineUser)
+	return nil
+}
 
-	sshClient, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", ip, sshPort), sshConfig)
+// connect opens the ssh and sftp connections to the machine.
+func connect(c *cli.Context) error {
+	machineConfig, err := loadConfig()
 	if err != nil {
-		log.Fatal(err)
+		// the config is only needed for the key when the address comes
+		// from a command
+		if machineIPCommand == "" {
+			return err
+		}
+		machineConfig = &MachineConfig{}
 	}
 
-	ftp, err := sftp.NewClient(sshClient)
-	rsftp = ftp
+	keyPath := getSSHKeyPath(machineConfig)
 
-	log.Debugf("connected to %s", sshClient.RemoteAddr())
-	log.Infof("machine sync: src=%s dest=%s machine=%s config-dir=%s", srcPath, destPath, machineName, machineConfigPath)
+	methods, _ := parseAuthMethods(c.GlobalString("auth-methods"))
+	auth, err := buildAuthMethods(methods, keyPath)
+	if err != nil {
+		return err
+	}
 
-	watcher, err := fsnotify.NewWatcher()
+	sshConfig := &ssh.ClientConfig{
+		User:            machineUser,
+		Auth:            auth,
+		HostKeyCallback: checkHostKey,
+	}
+	sshConfig.Ciphers, _ = parseAlgorithms("cipher", c.GlobalString("ssh-ciphers"), validCiphers)
+	sshConfig.KeyExchanges, _ = parseAlgorithms("key exchange", c.GlobalString("ssh-kex"), validKexAlgorithms)
+
+	addr, err := machineAddr(machineConfig)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	go func() {
-		for {
-			select {
-			case ev := <-watcher.Event:
-				log.Debug("event:", ev)
-				go handleEvent(ev, errorChan)
-				//syncMachine(syncCompleteChan, errorChan)
-			case err := <-watcher.Error:
-				log.Debug("error:", err)
-			}
-		}
-	}()
+	log.Debugf("connecting host=%s user=%s", addr, machineUser)
 
-	go func() {
-		for {
-			select {
-			case err := <-errorChan:
-				log.Errorf("error during sync: %s", err)
-			}
-		}
-	}()
+	sshClient, err := dialSSH(addr, sshConfig)
+	if err != nil {
+		return err
+	}
 
-	err = watcher.Watch(c.GlobalString("directory"))
+	ftp, err := sftp.NewClient(sshClient, sftpOptions()...)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	rssh = sshClient
+	rsftp = ftp
+	remoteStats.flush()
 
-	<-done
-	watcher.Close()
-}
+	if err := checkMachineID(); err != nil {
+		return err
+	}
 
-func handleEvent(evt *fsnotify.FileEvent, errChan chan error) {
-	// we cannot use filepath.Join here because if it is a windows client
-	// the remote paths will be wrong because the machine is linux
-	filePath := fmt.Sprintf("%s/%s", destPath, evt.Name)
-	if evt.IsDelete() {
-		log.Infof("deleting %s", filePath)
-		if err := rsftp.Remove(filePath); err != nil {
-			log.Error(err)
-			return
-		}
-	} else {
-		// this can probably be more efficient
-		log.Infof("updating %s", filePath)
-		localFile, err := os.Open(evt.Name)
-		if err != nil {
-			log.Error(err)
-			return
+	if err := promptBecomePass(); err != nil {
+		return err
+	}
+
+	detectCapabilities()
+	checkClockSkew()
+
+	if err := resolveOwners(ownerRules); err != nil {
+		return err
+	}
+
+	checkChroot()
+
+	log.Debugf("connected to %s", sshClient.RemoteAddr())
+	connEvents.up(sshClient)
+	log.Infof("machine sync: src=%s dest=%s machine=%s config-dir=%s", srcPath, destPath, machineName, machineConfigPath)
+
+	return nil
+}
+
+func watch(c *cli.Context) {
+	if err := checkFlags(c); err != nil {
+		os.Exit(1)
+	}
+
+	if p := c.GlobalString("explain"); p != "" {
+		explainPath(c, p)
+		return
+	}
+
+	if mode := c.GlobalString("dry-run"); mode != "" {
+		dryRun(c, mode)
+		return
+	}
+
+	if c.GlobalBool("daemon") && !isDaemonChild() {
+		if err := daemonize(logFilePath(c)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if dest := c.GlobalString("events-out"); dest != "" {
+		if err := syncEvents.open(dest); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	stopProfiling := startProfiling(c)
+
+	pidfile := c.GlobalString("pidfile")
+	if pidfile != "" {
+		if err := writePidfile(pidfile); err != nil {
+			log.Fatal(err)
 		}
-		// don't alert on missing remote files
-		_ = rsftp.Remove(filePath)
+	}
+
+	if err := configure(c); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := connect(c); err != nil {
+		log.Fatal(err)
+	}
+	reconnects.enable(c)
+
+	done := make(chan bool)
+	errorChan := make(chan error)
 
-		remoteFile, err := rsftp.Create(filePath)
+	if err := ensureDestPath(); err != nil {
+		log.Fatal(err)
+	}
+
+	waitGate()
+
+	if c.GlobalBool("initial-sync") || mirrorMode {
+		log.Infof("syncing %s", srcPath)
+		if err := initialSync(); err != nil {
+			log.Fatal(err)
+		}
+		if mirrorMode {
+			if err := reconcileMirror(); err != nil {
+				log.Fatal(err)
+			}
+		}
+	} else {
+		paths, err := syncPaths()
 		if err != nil {
-			log.Error(err)
-			return
+			log.Fatal(err)
+		}
+		if err := checkTreeSize(paths); err != nil {
+			log.Fatal(err)
 		}
+	}
 
-		// TODO: is not copying binaries correctly
-		data, err := ioutil.ReadAll(localFile)
+	// modes changed on the machine don't show up as local events
+	if enforceModes {
+		paths, err := syncPaths()
 		if err != nil {
-			log.Error(err)
-			return
+			log.Fatal(err)
 		}
-		if _, err := remoteFile.Write(data); err != nil {
-			log.Error(err)
-			return
+		if err := repairModes(paths); err != nil {
+			log.Errorf("unable to repair file modes: %s", err)
 		}
 	}
+
+	if err := updateRemoteSymlink(); err != nil {
+		log.Fatal(err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the branch is read again whenever HEAD is rewritten
+	gitHead := ""
+	if branchPrefix != "" {
+		if gitHead, err = gitHeadPath(srcPath); err != nil {
+			log.Fatal(err)
+		}
+		if err := watcher.Watch(filepath.Dir(gitHead)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if spillEvents {
+		if spill, err = newSpillQueue(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	startWorkers(concurrency, errorChan)
+
+	if gateFile != "" {
+		go pollGate()
+	}
+
+	if watchdogTimeout > 0 {
+		go runWatchdog()
+	}
+
+	if c.GlobalBool("throttle-on-battery") {
+		throttleDelay = c.GlobalDuration("throttle-delay")
+		go monitorResources()
+	}
+
+	go func() {
+		events, errs := watcher.Event, watcher.Error
+		for {
+			select {
+			case ev, ok := <-events:
+				if !ok {
+					events = nil
+					stopWatching(done)
+					continue
+				}
+				log.Debug("event:", ev)
+				if ev.IsDelete() {
+					watched.remove(ev.Name)
+				}
+				if p, ok := excludeFrom.has(ev.Name); ok {
+					if err := excludeFrom.load(p); err != nil && !os.IsNotExist(err) {
+						log.Errorf("unable to load %s: %s", p, err)
+					}
+				}
+				if filepath.Base(ev.Name) == destMarkerName {
+					go reloadMarker(ev.Name)
+				}
+				if gitignore != nil && filepath.Base(ev.Name) == ".gitignore" {
+					if err := gitignore.loadFile(ev.Name); err != nil {
+						log.Errorf("unable to load %s: %s", ev.Name, err)
+					}
+				}
+				if branchPrefix != "" && filepath.Clean(ev.Name) == gitHead {
+					go updateBranch()
+				}
+				if singleFile != "" && !singleFileEvent(ev) {
+					continue
+				}
+				if isExcluded(ev.Name, isDir(ev.Name)) {
+					logSkip(ev.Name, skipExcluded)
+					continue
+				}
+				newDir := ev.IsCreate() && isDir(ev.Name)
+				if newDir {
+					if err := watchTree(watcher, ev.Name); err != nil {
+						log.Errorf("unable to watch %s: %s", ev.Name, err)
+					}
+				}
+				if syncPause.hold(ev) {
+					continue
+				}
+				dispatch(ev)
+				if newDir {
+					dispatchTree(ev.Name)
+				}
+				//syncMachine(syncCompleteChan, errorChan)
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil
+					stopWatching(done)
+					continue
+				}
+				handleWatchError(watcher, err)
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case err := <-errorChan:
+				log.Errorf("error during sync: %s", err)
+			}
+		}
+	}()
+
+	handlePauseSignals()
+
+	if addr := c.GlobalString("status-addr"); addr != "" {
+		go func() {
+			if err := serveStatus(addr); err != nil {
+				log.Errorf("status server: %s", err)
+			}
+		}()
+	}
+
+	if c.GlobalBool("tui") {
+		if isTerminal() {
+			// logs would scroll the view away
+			if logFilePath(c) == "" {
+				log.SetOutput(ioutil.Discard)
+			}
+			go runTUI()
+		} else {
+			log.Warn("stdout is not a terminal; ignoring --tui")
+		}
+	}
+
+	if err := rewatch(watcher); err != nil {
+		log.Fatal(err)
+	}
+
+	if followRemounts {
+		go watchRemounts(watcher, done)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	var timeout <-chan time.Time
+	if maxRuntime > 0 {
+		timeout = time.After(maxRuntime)
+	}
+	timedOut := false
+	go func() {
+		select {
+		case s := <-sigs:
+			log.Infof("received %s; shutting down", s)
+		case <-timeout:
+			log.Infof("reached --max-runtime of %s; shutting down", maxRuntime)
+			timedOut = true
+		}
+		close(done)
+	}()
+
+	<-done
+	watcher.Close()
+	finishTransfers()
+
+	if spill != nil {
+		spill.close()
+	}
+
+	if verboseTransfers {
+		opStats.logSummary()
+	}
+
+	stopProfiling()
+
+	if pidfile != "" {
+		os.Remove(pidfile)
+	}
+
+	if timedOut {
+		os.Exit(exitMaxRuntime)
+	}
+}
+
+// handleEvent syncs the change evt reports.  When the connection to the
+// machine drops it returns the error so the worker can handle evt again
+// once reconnected; any other failure is logged here.
+func handleEvent(evt *fsnotify.FileEvent, errChan chan error) error {
+	if noDelete && isRemoval(evt) {
+		logSkip(evt.Name, skipNoDelete)
+		return nil
+	}
+
+	defer transferBreaker.finish(transferBreaker.wait())
+
+	var err error
+	start := time.Now()
+	filePath := remotePath(evt.Name)
+	op := "upload"
+	if isRemoval(evt) {
+		op = "delete"
+		log.Infof("deleting %s", filePath)
+		err = removeFile(filePath)
+	} else if isDir(evt.Name) {
+		op = "mkdir"
+		log.Infof("creating %s", filePath)
+		err = timeOp("mkdir", filePath, func() error {
+			return remoteMkdirAll(filePath)
+		})
+		if err == nil {
+			applyOwner(evt.Name, filePath)
+		}
+	} else {
+		if growingTracker.check(evt.Name) {
+			logSkip(evt.Name, skipGrowing)
+			return nil
+		}
+		log.Infof("updating %s", filePath)
+		err = retry(func() error {
+			return uploadFile(evt.Name, filePath)
+		}, isTooManyOpenFiles)
+		if err == errFileChanged && requeue(evt) {
+			return nil
+		}
+		requeues.reset(evt.Name)
+		if err == nil && verifyUploads {
+			err = verifyPaths([]string{evt.Name})
+		}
+	}
+
+	if isConnectionLost(err) && reconnects.isEnabled() {
+		log.Warnf("connection to %s lost while syncing %s; retrying after reconnecting", machineName, evt.Name)
+		return err
+	}
+
+	if err != nil && isPermissionDenied(err) {
+		switch onPermissionDenied {
+		case "skip":
+			log.Warnf("skipping %s: permission denied for %s", filePath, machineUser)
+			logSkip(evt.Name, skipPermission)
+			return nil
+		case "fail":
+			log.Fatalf("permission denied for %s on %s:%s", machineUser, machineName, filePath)
+		case "retry":
+			if retryPermissionDenied(evt) {
+				return nil
+			}
+		}
+	}
+	permissionRequeues.reset(evt.Name)
+
+	if !isLocalError(err, evt.Name) {
+		transferBreaker.record(err)
+	}
+	if err != nil {
+		err = &syncError{op: op, local: evt.Name, remote: filePath, err: err}
+	}
+
+	switch op {
+	case "delete":
+		syncEvents.emit("delete", evt.Name, filePath, 0, start, err)
+	case "upload":
+		syncEvents.emit("upload", evt.Name, filePath, fileSize(evt.Name), start, err)
+	}
+
+	syncStats.record(filePath, err)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	postSync.trigger()
+
+	return nil
+}
+
+// removeFile deletes filePath, retrying while the machine reports it busy.
+// A path that is already gone counts as deleted.
+func removeFile(filePath string) error {
+	defer remoteStats.invalidate(filePath)
+
+	// the file was uploaded encrypted; a directory is removed as is below
+	if encryptionKey != nil && !strings.HasSuffix(filePath, encryptedExt) {
+		if err := removeFile(filePath + encryptedExt); err != nil {
+			return err
+		}
+	}
+
+	err := retry(func() error {
+		return timeOp("remove", filePath, func() error {
+			return rsftp.Remove(filePath)
+		})
+	}, func(err error) bool {
+		return isTooManyOpenFiles(err) || isFileBusy(err)
+	})
+	if err != nil && isNotExist(err) {
+		log.Debugf("%s is already deleted", filePath)
+		return nil
+	}
+	if canBecome(err) {
+		q := shellQuote(filePath)
+		err = becomeRun(fmt.Sprintf("if [ -d %s ]; then rmdir -- %s; else rm -f -- %s; fi", q, q, q), nil)
+	}
+	if err != nil && ignoreBusyDeletes && isFileBusy(err) {
+		log.Warnf("not deleting busy file %s: %s", filePath, err)
+		logSkip(filePath, skipBusy)
+		return nil
+	}
+
+	return err
+}
+
+func remotePath(localPath string) string {
+	if singleFile != "" && filepath.Clean(localPath) == singleFile {
+		return destPath
+	}
+
+	if filePath, ok := destMarkers.route(localPath); ok {
+		return filePath
+	}
+
+	if filePath, ok := routeByExt(localPath); ok {
+		return filePath
+	}
+
+	// we cannot use filepath.Join here because if it is a windows client
+	// the remote paths will be wrong because the machine is linux
+	return fmt.Sprintf("%s/%s", destPath, filepath.ToSlash(localPath))
+}
+
+func uploadFile(localPath, filePath string) error {
+	if err := checkCaseCollision(localPath, filePath); err != nil {
+		return err
+	}
+
+	before, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+
+	data, err := uploadContent(localPath)
+	if err != nil {
+		return err
+	}
+
+	// don't upload a mix of old and new content
+	after, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	if fileChanged(before, after) {
+		return errFileChanged
+	}
+
+	if encryptionKey != nil {
+		if data, err = encrypt(encryptionKey, data); err != nil {
+			return err
+		}
+		filePath += encryptedExt
+	}
+
+	written := renames.move(filePath, data)
+	if !written && chooseStrategy(filePath, int64(len(data))) == strategyDelta {
+		if written, err = uploadDelta(filePath, data); err != nil {
+			return err
+		}
+	}
+
+	if !written && resumeUploads {
+		if written, err = resumeUpload(filePath, data); err != nil {
+			return err
+		}
+	}
+
+	// encrypted content doesn't compress
+	if !written && compressUploads && encryptionKey == nil {
+		if written, err = uploadCompressed(localPath, filePath, data); err != nil {
+			return err
+		}
+	}
+
+	if !written {
+		if err := writeRemote(filePath, data); err != nil {
+			return err
+		}
+	}
+	hardlinks.uploaded(localPath, filePath)
+
+	if err := applyMode(localPath, filePath); err != nil {
+		return err
+	}
+
+	applyXattrs(localPath, filePath)
+	applyOwner(localPath, filePath)
+
+	return nil
+}
+
+// writeRemote replaces filePath on the machine with data.
+func writeRemote(filePath string, data []byte) error {
+	defer remoteStats.invalidate(filePath)
+
+	// don't alert on missing remote files
+	_ = timeOp("remove", filePath, func() error {
+		return rsftp.Remove(filePath)
+	})
+
+	var remoteFile *sftp.File
+	create := func() error {
+		return timeOp("open", filePath, func() (err error) {
+			remoteFile, err = rsftp.Create(filePath)
+			return err
+		})
+	}
+	err := create()
+	if err != nil && isNotExist(err) {
+		// the parent hasn't been created yet
+		err = rsftp.MkdirAll(path.Dir(filePath))
+		if err == nil {
+			err = create()
+		}
+	}
+	if canBecome(err) {
+		return becomeWrite(filePath, data)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := timeOp("write", filePath, func() error {
+		return writeFull(&progressWriter{remoteFile}, data)
+	}); err != nil {
+		remoteFile.Close()
+		return err
+	}
+
+	// the final writes may only fail once the file is closed
+	if err := timeOp("close", filePath, remoteFile.Close); err != nil {
+		return err
+	}
+	syncStats.addBytes(int64(len(data)))
+
+	return nil
 }
 
 func main() {
@@ -218,36 +1257,719 @@ func main() {
 	app.Name = "machine-sync"
 	app.Usage = "sync files for docker machine"
 	app.Action = watch
-	app.Before = checkFlags
+	app.Before = setupLogging
+	// every global flag can also be set with a MACHINE_SYNC_ environment
+	// variable named after it; a flag on the command line takes precedence
+	// over the environment, which takes precedence over the default
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
-			Name:  "directory, d",
-			Value: "",
-			Usage: "path to watch directory",
+			Name:   "directory, d",
+			EnvVar: "MACHINE_SYNC_DIRECTORY",
+			Value:  "",
+			Usage:  "path to watch directory, or a single file to sync to the destination path",
+		},
+		cli.StringFlag{
+			Name:   "machine, m",
+			EnvVar: "MACHINE_SYNC_MACHINE",
+			Value:  "",
+			Usage:  "name of docker machine to sync",
+		},
+		cli.StringFlag{
+			Name:   "machine-path, c",
+			EnvVar: "MACHINE_SYNC_MACHINE_PATH",
+			Value:  "",
+			Usage:  "path to docker machine config directory (detected if not specified)",
+		},
+		cli.StringFlag{
+			Name:   "dialer",
+			EnvVar: "MACHINE_SYNC_DIALER",
+			Value:  dialerDirect,
+			Usage:  "how to reach the machine's ssh server: direct, or http-connect through --http-proxy",
+		},
+		cli.StringFlag{
+			Name:   "http-proxy",
+			EnvVar: "MACHINE_SYNC_HTTP_PROXY",
+			Usage:  "http:// or https:// url of the proxy for --dialer http-connect; user:password@ in the url is sent as basic auth",
+		},
+		cli.StringFlag{
+			Name:   "machine-ip-command",
+			EnvVar: "MACHINE_SYNC_MACHINE_IP_COMMAND",
+			Value:  "",
+			Usage:  "command printing the IP:PORT to connect to, used instead of the machine config",
+		},
+		cli.StringFlag{
+			Name:   "destination, p",
+			EnvVar: "MACHINE_SYNC_DESTINATION",
+			Value:  "",
+			Usage:  "path on destination machine to sync",
+		},
+		cli.StringFlag{
+			Name:   "under",
+			EnvVar: "MACHINE_SYNC_UNDER",
+			Value:  "",
+			Usage:  "sync into this directory below the destination, to keep several directories apart in one destination",
+		},
+		cli.StringSliceFlag{
+			Name:   "route",
+			EnvVar: "MACHINE_SYNC_ROUTE",
+			Usage:  "ext:dest to sync files with the extension below the absolute path dest instead of the destination; may be repeated",
+		},
+		cli.StringFlag{
+			Name:   "branch-prefix",
+			EnvVar: "MACHINE_SYNC_BRANCH_PREFIX",
+			Value:  "",
+			Usage:  "sync to a directory named after the current git branch under this path instead of --destination",
+		},
+		cli.StringFlag{
+			Name:   "expect-machine-id",
+			EnvVar: "MACHINE_SYNC_EXPECT_MACHINE_ID",
+			Value:  "",
+			Usage:  "refuse to sync unless --machine-id-file on the machine contains this value",
+		},
+		cli.StringFlag{
+			Name:   "machine-id-file",
+			EnvVar: "MACHINE_SYNC_MACHINE_ID_FILE",
+			Value:  "/etc/machine-id",
+			Usage:  "file on the machine compared against --expect-machine-id",
+		},
+		cli.StringFlag{
+			Name:   "chroot-base",
+			EnvVar: "MACHINE_SYNC_CHROOT_BASE",
+			Value:  "",
+			Usage:  "directory on the machine the sftp user is chrooted to; destinations below it are resolved inside the chroot",
+		},
+		cli.StringFlag{
+			Name:   "user, u",
+			EnvVar: "MACHINE_SYNC_USER",
+			Value:  "root",
+			Usage:  "user on machine to use for connection",
+		},
+		cli.StringFlag{
+			Name:   "auth-methods",
+			EnvVar: "MACHINE_SYNC_AUTH_METHODS",
+			Value:  "key",
+			Usage:  "comma separated auth methods to try in order (key, agent, password)",
+		},
+		cli.StringFlag{
+			Name:   "ssh-ciphers",
+			EnvVar: "MACHINE_SYNC_SSH_CIPHERS",
+			Value:  "",
+			Usage:  "comma separated ciphers to offer, for machines that don't accept the defaults (" + strings.Join(validCiphers, ", ") + ")",
+		},
+		cli.StringFlag{
+			Name:   "ssh-kex",
+			EnvVar: "MACHINE_SYNC_SSH_KEX",
+			Value:  "",
+			Usage:  "comma separated key exchange algorithms to offer (" + strings.Join(validKexAlgorithms, ", ") + ")",
+		},
+		cli.BoolFlag{
+			Name:   "yes, y",
+			EnvVar: "MACHINE_SYNC_YES",
+			Usage:  "answer yes: trust the machine's host key when it isn't in known_hosts and allow --mirror to delete",
+		},
+		cli.IntFlag{
+			Name:   "concurrency",
+			EnvVar: "MACHINE_SYNC_CONCURRENCY",
+			Value:  4,
+			Usage:  "number of files to transfer at once while watching",
+		},
+		cli.StringFlag{
+			Name:   "sftp-packet-size",
+			EnvVar: "MACHINE_SYNC_SFTP_PACKET_SIZE",
+			Value:  "32K",
+			Usage:  "largest sftp packet to send; more than 32K helps on fast links with high latency but not every server accepts it",
+		},
+		cli.IntFlag{
+			Name:   "sftp-requests",
+			EnvVar: "MACHINE_SYNC_SFTP_REQUESTS",
+			Value:  64,
+			Usage:  "sftp requests in flight per file; more keeps a high latency link busy at the cost of memory",
+		},
+		cli.BoolFlag{
+			Name:   "sftp-concurrent-writes",
+			EnvVar: "MACHINE_SYNC_SFTP_CONCURRENT_WRITES",
+			Usage:  "send the writes of a file concurrently; faster on high latency links, but a failed upload may leave gaps in the file",
+		},
+		cli.StringFlag{
+			Name:   "chunk-size",
+			EnvVar: "MACHINE_SYNC_CHUNK_SIZE",
+			Value:  "32K",
+			Usage:  "size of the buffers file content is copied with",
+		},
+		cli.IntFlag{
+			Name:   "initial-concurrency",
+			EnvVar: "MACHINE_SYNC_INITIAL_CONCURRENCY",
+			Value:  0,
+			Usage:  "number of files to transfer at once during the initial sync; defaults to --concurrency",
+		},
+		cli.DurationFlag{
+			Name:   "max-runtime",
+			EnvVar: "MACHINE_SYNC_MAX_RUNTIME",
+			Value:  0,
+			Usage:  "stop watching after this long, letting transfers in flight finish, and exit with code 5",
+		},
+		cli.DurationFlag{
+			Name:   "watchdog",
+			EnvVar: "MACHINE_SYNC_WATCHDOG",
+			Value:  5 * time.Minute,
+			Usage:  "reconnect when no event finishes and no data is sent for this long while work is pending (0 to disable)",
+		},
+		cli.IntFlag{
+			Name:   "queue-size",
+			EnvVar: "MACHINE_SYNC_QUEUE_SIZE",
+			Value:  64,
+			Usage:  "events each worker can have waiting before --queue-overflow applies",
+		},
+		cli.StringFlag{
+			Name:   "queue-overflow",
+			EnvVar: "MACHINE_SYNC_QUEUE_OVERFLOW",
+			Value:  "backpressure",
+			Usage:  "what to do when the queues are full: stop reading events until there is room, or spill them to a temporary file (backpressure or spill)",
+		},
+		cli.BoolFlag{
+			Name:   "throttle-on-battery",
+			EnvVar: "MACHINE_SYNC_THROTTLE_ON_BATTERY",
+			Usage:  "transfer one file at a time with --throttle-delay between them while on battery or under high load",
+		},
+		cli.DurationFlag{
+			Name:   "throttle-delay",
+			EnvVar: "MACHINE_SYNC_THROTTLE_DELAY",
+			Value:  2 * time.Second,
+			Usage:  "delay before each transfer while throttled",
+		},
+		cli.BoolFlag{
+			Name:   "initial-sync, i",
+			EnvVar: "MACHINE_SYNC_INITIAL_SYNC",
+			Usage:  "sync the whole directory to the machine before watching",
+		},
+		cli.BoolFlag{
+			Name:   "progress",
+			EnvVar: "MACHINE_SYNC_PROGRESS",
+			Usage:  "show the progress of the initial sync with an estimated time remaining",
+		},
+		cli.BoolFlag{
+			Name:   "resume",
+			EnvVar: "MACHINE_SYNC_RESUME",
+			Usage:  "keep a journal of files transferred by the initial sync so an interrupted sync continues where it stopped (not used with --tar)",
+		},
+		cli.BoolFlag{
+			Name:   "tar",
+			EnvVar: "MACHINE_SYNC_TAR",
+			Usage:  "upload the initial sync as a single tar archive extracted on the machine",
+		},
+		cli.BoolFlag{
+			Name:   "use-gitignore",
+			EnvVar: "MACHINE_SYNC_USE_GITIGNORE",
+			Usage:  "exclude paths ignored by .gitignore files in the directory",
+		},
+		cli.StringFlag{
+			Name:   "explain",
+			EnvVar: "MACHINE_SYNC_EXPLAIN",
+			Value:  "",
+			Usage:  "print why a path is or isn't synced, where it goes and how it compares with the machine, and exit",
+		},
+		cli.StringFlag{
+			Name:   "dry-run",
+			EnvVar: "MACHINE_SYNC_DRY_RUN",
+			Value:  "",
+			Usage:  "print what the initial sync would change and exit: local lists what would be uploaded, remote compares with the machine",
+		},
+		cli.BoolFlag{
+			Name:   "encrypt",
+			EnvVar: "MACHINE_SYNC_ENCRYPT",
+			Usage:  "encrypt file contents with AES-GCM before upload, writing them with a .enc extension",
+		},
+		cli.StringFlag{
+			Name:   "encryption-key",
+			EnvVar: "MACHINE_SYNC_ENCRYPTION_KEY",
+			Value:  "",
+			Usage:  "file holding the hex encoded 32 byte key for --encrypt and decrypt",
+		},
+		cli.BoolFlag{
+			Name:   "follow-remounts",
+			EnvVar: "MACHINE_SYNC_FOLLOW_REMOUNTS",
+			Usage:  "watch the directory again and resync when the filesystem mounted on it changes",
+		},
+		cli.StringSliceFlag{
+			Name:   "watch-list",
+			EnvVar: "MACHINE_SYNC_WATCH_LIST",
+			Usage:  "file or directory under --directory to watch and sync instead of the whole directory; may be repeated",
+		},
+		cli.StringSliceFlag{
+			Name:   "exclude-from",
+			EnvVar: "MACHINE_SYNC_EXCLUDE_FROM",
+			Usage:  "file of exclude patterns in .gitignore syntax, relative to the directory; reloaded when it changes inside the directory; may be repeated",
+		},
+		cli.StringSliceFlag{
+			Name:   "filter",
+			EnvVar: "MACHINE_SYNC_FILTER",
+			Usage:  "ordered include (\"+ pattern\") or exclude (\"- pattern\") rule using .gitignore patterns; directories that are excluded aren't descended into",
+		},
+		cli.StringFlag{
+			Name:   "filter-order",
+			EnvVar: "MACHINE_SYNC_FILTER_ORDER",
+			Value:  "first",
+			Usage:  "whether the first or last matching --filter rule decides (first or last)",
+		},
+		cli.IntFlag{
+			Name:   "max-depth",
+			EnvVar: "MACHINE_SYNC_MAX_DEPTH",
+			Value:  0,
+			Usage:  "how many directory levels below the directory to watch and sync (0 for unlimited)",
+		},
+		cli.IntFlag{
+			Name:   "max-files",
+			EnvVar: "MACHINE_SYNC_MAX_FILES",
+			Value:  100000,
+			Usage:  "refuse to sync a directory with more files than this unless --force is given (0 for unlimited)",
+		},
+		cli.StringFlag{
+			Name:   "max-size",
+			EnvVar: "MACHINE_SYNC_MAX_SIZE",
+			Value:  "10G",
+			Usage:  "refuse to sync a directory larger than this (e.g. 512M, 10G) unless --force is given (0 for unlimited)",
+		},
+		cli.IntFlag{
+			Name:   "max-deletes",
+			EnvVar: "MACHINE_SYNC_MAX_DELETES",
+			Usage:  "hold back deletions once more than this many happen within --max-deletes-window until they are confirmed on the terminal or through --status-addr, unless --force is given",
+		},
+		cli.DurationFlag{
+			Name:   "max-deletes-window",
+			EnvVar: "MACHINE_SYNC_MAX_DELETES_WINDOW",
+			Value:  10 * time.Second,
+			Usage:  "window --max-deletes is counted over",
+		},
+		cli.BoolFlag{
+			Name:   "check-inodes",
+			EnvVar: "MACHINE_SYNC_CHECK_INODES",
+			Usage:  "refuse to sync more paths than the destination has free inodes unless --force is given",
+		},
+		cli.BoolFlag{
+			Name:   "force",
+			EnvVar: "MACHINE_SYNC_FORCE",
+			Usage:  "sync the directory even when it exceeds --max-files, --max-size or the free inodes, and make any number of deletions",
+		},
+		cli.DurationFlag{
+			Name:   "skip-older-than",
+			EnvVar: "MACHINE_SYNC_SKIP_OLDER_THAN",
+			Usage:  "skip files not modified within this duration (e.g. 24h) during the initial sync",
+		},
+		cli.IntFlag{
+			Name:   "breaker-threshold",
+			EnvVar: "MACHINE_SYNC_BREAKER_THRESHOLD",
+			Value:  5,
+			Usage:  "consecutive failed transfers before pausing transfers to the machine (0 to disable)",
+		},
+		cli.DurationFlag{
+			Name:   "breaker-cooldown",
+			EnvVar: "MACHINE_SYNC_BREAKER_COOLDOWN",
+			Value:  30 * time.Second,
+			Usage:  "how long to pause transfers after the breaker trips before probing the machine",
+		},
+		cli.StringSliceFlag{
+			Name:   "remote-env",
+			EnvVar: "MACHINE_SYNC_REMOTE_ENV",
+			Usage:  "KEY=VALUE to set for commands run on the machine (must be allowed by AcceptEnv in the machine's sshd_config)",
+		},
+		cli.StringFlag{
+			Name:   "remote-symlink",
+			EnvVar: "MACHINE_SYNC_REMOTE_SYMLINK",
+			Value:  "",
+			Usage:  "link:target symlink to create or update on the machine after syncing (e.g. /app:/srv/releases/current)",
+		},
+		cli.StringFlag{
+			Name:   "status-addr",
+			EnvVar: "MACHINE_SYNC_STATUS_ADDR",
+			Value:  "",
+			Usage:  "address to serve the status, pause and resume endpoints on (e.g. 127.0.0.1:8900)",
+		},
+		cli.StringFlag{
+			Name:   "pause-mode",
+			EnvVar: "MACHINE_SYNC_PAUSE_MODE",
+			Value:  "queue",
+			Usage:  "what to do with events while paused (queue or drop)",
+		},
+		cli.StringFlag{
+			Name:   "post-sync",
+			EnvVar: "MACHINE_SYNC_POST_SYNC",
+			Value:  "",
+			Usage:  "command to run on the machine once a burst of changes has been synced (e.g. reloading a service)",
+		},
+		cli.DurationFlag{
+			Name:   "post-sync-delay",
+			EnvVar: "MACHINE_SYNC_POST_SYNC_DELAY",
+			Value:  time.Second,
+			Usage:  "how long to wait after the last synced change before running --post-sync",
+		},
+		cli.DurationFlag{
+			Name:   "post-sync-jitter",
+			EnvVar: "MACHINE_SYNC_POST_SYNC_JITTER",
+			Value:  500 * time.Millisecond,
+			Usage:  "random extra wait of up to this before running --post-sync, so machines don't all run it at once",
+		},
+		cli.StringFlag{
+			Name:   "gate-file",
+			EnvVar: "MACHINE_SYNC_GATE_FILE",
+			Value:  "",
+			Usage:  "only sync while this local file exists, pausing while it doesn't",
+		},
+		cli.BoolFlag{
+			Name:   "gate-absent",
+			EnvVar: "MACHINE_SYNC_GATE_ABSENT",
+			Usage:  "only sync while --gate-file doesn't exist instead",
+		},
+		cli.StringFlag{
+			Name:   "gate-mode",
+			EnvVar: "MACHINE_SYNC_GATE_MODE",
+			Value:  "queue",
+			Usage:  "what to do with events while the gate is closed (queue or drop)",
+		},
+		cli.BoolFlag{
+			Name:   "rename-detection",
+			EnvVar: "MACHINE_SYNC_RENAME_DETECTION",
+			Usage:  "hold deletions for --rename-window and rename a deleted file on the machine when a new file has the same content instead of uploading it again",
+		},
+		cli.DurationFlag{
+			Name:   "rename-window",
+			EnvVar: "MACHINE_SYNC_RENAME_WINDOW",
+			Value:  2 * time.Second,
+			Usage:  "how long deletions are held for --rename-detection",
+		},
+		cli.StringFlag{
+			Name:   "rename-min-size",
+			EnvVar: "MACHINE_SYNC_RENAME_MIN_SIZE",
+			Value:  "1M",
+			Usage:  "smallest file --rename-detection looks for a match for",
+		},
+		cli.BoolFlag{
+			Name:   "auto-strategy",
+			EnvVar: "MACHINE_SYNC_AUTO_STRATEGY",
+			Usage:  "pick tar for an initial sync of many small files and delta for large files already on the machine instead of --tar and --delta",
+		},
+		cli.IntFlag{
+			Name:   "auto-tar-files",
+			EnvVar: "MACHINE_SYNC_AUTO_TAR_FILES",
+			Value:  100,
+			Usage:  "files an initial sync needs for --auto-strategy to send it as a tar archive",
+		},
+		cli.StringFlag{
+			Name:   "auto-tar-avg-size",
+			EnvVar: "MACHINE_SYNC_AUTO_TAR_AVG_SIZE",
+			Value:  "256K",
+			Usage:  "largest average file size --auto-strategy sends as a tar archive",
+		},
+		cli.StringFlag{
+			Name:   "auto-delta-size",
+			EnvVar: "MACHINE_SYNC_AUTO_DELTA_SIZE",
+			Value:  "1M",
+			Usage:  "smallest file already on the machine --auto-strategy sends as a delta",
+		},
+		cli.BoolFlag{
+			Name:   "delta",
+			EnvVar: "MACHINE_SYNC_DELTA",
+			Usage:  "only send the changed blocks of files that already exist on the machine",
+		},
+		cli.BoolFlag{
+			Name:   "exclude-larger-growing",
+			EnvVar: "MACHINE_SYNC_EXCLUDE_LARGER_GROWING",
+			Usage:  "stop syncing files, such as logs, that only grow by more than --growing-threshold within --growing-window",
+		},
+		cli.StringFlag{
+			Name:   "growing-threshold",
+			EnvVar: "MACHINE_SYNC_GROWING_THRESHOLD",
+			Value:  "10M",
+			Usage:  "growth within --growing-window after which a file is warned about or excluded (0 to disable)",
+		},
+		cli.DurationFlag{
+			Name:   "growing-window",
+			EnvVar: "MACHINE_SYNC_GROWING_WINDOW",
+			Value:  time.Minute,
+			Usage:  "window to measure the growth of changing files over",
+		},
+		cli.BoolFlag{
+			Name:   "compress",
+			EnvVar: "MACHINE_SYNC_COMPRESS",
+			Usage:  "send compressible files gzipped and decompress them on the machine (requires gzip on the machine)",
+		},
+		cli.BoolFlag{
+			Name:   "resume-uploads",
+			EnvVar: "MACHINE_SYNC_RESUME_UPLOADS",
+			Usage:  "continue large uploads that were cut off from where they stopped instead of starting over",
+		},
+		cli.IntFlag{
+			Name:   "max-requeues",
+			EnvVar: "MACHINE_SYNC_MAX_REQUEUES",
+			Value:  3,
+			Usage:  "times to try again when a file changes while it is being uploaded",
+		},
+		cli.BoolFlag{
+			Name:   "ask-become-pass",
+			EnvVar: "MACHINE_SYNC_ASK_BECOME_PASS",
+			Usage:  "prompt for the user's sudo password on the machine and write through sudo where sftp is denied",
+		},
+		cli.StringFlag{
+			Name:   "on-case-collision",
+			EnvVar: "MACHINE_SYNC_ON_CASE_COLLISION",
+			Value:  "warn",
+			Usage:  "when the machine's filesystem is case insensitive, what to do with files whose names only differ in case (warn or refuse)",
+		},
+		cli.StringFlag{
+			Name:   "on-permission-denied",
+			EnvVar: "MACHINE_SYNC_ON_PERMISSION_DENIED",
+			Value:  "log",
+			Usage:  "what to do when the machine denies a change: log and continue, skip quietly, fail and exit, or retry after a delay (log, skip, fail or retry)",
+		},
+		cli.BoolFlag{
+			Name:   "ignore-busy-deletes",
+			EnvVar: "MACHINE_SYNC_IGNORE_BUSY_DELETES",
+			Usage:  "log instead of failing when a file on the machine is still busy after retrying its delete",
+		},
+		cli.BoolFlag{
+			Name:   "mirror",
+			EnvVar: "MACHINE_SYNC_MIRROR",
+			Usage:  "make the destination an exact copy of the directory: sync it, DELETE everything on the machine that doesn't exist locally (requires --yes), then watch",
+		},
+		cli.BoolFlag{
+			Name:   "no-delete",
+			EnvVar: "MACHINE_SYNC_NO_DELETE",
+			Usage:  "never remove files on the machine, even when they are deleted locally (takes precedence over any reconciliation)",
+		},
+		cli.BoolFlag{
+			Name:   "batch-deletes",
+			EnvVar: "MACHINE_SYNC_BATCH_DELETES",
+			Usage:  "remove bursts of deleted files with a single rm on the machine",
+		},
+		cli.BoolFlag{
+			Name:   "hardlinks",
+			EnvVar: "MACHINE_SYNC_HARDLINKS",
+			Usage:  "upload hardlinked files once and link them on the machine (not supported on windows)",
+		},
+		cli.BoolFlag{
+			Name:   "verify",
+			EnvVar: "MACHINE_SYNC_VERIFY",
+			Usage:  "check the sha256 of uploaded files on the machine",
+		},
+		cli.BoolFlag{
+			Name:   "preserve-mode",
+			EnvVar: "MACHINE_SYNC_PRESERVE_MODE",
+			Usage:  "set the mode of uploaded files to match the local files",
+		},
+		cli.StringFlag{
+			Name:   "file-mode",
+			EnvVar: "MACHINE_SYNC_FILE_MODE",
+			Value:  "",
+			Usage:  "octal mode to set on all uploaded files (e.g. 0644); cannot be used with --preserve-mode",
+		},
+		cli.BoolFlag{
+			Name:   "enforce-modes",
+			EnvVar: "MACHINE_SYNC_ENFORCE_MODES",
+			Usage:  "at startup, fix the mode of files on the machine that differ from --preserve-mode or --file-mode even when their content is unchanged",
 		},
 		cli.StringFlag{
-			Name:  "machine, m",
-			Value: "",
-			Usage: "name of docker machine to sync",
+			Name:   "owner-map",
+			EnvVar: "MACHINE_SYNC_OWNER_MAP",
+			Value:  "",
+			Usage:  "file of pattern owner[:group] lines setting the owner of uploaded paths on the machine",
+		},
+		cli.IntFlag{
+			Name:   "uid-offset",
+			EnvVar: "MACHINE_SYNC_UID_OFFSET",
+			Value:  0,
+			Usage:  "add this to owner ids from --owner-map, for containers in a user namespace (e.g. 100000 when container root is uid 100000 on the machine)",
+		},
+		cli.IntFlag{
+			Name:   "gid-offset",
+			EnvVar: "MACHINE_SYNC_GID_OFFSET",
+			Value:  0,
+			Usage:  "add this to group ids from --owner-map, for containers in a user namespace",
+		},
+		cli.BoolFlag{
+			Name:   "preserve-xattrs",
+			EnvVar: "MACHINE_SYNC_PRESERVE_XATTRS",
+			Usage:  "copy extended attributes to the machine (linux only, requires setfattr on the machine)",
+		},
+		cli.StringSliceFlag{
+			Name:   "transform",
+			EnvVar: "MACHINE_SYNC_TRANSFORM",
+			Usage:  "command that reads a file's content on stdin and writes what to upload instead, with the path in MACHINE_SYNC_PATH; runs before --normalize-eol and compression and may be repeated",
+		},
+		cli.BoolFlag{
+			Name:   "normalize-eol",
+			EnvVar: "MACHINE_SYNC_NORMALIZE_EOL",
+			Usage:  "convert line endings of text files matching --eol-pattern",
 		},
 		cli.StringFlag{
-			Name:  "machine-path, c",
-			Value: filepath.Join(os.Getenv("HOME"), ".docker", "machines"),
-			Usage: "path to docker machine config directory",
+			Name:   "eol",
+			EnvVar: "MACHINE_SYNC_EOL",
+			Value:  "lf",
+			Usage:  "line ending to convert to with --normalize-eol (lf or crlf)",
+		},
+		cli.StringSliceFlag{
+			Name:   "eol-pattern",
+			EnvVar: "MACHINE_SYNC_EOL_PATTERN",
+			Usage:  "file name pattern to normalize line endings for (default: " + strings.Join(defaultEOLPatterns, ", ") + ")",
+		},
+		cli.StringSliceFlag{
+			Name:   "text-ext",
+			EnvVar: "MACHINE_SYNC_TEXT_EXT",
+			Usage:  "extension to always treat as text instead of sampling the content (e.g. .dat)",
+		},
+		cli.StringSliceFlag{
+			Name:   "binary-ext",
+			EnvVar: "MACHINE_SYNC_BINARY_EXT",
+			Usage:  "extension to always treat as binary instead of sampling the content",
 		},
 		cli.StringFlag{
-			Name:  "destination, p",
-			Value: "",
-			Usage: "path on destination machine to sync",
+			Name:   "events-out",
+			EnvVar: "MACHINE_SYNC_EVENTS_OUT",
+			Value:  "",
+			Usage:  "file, unix:path or tcp:host:port to write a json line for every sync action and connection change to",
+		},
+		cli.BoolFlag{
+			Name:   "tui",
+			EnvVar: "MACHINE_SYNC_TUI",
+			Usage:  "show a live view of the sync instead of logs when stdout is a terminal",
+		},
+		cli.BoolFlag{
+			Name:   "daemon",
+			EnvVar: "MACHINE_SYNC_DAEMON",
+			Usage:  "detach and run in the background",
 		},
 		cli.StringFlag{
-			Name:  "user, u",
-			Value: "root",
-			Usage: "user on machine to use for connection",
+			Name:   "pidfile",
+			EnvVar: "MACHINE_SYNC_PIDFILE",
+			Value:  "",
+			Usage:  "path to write the process id to",
+		},
+		cli.StringFlag{
+			Name:   "log-file",
+			EnvVar: "MACHINE_SYNC_LOG_FILE",
+			Value:  "",
+			Usage:  "path to write logs to (defaults to a file in the temp directory with --daemon)",
 		},
 		cli.BoolFlag{
-			Name:  "debug, D",
-			Usage: "enable debug logging",
+			Name:   "log-skips",
+			EnvVar: "MACHINE_SYNC_LOG_SKIPS",
+			Usage:  "log every path that isn't synced and why",
+		},
+		cli.BoolFlag{
+			Name:   "verbose-transfers",
+			EnvVar: "MACHINE_SYNC_VERBOSE_TRANSFERS",
+			Usage:  "log every sftp operation with its duration and a latency summary on exit",
+		},
+		cli.StringFlag{
+			Name:   "pprof-addr",
+			EnvVar: "MACHINE_SYNC_PPROF_ADDR",
+			Value:  "",
+			Usage:  "address to serve net/http/pprof on (e.g. 127.0.0.1:6060)",
+		},
+		cli.StringFlag{
+			Name:   "cpuprofile",
+			EnvVar: "MACHINE_SYNC_CPUPROFILE",
+			Value:  "",
+			Usage:  "write a cpu profile to this file on exit",
+		},
+		cli.StringFlag{
+			Name:   "memprofile",
+			EnvVar: "MACHINE_SYNC_MEMPROFILE",
+			Value:  "",
+			Usage:  "write a heap profile to this file on exit",
+		},
+		cli.BoolFlag{
+			Name:   "debug, D",
+			EnvVar: "MACHINE_SYNC_DEBUG",
+			Usage:  "enable debug logging",
+		},
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:        "sync",
+			Usage:       "sync the directory to the machine once and exit",
+			Description: exitCodeUsage,
+			Action:      syncOnce,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "since",
+					Value: "",
+					Usage: "only sync files modified after a time (e.g. 2006-01-02 15:04) or a duration ago (e.g. 1h)",
+				},
+			},
+		},
+		{
+			Name:        "verify",
+			Usage:       "check the files on the machine match the directory and exit",
+			Description: exitCodeUsage,
+			Action:      verifyOnce,
+		},
+		{
+			Name:   "setup-key",
+			Usage:  "generate a key for the machine if needed and install it in the user's authorized_keys, logging in with a password",
+			Action: setupKey,
+		},
+		{
+			Name:      "completion",
+			Usage:     "print a shell completion script, e.g. eval \"$(machine-sync completion bash)\"",
+			ArgsUsage: "bash|zsh|fish",
+			Action:    completion,
+		},
+		{
+			Name:      "decrypt",
+			Usage:     "decrypt .enc files copied back from the machine next to them",
+			ArgsUsage: "FILE...",
+			Action:    decryptFiles,
+		},
+		{
+			Name:   "serve",
+			Usage:  "keep the connection to the machine open and run sync and verify requests sent with the request command",
+			Action: serve,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Value: "",
+					Usage: "unix:path or tcp:host:port to listen on (defaults to a socket named after the machine in a private directory of the temp directory)",
+				},
+				cli.StringFlag{
+					Name:   "token",
+					EnvVar: "MACHINE_SYNC_SERVE_TOKEN",
+					Usage:  "token requests must send; required when listening on tcp",
+				},
+			},
+		},
+		{
+			Name:        "request",
+			Usage:       "send a sync or verify to a running serve command and exit with its result",
+			Description: exitCodeUsage,
+			Action:      request,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "socket",
+					Value: "",
+					Usage: "unix:path or tcp:host:port the serve command listens on",
+				},
+				cli.StringFlag{
+					Name:   "token",
+					EnvVar: "MACHINE_SYNC_SERVE_TOKEN",
+					Usage:  "token the serve command was started with",
+				},
+				cli.StringFlag{
+					Name:  "since",
+					Value: "",
+					Usage: "only sync files modified after a time or a duration ago",
+				},
+			},
+		},
+		{
+			Name:   "stop",
+			Usage:  "stop a daemon started with --daemon using its pidfile",
+			Action: stopDaemon,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "pidfile",
+					Value: "",
+					Usage: "pidfile of the daemon to stop",
+				},
+			},
 		},
 	}
 
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	// every transfer is logged at info
+	log.SetLevel(log.WarnLevel)
+
+	os.Exit(m.Run())
+}
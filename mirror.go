@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// mirrorMode keeps the destination an exact copy of the directory: an
+// initial sync, deleting anything on the machine that doesn't exist
+// locally, then watching.  Excluded paths are left alone.
+var mirrorMode bool
+
+// localPathFor maps a path below root, the synced tree on the machine,
+// back to the local path it is synced from.  srcPath may be absolute or
+// outside the working directory, so the path is taken relative to root
+// rather than to destPath.
+func localPathFor(root, filePath string) string {
+	if encryptionKey != nil {
+		filePath = strings.TrimSuffix(filePath, encryptedExt)
+	}
+	return filepath.Join(srcPath, filepath.FromSlash(strings.TrimPrefix(filePath, root+"/")))
+}
+
+// extraRemotePaths returns the paths below the synced tree on the machine
+// that no longer exist locally.  A directory is returned without its
+// contents.
+func extraRemotePaths() ([]string, error) {
+	root := path.Clean(remotePath(srcPath))
+
+	extra := []string{}
+	walker := rsftp.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if isNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		p := walker.Path()
+		if p == root {
+			continue
+		}
+
+		fi := walker.Stat()
+		if destMarkers.owns(p) {
+			if fi.IsDir() {
+				walker.SkipDir()
+			}
+			continue
+		}
+		local := localPathFor(root, p)
+		if isExcluded(local, fi.IsDir()) {
+			if fi.IsDir() {
+				walker.SkipDir()
+			}
+			continue
+		}
+
+		if _, err := os.Lstat(local); !os.IsNotExist(err) {
+			continue
+		}
+
+		extra = append(extra, p)
+		if fi.IsDir() {
+			walker.SkipDir()
+		}
+	}
+
+	return extra, nil
+}
+
+// removeRemoteTree deletes filePath and, for a directory, everything in it.
+func removeRemoteTree(filePath string) error {
+	fi, err := rsftp.Lstat(filePath)
+	if err != nil {
+		if isNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if fi.IsDir() {
+		entries, err := rsftp.ReadDir(filePath)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := removeRemoteTree(path.Join(filePath, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return removeFile(filePath)
+}
+
+// reconcileMirror deletes what exists on the machine but not locally.
+// Nothing is deleted without --yes.
+func reconcileMirror() error {
+	// a single file is its own mirror
+	if singleFile != "" {
+		return nil
+	}
+
+	extra, err := extraRemotePaths()
+	if err != nil {
+		return err
+	}
+	if len(extra) == 0 {
+		return nil
+	}
+
+	if !assumeYes {
+		for _, p := range extra {
+			log.Warnf("would delete %s", p)
+		}
+		return fmt.Errorf("--mirror would delete %d paths on %s that don't exist locally; use --yes to allow it", len(extra), machineName)
+	}
+
+	for _, p := range extra {
+		log.Infof("deleting %s", p)
+		if err := removeRemoteTree(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
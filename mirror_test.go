@@ -0,0 +1,147 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mirrorTest syncs a small tree to the test server from the directory src
+// returns, given the test tree, then leaves extra files on the machine
+// next to the synced ones.  It returns the synced tree on the machine and
+// a cleanup function.
+func mirrorTest(t *testing.T, src func(dir string) string) (string, func()) {
+	s := startTestServer(t)
+	dest, cleanup := testTree(t)
+	connectTestServer(t, s)
+
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcPath = src(dir)
+
+	writeTestFile(t, filepath.Join("src", "a"), []byte("a"))
+	writeTestFile(t, filepath.Join("src", "sub", "b"), []byte("b"))
+	if err := initialSync(); err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(dest, srcPath)
+	if _, err := os.Stat(filepath.Join(root, "a")); err != nil {
+		t.Fatalf("the tree wasn't synced to %s: %s", root, err)
+	}
+	writeTestFile(t, filepath.Join(root, "gone"), []byte("gone"))
+	writeTestFile(t, filepath.Join(root, "sub", "gone", "c"), []byte("c"))
+
+	return root, func() {
+		cleanup()
+		s.kill()
+	}
+}
+
+func relativeSrc(string) string {
+	return "src"
+}
+
+// checkMirror fails the test unless the paths in kept are on the machine
+// and the paths in deleted aren't.
+func checkMirror(t *testing.T, root string, kept, deleted []string) {
+	for _, p := range kept {
+		if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(p))); err != nil {
+			t.Errorf("%s was deleted from the machine", p)
+		}
+	}
+	for _, p := range deleted {
+		if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(p))); !os.IsNotExist(err) {
+			t.Errorf("%s is still on the machine", p)
+		}
+	}
+}
+
+func TestMirrorDeletesExtraPaths(t *testing.T) {
+	defer func(yes bool) { assumeYes = yes }(assumeYes)
+	assumeYes = true
+
+	tests := []struct {
+		name string
+		src  func(dir string) string
+	}{
+		{"relative", relativeSrc},
+		{"absolute", func(dir string) string {
+			return filepath.Join(dir, "src")
+		}},
+		{"outside the working directory", func(dir string) string {
+			return filepath.Join("..", filepath.Base(dir), "src")
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root, cleanup := mirrorTest(t, test.src)
+			defer cleanup()
+
+			if err := reconcileMirror(); err != nil {
+				t.Fatal(err)
+			}
+			checkMirror(t, root, []string{"a", "sub/b"}, []string{"gone", "sub/gone"})
+		})
+	}
+}
+
+func TestMirrorKeepsExcludedPaths(t *testing.T) {
+	defer func(yes bool) { assumeYes = yes }(assumeYes)
+	assumeYes = true
+
+	root, cleanup := mirrorTest(t, relativeSrc)
+	defer cleanup()
+	writeTestFile(t, filepath.Join(root, "debug.log"), nil)
+	writeTestFile(t, filepath.Join(root, "cache", "data"), nil)
+
+	defer func(rules []filterRule) { filterRules = rules }(filterRules)
+	var err error
+	if filterRules, err = parseFilterRules([]string{"- *.log", "- cache/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reconcileMirror(); err != nil {
+		t.Fatal(err)
+	}
+	checkMirror(t, root, []string{"a", "debug.log", "cache/data"}, []string{"gone", "sub/gone"})
+}
+
+// TestMirrorKeepsMarkerPaths routes a subtree into the synced tree with a
+// destination marker; what is there belongs to the marker's directory.
+func TestMirrorKeepsMarkerPaths(t *testing.T) {
+	defer func(yes bool) { assumeYes = yes }(assumeYes)
+	assumeYes = true
+
+	root, cleanup := mirrorTest(t, relativeSrc)
+	defer cleanup()
+
+	defer func(m *markerIndex) { destMarkers = m }(destMarkers)
+	destMarkers = &markerIndex{dests: map[string]string{}}
+	writeTestFile(t, filepath.Join("src", "web", destMarkerName), []byte("src/public\n"))
+	if err := destMarkers.loadTree(srcPath); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(root, "public", "index.html"), nil)
+
+	if err := reconcileMirror(); err != nil {
+		t.Fatal(err)
+	}
+	checkMirror(t, root, []string{"a", "public/index.html"}, []string{"gone", "sub/gone"})
+}
+
+func TestMirrorRefusesWithoutYes(t *testing.T) {
+	defer func(yes bool) { assumeYes = yes }(assumeYes)
+	assumeYes = false
+
+	root, cleanup := mirrorTest(t, relativeSrc)
+	defer cleanup()
+
+	if err := reconcileMirror(); err == nil {
+		t.Fatal("deleting without --yes succeeded")
+	}
+	checkMirror(t, root, []string{"a", "sub/b", "gone", "sub/gone/c"}, nil)
+}
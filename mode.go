@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	preserveMode bool
+	fileMode     os.FileMode
+	// enforceModes checks the mode of every synced file on the machine at
+	// startup and fixes any that drifted, even if the content didn't.
+	enforceModes bool
+)
+
+func parseFileMode(v string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(v, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return os.FileMode(m).Perm(), nil
+}
+
+// desiredMode returns the mode localPath should have on the machine.  With
+// --preserve-mode the local mode is used, otherwise --file-mode if it was
+// given.  If neither is set it is 0 and the machine's default is left
+// alone.
+func desiredMode(localPath string) (os.FileMode, error) {
+	if !preserveMode {
+		return fileMode, nil
+	}
+
+	fi, err := os.Stat(localPath)
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Mode().Perm(), nil
+}
+
+// applyMode sets the mode of filePath on the machine.
+func applyMode(localPath, filePath string) error {
+	mode, err := desiredMode(localPath)
+	if err != nil || mode == 0 {
+		return err
+	}
+
+	return chmodRemote(filePath, mode)
+}
+
+func chmodRemote(filePath string, mode os.FileMode) error {
+	defer remoteStats.invalidate(filePath)
+
+	return timeOp("chmod", filePath, func() error {
+		err := rsftp.Chmod(filePath, mode)
+		if canBecome(err) {
+			return becomeRun(fmt.Sprintf("chmod %o -- %s", mode, shellQuote(filePath)), nil)
+		}
+		return err
+	})
+}
+
+// repairModes fixes the mode of each file in paths that differs on the
+// machine.  Files missing there are left to the sync.
+func repairModes(paths []string) error {
+	if !preserveMode && fileMode == 0 {
+		return nil
+	}
+
+	fixed := 0
+	for _, p := range paths {
+		fi, err := os.Lstat(p)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+
+		mode, err := desiredMode(p)
+		if err != nil {
+			return err
+		}
+
+		filePath := remotePath(p)
+		if encryptionKey != nil {
+			filePath += encryptedExt
+		}
+		rfi, err := remoteStats.stat(filePath)
+		if err != nil {
+			if isNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if rfi.Mode().Perm() == mode {
+			continue
+		}
+
+		log.Infof("fixing mode of %s: %o to %o", filePath, rfi.Mode().Perm(), mode)
+		if err := chmodRemote(filePath, mode); err != nil {
+			return err
+		}
+		fixed++
+	}
+	log.Debugf("fixed the mode of %d files", fixed)
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestParseFileMode(t *testing.T) {
+	tests := []struct {
+		v     string
+		want  os.FileMode
+		valid bool
+	}{
+		{"0644", 0644, true},
+		{"755", 0755, true},
+		{"4755", 0755, true},
+		{"0999", 0, false},
+		{"rw-r--r--", 0, false},
+	}
+
+	for _, test := range tests {
+		got, err := parseFileMode(test.v)
+		if (err == nil) != test.valid {
+			t.Errorf("parseFileMode(%q): unexpected error %v", test.v, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseFileMode(%q) = %o, want %o", test.v, got, test.want)
+		}
+	}
+}
+
+// TestUploadModes uploads a file with --preserve-mode and with --file-mode
+// and checks the mode each leaves on the machine.
+func TestUploadModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("local modes are not kept on windows")
+	}
+
+	s := startTestServer(t)
+	defer s.kill()
+	dest, cleanup := testTree(t)
+	defer cleanup()
+	connectTestServer(t, s)
+
+	defer func(preserve bool, mode os.FileMode) {
+		preserveMode, fileMode = preserve, mode
+	}(preserveMode, fileMode)
+
+	local := filepath.Join("src", "run.sh")
+	writeTestFile(t, local, []byte("#!/bin/sh\n"))
+	if err := os.Mkdir(filepath.Join(dest, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(local, 0751); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		preserve bool
+		mode     os.FileMode
+		want     os.FileMode
+	}{
+		{"preserve-mode", true, 0, 0751},
+		{"file-mode", false, 0640, 0640},
+	}
+
+	for _, test := range tests {
+		preserveMode, fileMode = test.preserve, test.mode
+		if err := uploadFile(local, remotePath(local)); err != nil {
+			t.Fatal(err)
+		}
+
+		fi, err := os.Stat(filepath.Join(dest, local))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.Mode().Perm(); got != test.want {
+			t.Errorf("%s: mode on the machine is %o, want %o", test.name, got, test.want)
+		}
+	}
+}
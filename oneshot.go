@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+// Exit codes of the one-shot sync and verify commands.
+const (
+	exitOK       = 0
+	exitFlags    = 1
+	exitConnect  = 2
+	exitTransfer = 3
+	exitVerify   = 4
+	// exitMaxRuntime is the exit code of watching when it stops at
+	// --max-runtime.
+	exitMaxRuntime = 5
+)
+
+const exitCodeUsage = `Exit codes:
+   0  success
+   1  invalid flags or configuration
+   2  unable to connect to the machine, or the connection was lost
+   3  one or more files failed to transfer
+   4  files on the machine do not match the directory`
+
+// syncOnce uploads the directory and exits with a code for the class of
+// failure, if any.
+func syncOnce(c *cli.Context) {
+	if v := c.String("since"); v != "" {
+		since, err := parseSince(v)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(exitFlags)
+		}
+		syncSince = since
+	}
+	setupOnce(c)
+
+	summary, err := runSync()
+	fmt.Fprintln(os.Stderr, summary)
+	exitOnce(err)
+}
+
+// runSync uploads the directory and returns a summary of what was done.
+func runSync() (string, error) {
+	start := time.Now()
+	before := syncStats.snapshot()
+
+	err := ensureDestPath()
+	if err == nil {
+		err = initialSync()
+	}
+	if err == nil {
+		err = updateRemoteSymlink()
+	}
+
+	stats := syncStats.snapshot()
+	return fmt.Sprintf("synced %d files (%s) with %d errors in %s", stats.Files-before.Files, formatBytes(stats.Bytes-before.Bytes), stats.Errors-before.Errors, time.Since(start)), err
+}
+
+// verifyOnce checks every file under the directory against the machine.
+func verifyOnce(c *cli.Context) {
+	setupOnce(c)
+
+	summary, err := runVerify()
+	if summary != "" {
+		fmt.Fprintln(os.Stderr, summary)
+	}
+	exitOnce(err)
+}
+
+// runVerify checks every file under the directory against the machine and
+// returns a summary of the result.
+func runVerify() (string, error) {
+	paths := []string{}
+	err := walkTree(srcPath, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if isExcluded(p, fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		paths = append(paths, p)
+		return nil
+	})
+	if err == nil {
+		err = verifyPaths(paths)
+	}
+
+	if e, ok := err.(*verifyError); ok {
+		return fmt.Sprintf("%d of %d paths differ on the machine", len(e.paths), len(paths)), err
+	} else if err == nil {
+		return fmt.Sprintf("verified %d paths", len(paths)), nil
+	}
+
+	return "", err
+}
+
+// setupOnce configures and connects for a one-shot command, exiting on
+// failure.
+func setupOnce(c *cli.Context) {
+	if err := checkFlags(c); err != nil {
+		os.Exit(exitFlags)
+	}
+
+	if err := configure(c); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(exitFlags)
+	}
+
+	if err := connect(c); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to connect to %s: %s\n", machineName, err)
+		os.Exit(exitConnect)
+	}
+}
+
+func exitOnce(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+	}
+	os.Exit(exitCode(err))
+}
+
+// exitCode returns the exit code for the result of a sync or verify.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case isConnectionLost(err):
+		return exitConnect
+	case isVerifyError(err):
+		return exitVerify
+	default:
+		return exitTransfer
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	verboseTransfers bool
+	opStats          = &opHistogram{ops: map[string]*opBuckets{}}
+	// opBucketBounds are the upper bounds of the latency histogram
+	// buckets; anything slower goes in a final bucket.
+	opBucketBounds = []time.Duration{
+		time.Millisecond,
+		10 * time.Millisecond,
+		100 * time.Millisecond,
+		time.Second,
+	}
+)
+
+type opBuckets struct {
+	count  int
+	total  time.Duration
+	counts []int
+}
+
+// opHistogram aggregates sftp operation latencies by operation type.
+type opHistogram struct {
+	mu  sync.Mutex
+	ops map[string]*opBuckets
+}
+
+func (h *opHistogram) add(op string, d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	b, ok := h.ops[op]
+	if !ok {
+		b = &opBuckets{counts: make([]int, len(opBucketBounds)+1)}
+		h.ops[op] = b
+	}
+
+	b.count++
+	b.total += d
+
+	i := sort.Search(len(opBucketBounds), func(i int) bool {
+		return d < opBucketBounds[i]
+	})
+	b.counts[i]++
+}
+
+// logSummary logs the histogram for each operation type.
+func (h *opHistogram) logSummary() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ops := []string{}
+	for op := range h.ops {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	for _, op := range ops {
+		b := h.ops[op]
+		buckets := []string{}
+		for i, n := range b.counts {
+			if i < len(opBucketBounds) {
+				buckets = append(buckets, fmt.Sprintf("<%s:%d", opBucketBounds[i], n))
+			} else {
+				buckets = append(buckets, fmt.Sprintf(">=%s:%d", opBucketBounds[i-1], n))
+			}
+		}
+		log.Infof("sftp %s: count=%d avg=%s %s", op, b.count, b.total/time.Duration(b.count), strings.Join(buckets, " "))
+	}
+}
+
+// timeOp runs the sftp operation fn on p, logging and recording how long
+// it took when --verbose-transfers is set.
+func timeOp(op, p string, fn func() error) error {
+	if !verboseTransfers {
+		return fn()
+	}
+
+	start := time.Now()
+	err := fn()
+	d := time.Since(start)
+
+	opStats.add(op, d)
+	if err != nil {
+		log.Infof("sftp %s %s: %s (%s)", op, p, d, err)
+	} else {
+		log.Infof("sftp %s %s: %s", op, p, d)
+	}
+
+	return err
+}
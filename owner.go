@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/sftp"
+)
+
+// ownerRule sets the owner and/or group of the paths matching a pattern.
+// An empty owner or group leaves it unchanged.
+type ownerRule struct {
+	pattern string
+	rule    ignoreRule
+	owner   string
+	group   string
+	uid     int
+	gid     int
+}
+
+var (
+	ownerRules []*ownerRule
+	// uidOffset and gidOffset shift the ids from the owner map, for
+	// machines running containers in a user namespace where container uid
+	// 0 is host uid 100000 and so on.
+	uidOffset int
+	gidOffset int
+	// chownDenied is set once the machine refuses a chown so it isn't
+	// tried for every file.
+	chownDenied bool
+	chownMu     sync.Mutex
+)
+
+// loadOwnerMap reads an owner mapping file.  Each line is a pattern in
+// .gitignore syntax, matched against the path relative to the directory,
+// followed by owner, owner:group or :group.  Owners and groups can be
+// names or ids.  When several patterns match a path the longest one wins,
+// and of equally long ones the last:
+//
+//	/**          app:app
+//	logs/        :adm
+//	bin/*.sh     root
+func loadOwnerMap(p string) ([]*ownerRule, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules := []*ownerRule{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: must be a pattern followed by owner[:group]", p, n)
+		}
+
+		rule, ok, err := parseIgnoreRule(fields[0])
+		if err != nil || !ok {
+			return nil, fmt.Errorf("%s:%d: invalid pattern %s", p, n, fields[0])
+		}
+
+		owner, group := fields[1], ""
+		if i := strings.Index(owner, ":"); i != -1 {
+			owner, group = owner[:i], owner[i+1:]
+		}
+		if owner == "" && group == "" {
+			return nil, fmt.Errorf("%s:%d: missing owner or group", p, n)
+		}
+
+		rules = append(rules, &ownerRule{
+			pattern: fields[0],
+			rule:    rule,
+			owner:   owner,
+			group:   group,
+			uid:     -1,
+			gid:     -1,
+		})
+	}
+
+	return rules, scanner.Err()
+}
+
+// resolveOwners looks up the ids of owner and group names on the machine.
+func resolveOwners(rules []*ownerRule) error {
+	for _, r := range rules {
+		var err error
+		if r.owner != "" {
+			if r.uid, err = remoteID("id -u", r.owner); err != nil {
+				return fmt.Errorf("unknown owner %s on %s: %s", r.owner, machineName, err)
+			}
+		}
+		if r.group != "" {
+			if r.gid, err = remoteID("getent group", r.group); err != nil {
+				return fmt.Errorf("unknown group %s on %s: %s", r.group, machineName, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// remoteID returns name as a number, looking it up on the machine with
+// cmd when it isn't one already.  getent output is name:x:gid:members.
+func remoteID(cmd, name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	session, err := newSession()
+	if err != nil {
+		return -1, err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err := session.Run(cmd + " " + shellQuote(name)); err != nil {
+		return -1, fmt.Errorf("%s: %s", err, strip(stderr.String()))
+	}
+
+	out := strip(stdout.String())
+	if fields := strings.Split(out, ":"); len(fields) > 2 {
+		out = fields[2]
+	}
+
+	return strconv.Atoi(out)
+}
+
+// matchOwner returns the best matching rule for the local path.
+func matchOwner(localPath string, isDir bool) *ownerRule {
+	rel := relPath(localPath)
+
+	var best *ownerRule
+	for _, r := range ownerRules {
+		if r.rule.dirOnly && !isDir {
+			continue
+		}
+		if !r.rule.re.MatchString(rel) {
+			continue
+		}
+		if best == nil || len(r.pattern) >= len(best.pattern) {
+			best = r
+		}
+	}
+
+	return best
+}
+
+// applyOwner sets the owner and group of filePath from the owner map.
+func applyOwner(localPath, filePath string) {
+	if len(ownerRules) == 0 {
+		return
+	}
+
+	chownMu.Lock()
+	denied := chownDenied
+	chownMu.Unlock()
+	if denied {
+		return
+	}
+
+	r := matchOwner(localPath, isDir(localPath))
+	if r == nil {
+		return
+	}
+
+	// ids left unchanged are read from the machine so are already shifted
+	uid, gid := r.uid, r.gid
+	if uid != -1 {
+		uid += uidOffset
+	}
+	if gid != -1 {
+		gid += gidOffset
+	}
+	if uid == -1 || gid == -1 {
+		fi, err := remoteStats.stat(filePath)
+		if err != nil {
+			log.Warnf("unable to stat %s: %s", filePath, err)
+			return
+		}
+		if st, ok := fi.Sys().(*sftp.FileStat); ok {
+			if uid == -1 {
+				uid = int(st.UID)
+			}
+			if gid == -1 {
+				gid = int(st.GID)
+			}
+		}
+	}
+
+	defer remoteStats.invalidate(filePath)
+	if err := timeOp("chown", filePath, func() error {
+		return rsftp.Chown(filePath, uid, gid)
+	}); err != nil {
+		if isPermissionDenied(err) || isUnsupported(err) {
+			chownMu.Lock()
+			chownDenied = true
+			chownMu.Unlock()
+			if isUnsupported(err) {
+				log.Warnf("the sftp server on %s doesn't support changing owners; not applying the owner map", machineName)
+			} else {
+				log.Warnf("%s is not allowed to change owners on %s; not applying the owner map", machineUser, machineName)
+			}
+			return
+		}
+		log.Warnf("unable to set the owner of %s: %s", filePath, err)
+	}
+}
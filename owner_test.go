@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeOwnerMap(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "owner-map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+
+	return f.Name()
+}
+
+func TestLoadOwnerMapErrors(t *testing.T) {
+	for _, content := range []string{
+		"logs/\n",
+		"logs/ app extra\n",
+		"logs/ :\n",
+	} {
+		p := writeOwnerMap(t, content)
+		if _, err := loadOwnerMap(p); err == nil {
+			t.Errorf("loading %q succeeded", content)
+		}
+		os.Remove(p)
+	}
+}
+
+func TestOwnerMapPrecedence(t *testing.T) {
+	p := writeOwnerMap(t, `# owners by subtree
+/**          app:app
+logs/        :adm
+bin/*.sh     root
+*.sh         1000
+bin/run.sh   deploy
+/**          web
+`)
+	defer os.Remove(p)
+
+	rules, err := loadOwnerMap(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(rules []*ownerRule, src string) {
+		ownerRules, srcPath = rules, src
+	}(ownerRules, srcPath)
+	ownerRules, srcPath = rules, "src"
+
+	tests := []struct {
+		path  string
+		dir   bool
+		owner string
+		group string
+	}{
+		// of the equally long /** rules the last wins
+		{"index.html", false, "web", ""},
+		// a directory only rule doesn't match files
+		{"logs", true, "", "adm"},
+		{"logs", false, "web", ""},
+		// the longest matching pattern wins whatever the order
+		{"bin/start.sh", false, "root", ""},
+		{"bin/run.sh", false, "deploy", ""},
+		{"scripts/setup.sh", false, "1000", ""},
+	}
+
+	for _, test := range tests {
+		r := matchOwner(filepath.Join("src", filepath.FromSlash(test.path)), test.dir)
+		if r == nil {
+			t.Errorf("%s: no rule matched", test.path)
+			continue
+		}
+		if r.owner != test.owner || r.group != test.group {
+			t.Errorf("%s: matched %s %s:%s, want %s:%s", test.path, r.pattern, r.owner, r.group, test.owner, test.group)
+		}
+	}
+}
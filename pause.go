@@ -0,0 +1,155 @@
+package main
+
+import (
+	"os"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/howeyc/fsnotify"
+)
+
+var syncPause = &pauser{}
+
+// pauser holds back events while syncing is paused or closed by the gate
+// file.  Depending on the pause or gate mode held events are either queued
+// until syncing resumes or dropped.
+type pauser struct {
+	mu        sync.Mutex
+	paused    bool
+	queue     bool
+	gated     bool
+	gateQueue bool
+	held      []*fsnotify.FileEvent
+}
+
+// hold reports whether ev was held back because syncing is paused.
+func (p *pauser) hold(ev *fsnotify.FileEvent) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.paused && !p.gated {
+		return false
+	}
+
+	queue := p.queue
+	if !p.paused {
+		queue = p.gateQueue
+	}
+	if queue {
+		p.held = append(p.held, ev)
+	} else {
+		log.Debugf("paused; dropping event for %s", ev.Name)
+	}
+
+	return true
+}
+
+func (p *pauser) pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.paused {
+		log.Info("syncing paused")
+	}
+	p.paused = true
+}
+
+// resume unpauses syncing and returns the events queued while paused.
+func (p *pauser) resume() []*fsnotify.FileEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.gated {
+		if p.paused {
+			log.Info("syncing resumed; waiting for the gate file")
+		}
+		p.paused = false
+		return nil
+	}
+
+	if p.paused {
+		log.Infof("syncing resumed; %d queued events", len(p.held))
+	}
+	held := p.held
+	p.paused = false
+	p.held = nil
+
+	return held
+}
+
+// gate closes or opens the gate and returns the events queued while it was
+// closed once nothing else holds them back.
+func (p *pauser) gate(closed bool) []*fsnotify.FileEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if closed == p.gated {
+		return nil
+	}
+	p.gated = closed
+	if closed {
+		log.Info("gate closed; syncing paused")
+		return nil
+	}
+
+	if p.paused {
+		log.Info("gate open; syncing is still paused")
+		return nil
+	}
+	log.Infof("gate open; syncing resumed with %d queued events", len(p.held))
+	held := p.held
+	p.held = nil
+
+	return held
+}
+
+// state reports whether syncing is held back, for either reason, and how
+// many events are queued.
+func (p *pauser) state() (bool, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.paused || p.gated, len(p.held)
+}
+
+// isPaused reports whether syncing was paused, leaving out the gate.
+func (p *pauser) isPaused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.paused
+}
+
+func (p *pauser) isGated() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.gated
+}
+
+func pauseSync() {
+	syncPause.pause()
+}
+
+func resumeSync() {
+	for _, ev := range syncPause.resume() {
+		dispatch(ev)
+	}
+}
+
+// handlePauseSignals toggles pausing each time the process receives the
+// pause signal.
+func handlePauseSignals() {
+	sigs := make(chan os.Signal, 1)
+	notifyPauseSignal(sigs)
+
+	go func() {
+		for range sigs {
+			if syncPause.isPaused() {
+				resumeSync()
+			} else {
+				pauseSync()
+			}
+		}
+	}()
+}
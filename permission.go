@@ -0,0 +1,39 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/howeyc/fsnotify"
+)
+
+const (
+	// permissionRetryDelay gives time for the permissions on the machine
+	// to be fixed, such as by a chown, before trying again.
+	permissionRetryDelay = 5 * time.Second
+	permissionRetries    = 5
+)
+
+var (
+	// onPermissionDenied is what to do when the machine refuses a change:
+	// log, skip, fail or retry.
+	onPermissionDenied = "log"
+	permissionRequeues = &requeueCounter{counts: map[string]int{}}
+)
+
+// retryPermissionDenied schedules ev to be handled again after
+// permissionRetryDelay.  It returns false once the attempts are used up.
+func retryPermissionDenied(ev *fsnotify.FileEvent) bool {
+	n, ok := permissionRequeues.next(ev.Name, permissionRetries)
+	if !ok {
+		log.Warnf("permission still denied for %s after %d attempts", ev.Name, permissionRetries)
+		return false
+	}
+
+	log.Debugf("permission denied for %s; trying again in %s (%d/%d)", ev.Name, permissionRetryDelay, n, permissionRetries)
+	time.AfterFunc(permissionRetryDelay, func() {
+		dispatch(ev)
+	})
+
+	return true
+}
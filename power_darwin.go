@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// onBattery asks pmset which power source is in use.
+func onBattery() (bool, bool) {
+	out, err := exec.Command("pmset", "-g", "batt").Output()
+	if err != nil {
+		return false, false
+	}
+
+	return strings.Contains(string(out), "Battery Power"), true
+}
+
+// highLoad reports whether the one minute load average is high for the
+// number of cpus.
+func highLoad() (bool, bool) {
+	// prints "{ 1.23 1.10 0.98 }"
+	out, err := exec.Command("sysctl", "-n", "vm.loadavg").Output()
+	if err != nil {
+		return false, false
+	}
+
+	fields := strings.Fields(strings.Trim(strip(string(out)), "{}"))
+	if len(fields) == 0 {
+		return false, false
+	}
+
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return false, false
+	}
+
+	return load/float64(runtime.NumCPU()) > highLoadPerCPU, true
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// onBattery reports whether no mains power supply is online.  The second
+// value is false when there is no mains supply to check.
+func onBattery() (bool, bool) {
+	supplies, _ := filepath.Glob("/sys/class/power_supply/*")
+
+	found := false
+	for _, s := range supplies {
+		typ, err := ioutil.ReadFile(filepath.Join(s, "type"))
+		if err != nil || strip(string(typ)) != "Mains" {
+			continue
+		}
+		found = true
+
+		online, err := ioutil.ReadFile(filepath.Join(s, "online"))
+		if err == nil && strip(string(online)) == "1" {
+			return false, true
+		}
+	}
+
+	return found, found
+}
+
+// highLoad reports whether the one minute load average is high for the
+// number of cpus.
+func highLoad() (bool, bool) {
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return false, false
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return false, false
+	}
+
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return false, false
+	}
+
+	return load/float64(runtime.NumCPU()) > highLoadPerCPU, true
+}
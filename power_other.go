@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+// power and load detection are not implemented on this platform
+
+func onBattery() (bool, bool) {
+	return false, false
+}
+
+func highLoad() (bool, bool) {
+	return false, false
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/pprof"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+)
+
+// startProfiling starts whichever profiling was requested and returns a
+// function that writes out the profiles on shutdown.
+func startProfiling(c *cli.Context) func() {
+	if addr := c.GlobalString("pprof-addr"); addr != "" {
+		go func() {
+			log.Infof("serving pprof on http://%s/debug/pprof/", addr)
+			if err := http.ListenAndServe(addr, nil); err != nil {
+				log.Errorf("pprof server: %s", err)
+			}
+		}()
+	}
+
+	cpuProfile := c.GlobalString("cpuprofile")
+	if cpuProfile != "" {
+		f, err := os.Create(cpuProfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	memProfile := c.GlobalString("memprofile")
+
+	return func() {
+		if cpuProfile != "" {
+			pprof.StopCPUProfile()
+			log.Infof("wrote cpu profile to %s", cpuProfile)
+		}
+
+		if memProfile != "" {
+			f, err := os.Create(memProfile)
+			if err != nil {
+				log.Error(err)
+				return
+			}
+			defer f.Close()
+
+			runtime.GC()
+			if err := pprof.WriteHeapProfile(f); err != nil {
+				log.Error(err)
+				return
+			}
+			log.Infof("wrote heap profile to %s", memProfile)
+		}
+	}
+}
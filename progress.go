@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	progressInterval    = 200 * time.Millisecond
+	progressLogInterval = 10 * time.Second
+	progressWidth       = 30
+)
+
+var (
+	showProgress    bool
+	initialProgress *syncProgress
+)
+
+// syncProgress tracks the initial sync against the totals found by the
+// walk.  It draws a bar on a terminal and logs a line now and then
+// otherwise.
+type syncProgress struct {
+	mu         sync.Mutex
+	start      time.Time
+	totalFiles int
+	totalBytes int64
+	files      int
+	bytes      int64
+	tty        bool
+	done       chan struct{}
+	stopped    sync.WaitGroup
+}
+
+func startProgress(paths []string) *syncProgress {
+	p := &syncProgress{
+		start: time.Now(),
+		tty:   isTerminal(),
+		done:  make(chan struct{}),
+	}
+	for _, path := range paths {
+		if fi, err := os.Lstat(path); err == nil && fi.Mode().IsRegular() {
+			p.totalFiles++
+			p.totalBytes += fi.Size()
+		}
+	}
+
+	p.stopped.Add(1)
+	go p.run()
+
+	return p
+}
+
+// add counts a finished file of size bytes.
+func (p *syncProgress) add(size int64) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.files++
+	p.bytes += size
+}
+
+// stop draws the final state.
+func (p *syncProgress) stop() {
+	if p == nil {
+		return
+	}
+
+	close(p.done)
+	p.stopped.Wait()
+}
+
+func (p *syncProgress) run() {
+	defer p.stopped.Done()
+
+	interval := progressInterval
+	if !p.tty {
+		interval = progressLogInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.render()
+		case <-p.done:
+			p.render()
+			if p.tty {
+				fmt.Fprintln(os.Stdout)
+			}
+			return
+		}
+	}
+}
+
+func (p *syncProgress) render() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// bytes give a better estimate than files of mixed sizes
+	fraction := 1.0
+	switch {
+	case p.totalBytes > 0:
+		fraction = float64(p.bytes) / float64(p.totalBytes)
+	case p.totalFiles > 0:
+		fraction = float64(p.files) / float64(p.totalFiles)
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+
+	eta := "-"
+	if fraction > 0 {
+		elapsed := time.Since(p.start)
+		remaining := time.Duration(float64(elapsed)/fraction) - elapsed
+		eta = remaining.Truncate(time.Second).String()
+	}
+
+	line := fmt.Sprintf("%d/%d files  %s/%s  ETA %s", p.files, p.totalFiles, formatBytes(p.bytes), formatBytes(p.totalBytes), eta)
+	if !p.tty {
+		log.Infof("initial sync: %s", line)
+		return
+	}
+
+	filled := int(fraction * progressWidth)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressWidth-filled)
+	// \033[K clears whatever was left from a longer line
+	fmt.Fprintf(os.Stdout, "\r[%s] %s\033[K", bar, line)
+}
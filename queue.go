@@ -0,0 +1,114 @@
+package main
+
+import (
+	"hash/fnv"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/howeyc/fsnotify"
+)
+
+// queueSize is how many events each worker can have waiting before the
+// watcher blocks or, with spillEvents, events are spilled to disk.
+var queueSize = 64
+
+// eventQueues holds one queue per worker.  Events are assigned to a queue
+// by path so every event for a path is handled in the order it was
+// received by the same worker, while different paths are handled in
+// parallel.
+var eventQueues []chan *fsnotify.FileEvent
+
+func startWorkers(n int, errChan chan error) {
+	transferLimiter.setLimit(n)
+
+	eventQueues = make([]chan *fsnotify.FileEvent, n)
+	for i := range eventQueues {
+		q := make(chan *fsnotify.FileEvent, queueSize)
+		eventQueues[i] = q
+
+		go func() {
+			for ev := range q {
+				for handleQueued(ev, errChan) {
+				}
+			}
+		}()
+	}
+}
+
+// handleQueued handles ev for a worker and reports whether it has to be
+// handled again because the connection dropped.  The worker does that
+// once reconnected, before any later event for the path, so a removal
+// that failed can't undo a create that followed it.
+func handleQueued(ev *fsnotify.FileEvent, errChan chan error) bool {
+	throttleWait()
+	transferLimiter.acquire()
+	workerProgress.start()
+	lost := handleEvent(ev, errChan)
+	workerProgress.done()
+	// reconnecting waits for the transfer slots to be released
+	transferLimiter.release()
+
+	if lost == nil || !reconnects.recover(lost) {
+		return false
+	}
+	if ev.IsDelete() {
+		// created again while reconnecting; its own event uploads it
+		if _, err := os.Lstat(ev.Name); err == nil {
+			log.Debugf("%s exists again; not deleting it", ev.Name)
+			return false
+		}
+	}
+
+	return true
+}
+
+func dispatch(ev *fsnotify.FileEvent) {
+	if renames.hold(ev) {
+		return
+	}
+
+	dispatchRemoval(ev)
+}
+
+// dispatchRemoval queues ev once rename detection has let it through.
+func dispatchRemoval(ev *fsnotify.FileEvent) {
+	if deleteGuard.hold(ev) {
+		return
+	}
+
+	enqueue(ev)
+}
+
+// enqueue queues ev for its worker.
+func enqueue(ev *fsnotify.FileEvent) {
+	if batchDeletes && ev.IsDelete() {
+		deletes.add(ev)
+		return
+	}
+
+	q := queueFor(ev.Name)
+	if spill == nil {
+		q <- ev
+		return
+	}
+
+	// once events are spilled the rest follow them to keep the order
+	if spill.len() == 0 {
+		select {
+		case q <- ev:
+			return
+		default:
+		}
+	}
+	if err := spill.push(ev.Name); err != nil {
+		log.Errorf("unable to spill event for %s: %s", ev.Name, err)
+		q <- ev
+	}
+}
+
+func queueFor(p string) chan *fsnotify.FileEvent {
+	h := fnv.New32a()
+	h.Write([]byte(p))
+
+	return eventQueues[h.Sum32()%uint32(len(eventQueues))]
+}
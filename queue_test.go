@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/howeyc/fsnotify"
+)
+
+// startTestWorkers starts n workers handling dispatched events and returns
+// a function stopping them once their queues are drained.
+func startTestWorkers(t *testing.T, n int) func() {
+	errChan := make(chan error)
+	go func() {
+		for range errChan {
+		}
+	}()
+	startWorkers(n, errChan)
+
+	return func() {
+		waitForQueues(t)
+		// holding the limiter waits for the workers to be done with it
+		transferLimiter.hold()
+		defer transferLimiter.unhold()
+		for _, q := range eventQueues {
+			close(q)
+		}
+	}
+}
+
+// waitForQueues waits for every event dispatched so far to be handled.  A
+// file is queued behind them on each queue and waited for on the machine.
+func waitForQueues(t *testing.T) {
+	pending := map[string]bool{}
+	for i := 0; len(pending) < len(eventQueues); i++ {
+		p := filepath.Join("src", fmt.Sprintf(".queued-%d", i))
+		q := fmt.Sprint(queueFor(p))
+		if _, ok := pending[q]; ok {
+			continue
+		}
+		writeTestFile(t, p, nil)
+		pending[q] = true
+		dispatch(&fsnotify.FileEvent{Name: p})
+		defer func(p string) {
+			os.Remove(p)
+			os.Remove(filepath.Join(destPath, p))
+		}(p)
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for i := 0; ; i++ {
+		p := filepath.Join("src", fmt.Sprintf(".queued-%d", i))
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			return
+		}
+		for {
+			if _, err := os.Stat(filepath.Join(destPath, p)); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for queued events")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// watchEvents collects the events for dir while fn changes it.
+func watchEvents(t *testing.T, dir string, fn func()) []*fsnotify.FileEvent {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	if err := watcher.Watch(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	fn()
+
+	events := []*fsnotify.FileEvent{}
+	for {
+		select {
+		case ev := <-watcher.Event:
+			events = append(events, ev)
+		case err := <-watcher.Error:
+			t.Fatal(err)
+		case <-time.After(500 * time.Millisecond):
+			return events
+		}
+	}
+}
+
+// TestEventsForAPathInOrder replays creates and deletes of many files,
+// interleaved as they were received, and checks the machine ends up like
+// the directory.  Files that were deleted and created again are only
+// there if each file's events were handled in order.
+func TestEventsForAPathInOrder(t *testing.T) {
+	s := startTestServer(t)
+	defer s.kill()
+	dest, cleanup := testTree(t)
+	defer cleanup()
+	connectTestServer(t, s)
+	if err := os.Mkdir(filepath.Join(dest, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 40
+	name := func(i int) string {
+		return filepath.Join("src", fmt.Sprintf("f%d", i))
+	}
+	events := watchEvents(t, "src", func() {
+		for round := 0; round < 3; round++ {
+			for i := 0; i < n; i++ {
+				writeTestFile(t, name(i), []byte(fmt.Sprintf("%d %d", i, round)))
+				// odd files end up deleted, even ones recreated
+				if round < 2 || i%2 == 1 {
+					os.Remove(name(i))
+				}
+			}
+		}
+	})
+
+	stop := startTestWorkers(t, 4)
+	for _, ev := range events {
+		dispatch(ev)
+	}
+	stop()
+
+	for i := 0; i < n; i++ {
+		data, err := ioutil.ReadFile(filepath.Join(dest, name(i)))
+		switch {
+		case i%2 == 1 && err == nil:
+			t.Errorf("%s was deleted but is on the machine", name(i))
+		case i%2 == 0 && err != nil:
+			t.Errorf("%s was created again but is not on the machine", name(i))
+		case i%2 == 0 && string(data) != fmt.Sprintf("%d 2", i):
+			t.Errorf("%s has %q on the machine", name(i), data)
+		}
+	}
+}
+
+func TestSpillQueueOrder(t *testing.T) {
+	// built without newSpillQueue so nothing is fed to the workers
+	f, err := ioutil.TempFile("", "machine-sync-spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &spillQueue{f: f, ready: make(chan struct{}, 1)}
+	s.r = bufio.NewReader(io.NewSectionReader(f, 0, 1<<62))
+	defer s.close()
+
+	paths := []string{"a", "with\nnewline", "with \"quotes\"", "z"}
+	for round := 0; round < 2; round++ {
+		for _, p := range paths {
+			if err := s.push(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if s.len() != len(paths) {
+			t.Fatalf("%d spilled, want %d", s.len(), len(paths))
+		}
+		for _, want := range paths {
+			if p, ok := s.next(); !ok || p != want {
+				t.Fatalf("next = %q, %v; want %q", p, ok, want)
+			}
+		}
+		if _, ok := s.next(); ok {
+			t.Fatal("spill queue not empty")
+		}
+	}
+}
+
+// TestSpillBurst dispatches a burst of events far larger than the queues
+// while the machine is slow.  The watcher mustn't be held up and every
+// file must still be synced.
+func TestSpillBurst(t *testing.T) {
+	s := startTestServer(t)
+	defer s.kill()
+	dest, cleanup := testTree(t)
+	defer cleanup()
+	connectTestServer(t, s)
+
+	defer func(n int) { queueSize = n }(queueSize)
+	queueSize = 4
+
+	const n = 2000
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = filepath.Join("src", fmt.Sprintf("d%d", i%10), fmt.Sprintf("f%d", i))
+		writeTestFile(t, paths[i], []byte(fmt.Sprintf("file %d\n", i)))
+	}
+
+	stop := startTestWorkers(t, 2)
+	var err error
+	if spill, err = newSpillQueue(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		spill.close()
+		spill = nil
+	}()
+
+	s.setDelay(time.Millisecond)
+	start := time.Now()
+	for _, p := range paths {
+		dispatch(&fsnotify.FileEvent{Name: p})
+	}
+	if spill.len() == 0 {
+		t.Error("nothing was spilled")
+	}
+	dispatched := time.Since(start)
+	s.setDelay(0)
+
+	stop()
+	if handled := time.Since(start); dispatched > handled/2 {
+		t.Errorf("dispatching took %s of the %s handling took", dispatched, handled)
+	}
+	compareTrees(t, "src", dest)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/howeyc/fsnotify"
+	"github.com/pkg/sftp"
+)
+
+const (
+	reconnectBackoff    = time.Second
+	reconnectMaxBackoff = 30 * time.Second
+)
+
+var reconnects = &reconnector{}
+
+// reconnector connects to the machine again after the connection drops.
+// Transfers that fail because of the drop are retried once it is back
+// rather than lost.  Only one reconnect runs at a time; everything that
+// notices the drop waits for the same one.
+type reconnector struct {
+	mu     sync.Mutex
+	c      *cli.Context
+	active bool
+	done   chan struct{}
+}
+
+// enable turns on reconnecting with the flags in c.  Until then a dropped
+// connection is an error like any other.
+func (r *reconnector) enable(c *cli.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.c = c
+}
+
+// recover reconnects after the connection was lost with err, or waits for
+// the reconnect already running, and reports whether it is back.  It must
+// not be called by a worker holding a transfer slot, as reconnecting waits
+// for those to be released.
+func (r *reconnector) recover(err error) bool {
+	r.mu.Lock()
+	if r.c == nil {
+		r.mu.Unlock()
+		return false
+	}
+	if !r.active {
+		r.active = true
+		r.done = make(chan struct{})
+		go r.run(err)
+	}
+	done := r.done
+	r.mu.Unlock()
+
+	<-done
+
+	return true
+}
+
+// isEnabled reports whether a dropped connection is reconnected.
+func (r *reconnector) isEnabled() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.c != nil
+}
+
+// requeue dispatches the removal ev again once the connection is back.
+// Workers retry their own events before the path's later ones; this is for
+// removals failed outside of them, such as batched deletes.
+func (r *reconnector) requeue(ev *fsnotify.FileEvent, err error) bool {
+	if !r.isEnabled() {
+		return false
+	}
+
+	log.Warnf("connection to %s lost while syncing %s; retrying after reconnecting", machineName, ev.Name)
+	go func() {
+		r.recover(err)
+		// created again while reconnecting; its own event uploads it
+		if _, err := os.Lstat(ev.Name); err == nil {
+			log.Debugf("%s exists again; not deleting it", ev.Name)
+			return
+		}
+		dispatch(ev)
+	}()
+
+	return true
+}
+
+func (r *reconnector) run(cause error) {
+	connEvents.lost(connEvents.current(), cause)
+	rssh.Close()
+
+	delay := reconnectBackoff
+	for {
+		log.Infof("reconnecting to %s", machineName)
+		connEvents.reconnecting()
+		// transfers still running on the old connection fail and are
+		// requeued before the new one is used
+		transferLimiter.hold()
+		err := connect(r.c)
+		transferLimiter.unhold()
+		if err == nil {
+			break
+		}
+
+		log.Errorf("unable to reconnect to %s: %s; retrying in %s", machineName, err, delay)
+		connEvents.failed(err)
+		time.Sleep(delay)
+		if delay *= 2; delay > reconnectMaxBackoff {
+			delay = reconnectMaxBackoff
+		}
+	}
+
+	r.mu.Lock()
+	r.active = false
+	close(r.done)
+	r.mu.Unlock()
+}
+
+// isConnectionLost reports whether err was caused by the connection to the
+// machine dropping rather than by the operation itself.
+func isConnectionLost(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == sftp.ErrSSHFxConnectionLost || !connEvents.isUp() {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"connection lost", "use of closed network connection", "connection reset", "broken pipe"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+
+	return false
+}
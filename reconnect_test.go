@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+// machineContext writes a machine config for s and returns a context with
+// the flags connect needs.
+func machineContext(t *testing.T, s *testServer) *cli.Context {
+	dir, err := ioutil.TempDir("", "machines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(s.addr)
+	p, _ := strconv.Atoi(port)
+
+	writeTestFile(t, filepath.Join(dir, "test", "config.json"), []byte(fmt.Sprintf(
+		`{"DriverName": "test", "Driver": {"IPAddress": %q, "SSHPort": %d}}`, host, p)))
+	machineConfigPath, machineName, machineUser = dir, "test", "test"
+
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	// the server lets anyone in before a password is asked for
+	set.String("auth-methods", "password", "")
+
+	return cli.NewContext(nil, set, nil)
+}
+
+// connectReconnecting connects to s the way machine-sync does, with
+// reconnecting enabled, and returns a function undoing it.
+func connectReconnecting(t *testing.T, s *testServer, dest string) func() {
+	home := os.Getenv("HOME")
+	os.Setenv("HOME", filepath.Dir(dest))
+	yes := assumeYes
+	assumeYes = true
+
+	c := machineContext(t, s)
+	if err := connect(c); err != nil {
+		t.Fatal(err)
+	}
+	reconnects.enable(c)
+
+	return func() {
+		reconnects.enable(nil)
+		os.RemoveAll(machineConfigPath)
+		assumeYes = yes
+		os.Setenv("HOME", home)
+	}
+}
+
+// TestSyncSurvivesServerRestart kills the machine part way through an
+// initial sync and brings it back.  The sync must carry on once
+// reconnected and only send again what was in flight.
+func TestSyncSurvivesServerRestart(t *testing.T) {
+	requireExec(t)
+
+	s := startTestServer(t)
+	defer s.kill()
+	dest, cleanup := testTree(t)
+	defer cleanup()
+	defer connectReconnecting(t, s, dest)()
+
+	const n, size = 200, 64 * 1024
+	for i := 0; i < n; i++ {
+		writeTestFile(t, filepath.Join("src", fmt.Sprintf("f%03d", i)), randomData(int64(i), size))
+	}
+
+	defer func(n int) { initialConcurrency = n }(initialConcurrency)
+	initialConcurrency = 8
+	s.setDelay(2 * time.Millisecond)
+
+	sent := syncStats.snapshot().Bytes
+	done := make(chan error, 1)
+	go func() {
+		done <- initialSync()
+	}()
+
+	synced := func() int {
+		files, _ := ioutil.ReadDir(filepath.Join(dest, "src"))
+		return len(files)
+	}
+	for synced() < n/10 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.kill()
+	if synced() == n {
+		t.Fatal("the sync finished before the machine was killed")
+	}
+	time.Sleep(500 * time.Millisecond)
+	s.restore()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(60 * time.Second):
+		t.Fatal("timed out waiting for the sync to finish")
+	}
+
+	compareTrees(t, "src", dest)
+	if resent := syncStats.snapshot().Bytes - sent - n*size; resent > int64(initialConcurrency)*size {
+		t.Errorf("sent %d bytes again after reconnecting", resent)
+	}
+}
+
+// TestRetriedRemovalKeepsOrder deletes and recreates a file while the
+// machine is away.  The removal that failed must be retried before the
+// create, or the file is lost on the machine.
+func TestRetriedRemovalKeepsOrder(t *testing.T) {
+	requireExec(t)
+
+	s := startTestServer(t)
+	defer s.kill()
+	dest, cleanup := testTree(t)
+	defer cleanup()
+	defer connectReconnecting(t, s, dest)()
+
+	local := filepath.Join("src", "file")
+	writeTestFile(t, local, []byte("old"))
+	if err := initialSync(); err != nil {
+		t.Fatal(err)
+	}
+
+	events := watchEvents(t, "src", func() {
+		os.Remove(local)
+		writeTestFile(t, local, []byte("new"))
+	})
+
+	s.kill()
+	stop := startTestWorkers(t, 2)
+	for _, ev := range events {
+		dispatch(ev)
+	}
+	time.Sleep(500 * time.Millisecond)
+	s.restore()
+	stop()
+
+	got, err := ioutil.ReadFile(filepath.Join(dest, local))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "new" {
+		t.Errorf("file has %q on the machine, want %q", got, "new")
+	}
+}
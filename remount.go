@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/howeyc/fsnotify"
+)
+
+// remountPollInterval is how often the watched directory is checked for
+// having been remounted.
+const remountPollInterval = 2 * time.Second
+
+// followRemounts watches srcPath again when the filesystem mounted on it
+// changes, which leaves the existing watches on the old one.
+var followRemounts bool
+
+// watchRemounts polls srcPath and, when its device or inode changes,
+// registers the watches again and resyncs the tree.  It returns when done
+// is closed.
+func watchRemounts(w *fsnotify.Watcher, done chan bool) {
+	root, err := os.Stat(srcPath)
+	if err != nil {
+		log.Errorf("unable to follow remounts of %s: %s", srcPath, err)
+		return
+	}
+
+	ticker := time.NewTicker(remountPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(srcPath)
+		if err != nil {
+			// unmounted, or between unmount and mount
+			continue
+		}
+		if os.SameFile(root, fi) {
+			continue
+		}
+		root = fi
+
+		log.Warnf("%s was remounted; watching it again", srcPath)
+		if err := rewatch(w); err != nil {
+			log.Errorf("unable to watch %s after it was remounted: %s", srcPath, err)
+			continue
+		}
+		reconcileWatch()
+	}
+}
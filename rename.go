@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/howeyc/fsnotify"
+)
+
+// renameMaxPending is the most removals held for rename detection at once;
+// beyond that they are deleted straight away.
+const renameMaxPending = 1000
+
+var (
+	detectRenames bool
+	// renameMinSize is the smallest file worth matching; smaller ones
+	// cost less to upload again than to hash on the machine.
+	renameMinSize int64
+	renames       = &renameDetector{pending: map[string]*heldRemoval{}}
+)
+
+type heldRemoval struct {
+	ev    *fsnotify.FileEvent
+	timer *time.Timer
+}
+
+// renameDetector holds removals for renameWindow so that a file moved
+// locally, which the watcher reports as a removal and a create, can be
+// renamed on the machine instead of being uploaded again.
+type renameDetector struct {
+	mu      sync.Mutex
+	window  time.Duration
+	pending map[string]*heldRemoval
+}
+
+// hold reports whether the removal ev is held back.  It is dispatched once
+// the window passes unless a new file took its content first or the path
+// was created again.  Only files of at least renameMinSize are held.
+func (r *renameDetector) hold(ev *fsnotify.FileEvent) bool {
+	if !detectRenames || noDelete || encryptionKey != nil {
+		return false
+	}
+
+	// an editor saving by delete and create must not lose the new file
+	if !isRemoval(ev) {
+		if r.take(ev.Name) != nil {
+			logSkip(ev.Name, skipRecreated)
+		}
+		return false
+	}
+
+	fi, err := remoteStats.stat(remotePath(ev.Name))
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() < renameMinSize {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.pending[ev.Name]; ok {
+		return true
+	}
+	if len(r.pending) >= renameMaxPending {
+		return false
+	}
+
+	r.pending[ev.Name] = &heldRemoval{
+		ev: ev,
+		timer: time.AfterFunc(r.window, func() {
+			ev := r.take(ev.Name)
+			if ev == nil {
+				return
+			}
+			if _, err := os.Lstat(ev.Name); err == nil {
+				logSkip(ev.Name, skipRecreated)
+				return
+			}
+			dispatchRemoval(ev)
+		}),
+	}
+
+	return true
+}
+
+// take removes p from the held removals, returning its event if it was
+// still held.
+func (r *renameDetector) take(p string) *fsnotify.FileEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h, ok := r.pending[p]
+	if !ok {
+		return nil
+	}
+	h.timer.Stop()
+	delete(r.pending, p)
+
+	return h.ev
+}
+
+// move renames a removed file on the machine to filePath when it has the
+// same content as data, reporting whether it did.
+func (r *renameDetector) move(filePath string, data []byte) bool {
+	if !detectRenames || int64(len(data)) < renameMinSize || encryptionKey != nil {
+		return false
+	}
+
+	r.mu.Lock()
+	held := make([]string, 0, len(r.pending))
+	for p := range r.pending {
+		held = append(held, p)
+	}
+	r.mu.Unlock()
+
+	candidates := map[string]string{}
+	for _, p := range held {
+		remote := remotePath(p)
+		if remote == filePath {
+			continue
+		}
+		if fi, err := remoteStats.stat(remote); err == nil && fi.Mode().IsRegular() && fi.Size() == int64(len(data)) {
+			candidates[remote] = p
+		}
+	}
+
+	if len(candidates) == 0 {
+		return false
+	}
+
+	remotes := make([]string, 0, len(candidates))
+	for remote := range candidates {
+		remotes = append(remotes, remote)
+	}
+	hashes, err := remoteHashes(remotes)
+	if err != nil {
+		log.Debugf("rename detection for %s: %s", filePath, err)
+		return false
+	}
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	for remote, p := range candidates {
+		if hashes[remote] != hash {
+			continue
+		}
+		ev := r.take(p)
+		if ev == nil {
+			continue
+		}
+
+		if err := renameRemote(remote, filePath); err != nil {
+			log.Debugf("unable to rename %s to %s: %s", remote, filePath, err)
+			dispatchRemoval(ev)
+			return false
+		}
+		log.Infof("renamed %s to %s", remote, filePath)
+
+		return true
+	}
+
+	return false
+}
+
+// renameRemote moves oldPath to filePath on the machine, replacing
+// filePath when the server can do that atomically.
+func renameRemote(oldPath, filePath string) error {
+	defer remoteStats.invalidate(oldPath)
+	defer remoteStats.invalidate(filePath)
+
+	if err := remoteMkdirAll(path.Dir(filePath)); err != nil {
+		return err
+	}
+
+	return timeOp("rename", filePath, func() error {
+		if serverExtensions[extPosixRename] {
+			return rsftp.PosixRename(oldPath, filePath)
+		}
+		return rsftp.Rename(oldPath, filePath)
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// renameTest sets up rename detection with a large file already synced.
+func renameTest(t *testing.T, window time.Duration) (string, []byte, func()) {
+	s := startTestServer(t)
+	dest, cleanup := testTree(t)
+	connectTestServer(t, s)
+
+	detect, w, min := detectRenames, renames.window, renameMinSize
+	detectRenames, renames.window, renameMinSize = true, window, 1<<20
+
+	data := randomData(9, 8<<20)
+	local := filepath.Join("src", "large")
+	writeTestFile(t, local, data)
+	if err := uploadFile(local, remotePath(local)); err != nil {
+		t.Fatal(err)
+	}
+
+	return dest, data, func() {
+		detectRenames, renames.window, renameMinSize = detect, w, min
+		cleanup()
+		s.kill()
+	}
+}
+
+func TestRenameMovedFile(t *testing.T) {
+	dest, data, cleanup := renameTest(t, 5*time.Second)
+	defer cleanup()
+
+	oldPath := filepath.Join("src", "large")
+	newPath := filepath.Join("src", "moved")
+	events := watchEvents(t, "src", func() {
+		if err := os.Rename(oldPath, newPath); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	sent := syncStats.snapshot().Bytes
+	stop := startTestWorkers(t, 2)
+	for _, ev := range events {
+		dispatch(ev)
+	}
+	stop()
+
+	got, err := ioutil.ReadFile(filepath.Join(dest, newPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("moved file differs on the machine")
+	}
+	if _, err := os.Stat(filepath.Join(dest, oldPath)); !os.IsNotExist(err) {
+		t.Error("the old file is still on the machine")
+	}
+	if n := syncStats.snapshot().Bytes - sent; n >= int64(len(data)) {
+		t.Errorf("sent %d bytes moving the file", n)
+	}
+}
+
+func TestRenameWindowExpires(t *testing.T) {
+	dest, _, cleanup := renameTest(t, 100*time.Millisecond)
+	defer cleanup()
+
+	local := filepath.Join("src", "large")
+	events := watchEvents(t, "src", func() {
+		os.Remove(local)
+	})
+
+	stop := startTestWorkers(t, 2)
+	for _, ev := range events {
+		dispatch(ev)
+	}
+	// the removal is only queued once the window has passed
+	time.Sleep(500 * time.Millisecond)
+	stop()
+
+	if _, err := os.Stat(filepath.Join(dest, local)); !os.IsNotExist(err) {
+		t.Error("the removed file is still on the machine")
+	}
+}
+
+// TestRenameRecreated deletes a file and writes it again, as some editors
+// save, and checks the held removal doesn't delete the new file.
+func TestRenameRecreated(t *testing.T) {
+	dest, _, cleanup := renameTest(t, 100*time.Millisecond)
+	defer cleanup()
+
+	local := filepath.Join("src", "large")
+	data := randomData(10, 8<<20)
+	events := watchEvents(t, "src", func() {
+		os.Remove(local)
+		writeTestFile(t, local, data)
+	})
+
+	stop := startTestWorkers(t, 2)
+	for _, ev := range events {
+		dispatch(ev)
+	}
+	time.Sleep(500 * time.Millisecond)
+	stop()
+
+	got, err := ioutil.ReadFile(filepath.Join(dest, local))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("recreated file differs on the machine")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/howeyc/fsnotify"
+)
+
+// requeueDelay gives a file that is being written a moment to settle
+// before it is uploaded again.
+const requeueDelay = 500 * time.Millisecond
+
+var (
+	errFileChanged = errors.New("file changed while it was being read")
+	maxRequeues    int
+	requeues       = &requeueCounter{counts: map[string]int{}}
+)
+
+// requeueCounter bounds how many times a path is requeued so a file that
+// never stops changing can't keep a worker busy forever.
+type requeueCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (r *requeueCounter) next(p string, max int) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.counts[p] >= max {
+		delete(r.counts, p)
+		return max, false
+	}
+	r.counts[p]++
+
+	return r.counts[p], true
+}
+
+func (r *requeueCounter) reset(p string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.counts, p)
+}
+
+// requeue schedules ev to be handled again if p changed while being read.
+// It returns false once the attempts are used up.
+func requeue(ev *fsnotify.FileEvent) bool {
+	n, ok := requeues.next(ev.Name, maxRequeues)
+	if !ok {
+		log.Warnf("%s kept changing while being uploaded; giving up after %d attempts", ev.Name, maxRequeues)
+		return false
+	}
+
+	log.Debugf("%s changed while being uploaded; requeueing (%d/%d)", ev.Name, n, maxRequeues)
+	time.AfterFunc(requeueDelay, func() {
+		dispatch(ev)
+	})
+
+	return true
+}
+
+// fileChanged reports whether the file changed between the two stats.
+func fileChanged(before, after os.FileInfo) bool {
+	return before.Size() != after.Size() || !before.ModTime().Equal(after.ModTime())
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRequeueCounter(t *testing.T) {
+	r := &requeueCounter{counts: map[string]int{}}
+
+	for want := 1; want <= 3; want++ {
+		if n, ok := r.next("a", 3); !ok || n != want {
+			t.Fatalf("next = %d, %v; want %d, true", n, ok, want)
+		}
+	}
+	if n, ok := r.next("a", 3); ok || n != 3 {
+		t.Errorf("next after the limit = %d, %v; want 3, false", n, ok)
+	}
+	// giving up starts the count again
+	if n, ok := r.next("a", 3); !ok || n != 1 {
+		t.Errorf("next after giving up = %d, %v; want 1, true", n, ok)
+	}
+
+	// paths are counted apart and reset on success
+	if n, _ := r.next("b", 3); n != 1 {
+		t.Errorf("next for another path = %d, want 1", n)
+	}
+	r.reset("a")
+	if n, _ := r.next("a", 3); n != 1 {
+		t.Errorf("next after reset = %d, want 1", n)
+	}
+
+	if _, ok := r.next("c", 0); ok {
+		t.Error("requeued with no attempts allowed")
+	}
+}
+
+type fakeFileInfo struct {
+	os.FileInfo
+	size    int64
+	modTime time.Time
+}
+
+func (fi fakeFileInfo) Size() int64        { return fi.size }
+func (fi fakeFileInfo) ModTime() time.Time { return fi.modTime }
+
+func TestFileChanged(t *testing.T) {
+	now := time.Now()
+	before := fakeFileInfo{size: 10, modTime: now}
+
+	tests := []struct {
+		after   fakeFileInfo
+		changed bool
+	}{
+		{fakeFileInfo{size: 10, modTime: now}, false},
+		{fakeFileInfo{size: 11, modTime: now}, true},
+		{fakeFileInfo{size: 10, modTime: now.Add(time.Nanosecond)}, true},
+	}
+
+	for _, test := range tests {
+		if got := fileChanged(before, test.after); got != test.changed {
+			t.Errorf("fileChanged(%v, %v) = %v, want %v", before, test.after, got, test.changed)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/sftp"
+)
+
+// resumeMinSize is the smallest partial file worth resuming rather than
+// uploading again.
+const resumeMinSize = 1 << 20
+
+var resumeUploads bool
+
+// resumeUpload continues an upload of data to filePath that was cut off
+// part way.  When the file on the machine is a prefix of data only the
+// rest is written.  The result is verified and false is returned,
+// without an error, whenever the file has to be uploaded in full instead.
+func resumeUpload(filePath string, data []byte) (bool, error) {
+	fi, err := remoteStats.stat(filePath)
+	if err != nil || !fi.Mode().IsRegular() {
+		return false, nil
+	}
+	offset := fi.Size()
+	if offset < resumeMinSize || offset >= int64(len(data)) {
+		return false, nil
+	}
+
+	sum, err := remotePrefixSum(filePath, offset)
+	if err != nil {
+		log.Debugf("unable to resume %s: %s", filePath, err)
+		return false, nil
+	}
+	if local := sha256.Sum256(data[:offset]); sum != hex.EncodeToString(local[:]) {
+		return false, nil
+	}
+
+	defer remoteStats.invalidate(filePath)
+
+	var f *sftp.File
+	if err := timeOp("open", filePath, func() (err error) {
+		f, err = rsftp.OpenFile(filePath, os.O_WRONLY)
+		return err
+	}); err != nil {
+		return false, err
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return false, err
+	}
+	if err := timeOp("write", filePath, func() error {
+		return writeFull(&progressWriter{f}, data[offset:])
+	}); err != nil {
+		f.Close()
+		return true, err
+	}
+	if err := f.Truncate(int64(len(data))); err != nil {
+		f.Close()
+		return true, err
+	}
+	if err := timeOp("close", filePath, f.Close); err != nil {
+		return true, err
+	}
+	syncStats.addBytes(int64(len(data)) - offset)
+
+	sum256 := sha256.Sum256(data)
+	if err := verifyRemote(map[string]string{filePath: hex.EncodeToString(sum256[:])}); err != nil {
+		log.Warnf("resumed upload of %s doesn't match; uploading it again", filePath)
+		return false, nil
+	}
+	log.Debugf("resumed %s at %s of %s", filePath, formatBytes(offset), formatBytes(int64(len(data))))
+
+	return true, nil
+}
+
+// remotePrefixSum returns the sha256 of the first n bytes of filePath on
+// the machine.
+func remotePrefixSum(filePath string, n int64) (string, error) {
+	session, err := newSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err := session.Run(fmt.Sprintf("head -c %d %s | sha256sum", n, shellQuote(filePath))); err != nil {
+		return "", fmt.Errorf("%s: %s", err, strip(stderr.String()))
+	}
+
+	fields := strings.Fields(stdout.String())
+	if len(fields) == 0 {
+		return "", fmt.Errorf("no output from sha256sum")
+	}
+
+	return fields[0], nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/sftp"
+)
+
+const (
+	maxRetries   = 5
+	retryBackoff = 250 * time.Millisecond
+)
+
+// retry calls fn until it succeeds, returns an error that shouldRetry
+// rejects or maxRetries attempts have been made.  The delay between
+// attempts doubles each time to give the cause a chance to clear.
+func retry(fn func() error, shouldRetry func(error) bool) error {
+	delay := retryBackoff
+	var err error
+	for i := 0; i < maxRetries; i++ {
+		if err = fn(); err == nil || !shouldRetry(err) {
+			return err
+		}
+		log.Warnf("%s; retrying in %s", err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+
+	return err
+}
+
+// sftp status codes from draft-ietf-secsh-filexfer-02.
+const (
+	sshFxNoSuchFile       = 2
+	sshFxPermissionDenied = 3
+	sshFxFailure          = 4
+	sshFxOpUnsupported    = 8
+)
+
+// isTooManyOpenFiles reports whether err was caused by file descriptor
+// exhaustion either locally or on the machine.  Remote failures only carry
+// the server's message so those are matched on the text.
+func isTooManyOpenFiles(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	if err == syscall.EMFILE || err == syscall.ENFILE {
+		return true
+	}
+
+	return strings.Contains(strings.ToLower(err.Error()), "too many open files")
+}
+
+// isFileBusy reports whether err means the file is in use or locked on the
+// machine.  sftp has no status for this so the server's message is matched.
+func isFileBusy(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"busy", "locked", "resource temporarily unavailable"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isNotExist reports whether err means the path is already gone on the
+// machine.  Most servers send SSH_FX_NO_SUCH_FILE, which the client maps to
+// os.ErrNotExist, but some only send a failure status with a message.
+func isNotExist(err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+
+	if se, ok := err.(*sftp.StatusError); ok {
+		if se.Code == sshFxNoSuchFile {
+			return true
+		}
+		return se.Code == sshFxFailure && strings.Contains(strings.ToLower(se.Error()), "no such file")
+	}
+
+	return false
+}
+
+// isPermissionDenied reports whether the machine refused the operation
+// because the user lacks permission.
+func isPermissionDenied(err error) bool {
+	if os.IsPermission(err) {
+		return true
+	}
+
+	se, ok := err.(*sftp.StatusError)
+	return ok && se.Code == sshFxPermissionDenied
+}
+
+// isUnsupported reports whether the sftp server doesn't implement the
+// operation.
+func isUnsupported(err error) bool {
+	se, ok := err.(*sftp.StatusError)
+	return ok && se.Code == sshFxOpUnsupported
+}
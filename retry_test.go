@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func TestIsTooManyOpenFiles(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{syscall.EMFILE, true},
+		{syscall.ENFILE, true},
+		{&os.PathError{Op: "open", Path: "a", Err: syscall.EMFILE}, true},
+		{errors.New(`sftp: "Failure" (SSH_FX_FAILURE): Too many open files`), true},
+		{&os.PathError{Op: "open", Path: "a", Err: syscall.ENOENT}, false},
+		{errors.New("connection lost"), false},
+	}
+
+	for _, test := range tests {
+		if got := isTooManyOpenFiles(test.err); got != test.want {
+			t.Errorf("isTooManyOpenFiles(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestRetryUntilHandlesAreFree(t *testing.T) {
+	calls := 0
+	err := retry(func() error {
+		if calls++; calls < 3 {
+			return &os.PathError{Op: "open", Path: "a", Err: syscall.EMFILE}
+		}
+		return nil
+	}, isTooManyOpenFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("called %d times, want 3", calls)
+	}
+}
+
+func TestRetryStopsOnOtherErrors(t *testing.T) {
+	calls := 0
+	err := retry(func() error {
+		calls++
+		return syscall.ENOENT
+	}, isTooManyOpenFiles)
+	if err != syscall.ENOENT {
+		t.Errorf("got %v, want %v", err, syscall.ENOENT)
+	}
+	if calls != 1 {
+		t.Errorf("called %d times, want 1", calls)
+	}
+}
+
+func TestClassifyStatusErrors(t *testing.T) {
+	tests := []struct {
+		err              error
+		notExist, denied bool
+	}{
+		{os.ErrNotExist, true, false},
+		{&os.PathError{Op: "remove", Path: "a", Err: os.ErrNotExist}, true, false},
+		{&sftp.StatusError{Code: sshFxNoSuchFile}, true, false},
+		{os.ErrPermission, false, true},
+		{&sftp.StatusError{Code: sshFxPermissionDenied}, false, true},
+		{&sftp.StatusError{Code: sshFxFailure}, false, false},
+		{errors.New("i/o error"), false, false},
+	}
+
+	for _, test := range tests {
+		if got := isNotExist(test.err); got != test.notExist {
+			t.Errorf("isNotExist(%v) = %v, want %v", test.err, got, test.notExist)
+		}
+		if got := isPermissionDenied(test.err); got != test.denied {
+			t.Errorf("isPermissionDenied(%v) = %v, want %v", test.err, got, test.denied)
+		}
+	}
+}
+
+func TestRemoveFileIsIdempotent(t *testing.T) {
+	s := startTestServer(t)
+	defer s.kill()
+	dest, cleanup := testTree(t)
+	defer cleanup()
+	connectTestServer(t, s)
+
+	filePath := filepath.ToSlash(filepath.Join(dest, "file"))
+	writeTestFile(t, filePath, []byte("data"))
+
+	if err := removeFile(filePath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Errorf("%s was not removed", filePath)
+	}
+
+	// already gone
+	if err := removeFile(filePath); err != nil {
+		t.Errorf("removing a missing file: %s", err)
+	}
+
+	// a real failure is still reported
+	dir := filepath.ToSlash(filepath.Join(dest, "dir"))
+	writeTestFile(t, filepath.Join(dir, "file"), []byte("data"))
+	if err := removeFile(dir); err == nil {
+		t.Errorf("removing the non-empty directory %s succeeded", dir)
+	}
+}
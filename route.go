@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// extRoutes sends files with an extension to another tree on the machine
+// (--route).  The path below the directory is kept, so with conf:/etc/app
+// config/app.conf goes to /etc/app/config/app.conf.  Single file mode and
+// .machinesync-dest files take precedence, and --under doesn't apply.
+var extRoutes = map[string]string{}
+
+// parseRoutes reads --route ext:dest values.  The extension may be given
+// as conf, .conf or *.conf; dest must be absolute.
+func parseRoutes(routes []string) (map[string]string, error) {
+	parsed := map[string]string{}
+	for _, r := range routes {
+		i := strings.Index(r, ":")
+		if i == -1 {
+			return nil, fmt.Errorf("invalid route %s: must be ext:dest", r)
+		}
+
+		ext := strings.TrimPrefix(strings.TrimPrefix(r[:i], "*"), ".")
+		dest := path.Clean(r[i+1:])
+		if ext == "" || strings.ContainsAny(ext, "/\\*?[") {
+			return nil, fmt.Errorf("invalid route %s: %q is not an extension", r, r[:i])
+		}
+		if !path.IsAbs(dest) {
+			return nil, fmt.Errorf("invalid route %s: destination must be an absolute path", r)
+		}
+		if prev, ok := parsed["."+ext]; ok && prev != dest {
+			return nil, fmt.Errorf("extension .%s is routed to both %s and %s", ext, prev, dest)
+		}
+
+		parsed["."+ext] = dest
+	}
+
+	return parsed, nil
+}
+
+// routeByExt returns the remote path of localPath when its extension is
+// routed.
+func routeByExt(localPath string) (string, bool) {
+	dest, ok := extRoutes[filepath.Ext(localPath)]
+	if !ok {
+		return "", false
+	}
+
+	return path.Join(dest, filepath.ToSlash(localPath)), true
+}
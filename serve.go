@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+)
+
+// serveRequest is sent by the request command to a serving machine-sync as
+// a single line of json.  Command is sync or verify.
+type serveRequest struct {
+	Command string `json:"command"`
+	Since   string `json:"since,omitempty"`
+	Token   string `json:"token,omitempty"`
+}
+
+// serveResponse is the single line of json sent back when the request has
+// finished.  ExitCode matches the exit codes of the one-shot commands.
+type serveResponse struct {
+	ExitCode int    `json:"exit_code"`
+	Summary  string `json:"summary,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+var (
+	// serveMu runs one request at a time.
+	serveMu sync.Mutex
+	// serveToken must be sent with every request when set.  It is
+	// required on tcp, which any local user can connect to.
+	serveToken string
+)
+
+// serveAddr returns the address to serve on or connect to: unix:path,
+// tcp:host:port, or by default a socket for the machine in a directory of
+// the temp dir only the user can access.
+func serveAddr(addr string) (string, string) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		return "unix", strings.TrimPrefix(addr, "unix:")
+	case strings.HasPrefix(addr, "tcp:"):
+		return "tcp", strings.TrimPrefix(addr, "tcp:")
+	case addr != "":
+		return "unix", addr
+	default:
+		return "unix", filepath.Join(serveDir(), machineName+".sock")
+	}
+}
+
+func serveDir() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("machine-sync-%d", os.Getuid()))
+}
+
+// checkServeDir creates the default socket directory, refusing one that
+// other users can get into.
+func checkServeDir() error {
+	dir := serveDir()
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	// windows doesn't report unix permissions
+	if !fi.IsDir() || (runtime.GOOS != "windows" && fi.Mode().Perm() != 0700) {
+		return fmt.Errorf("refusing to use %s for the socket: it must be a directory only you can access", dir)
+	}
+
+	return nil
+}
+
+// serve keeps the connection to the machine open and runs sync and verify
+// requests from the request command, so repeated syncs don't pay for the
+// ssh handshake every time.
+func serve(c *cli.Context) {
+	serveToken = c.String("token")
+	network, addr := serveAddr(c.String("listen"))
+	if network == "tcp" && serveToken == "" {
+		log.Fatal("serving on tcp requires --token")
+	}
+
+	setupOnce(c)
+	reconnects.enable(c)
+
+	if c.String("listen") == "" {
+		if err := checkServeDir(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if network == "unix" {
+		// a socket left behind by a previous run
+		os.Remove(addr)
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if network == "unix" {
+		if err := os.Chmod(addr, 0600); err != nil {
+			log.Fatal(err)
+		}
+	}
+	log.Infof("serving sync requests on %s:%s", network, addr)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// closed on shutdown
+			return
+		}
+		go handleServeConn(conn)
+	}
+}
+
+func handleServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	req := &serveRequest{}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, req)
+	}
+	if err != nil {
+		json.NewEncoder(conn).Encode(&serveResponse{ExitCode: exitFlags, Error: fmt.Sprintf("invalid request: %s", err)})
+		return
+	}
+
+	if serveToken != "" && subtle.ConstantTimeCompare([]byte(req.Token), []byte(serveToken)) != 1 {
+		log.Warnf("rejected %s request with a wrong token", req.Command)
+		json.NewEncoder(conn).Encode(&serveResponse{ExitCode: exitFlags, Error: "invalid token"})
+		return
+	}
+
+	serveMu.Lock()
+	defer serveMu.Unlock()
+
+	log.Debugf("serving %s request", req.Command)
+
+	// the connection may have dropped since the last request
+	if !connEvents.isUp() {
+		reconnects.recover(errors.New("connection lost while idle"))
+	}
+
+	resp := &serveResponse{}
+	switch req.Command {
+	case "sync":
+		syncSince = time.Time{}
+		if req.Since != "" {
+			if syncSince, err = parseSince(req.Since); err != nil {
+				resp.ExitCode = exitFlags
+				resp.Error = err.Error()
+				break
+			}
+		}
+		resp.Summary, err = runSync()
+		resp.ExitCode = exitCode(err)
+	case "verify":
+		resp.Summary, err = runVerify()
+		resp.ExitCode = exitCode(err)
+	default:
+		resp.ExitCode = exitFlags
+		err = fmt.Errorf("unknown command %q", req.Command)
+	}
+	if err != nil && resp.Error == "" {
+		resp.Error = err.Error()
+	}
+
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		log.Warnf("unable to send response: %s", err)
+	}
+}
+
+// request sends a sync or verify to a serving machine-sync and exits with
+// its result.
+func request(c *cli.Context) {
+	machineName = c.GlobalString("machine")
+
+	cmd := c.Args().First()
+	if cmd != "sync" && cmd != "verify" {
+		fmt.Fprintln(os.Stderr, "error: request must be sync or verify")
+		os.Exit(exitFlags)
+	}
+
+	network, addr := serveAddr(c.String("socket"))
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to connect to machine-sync serve at %s: %s\n", addr, err)
+		os.Exit(exitConnect)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(&serveRequest{Command: cmd, Since: c.String("since"), Token: c.String("token")}); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(exitConnect)
+	}
+
+	resp := &serveResponse{}
+	if err := json.NewDecoder(conn).Decode(resp); err != nil {
+		fmt.Fprintf(os.Stderr, "error: no response from machine-sync serve: %s\n", err)
+		os.Exit(exitConnect)
+	}
+
+	if resp.Summary != "" {
+		fmt.Fprintln(os.Stderr, resp.Summary)
+	}
+	if resp.Error != "" {
+		fmt.Fprintf(os.Stderr, "error: %s\n", resp.Error)
+	}
+	os.Exit(resp.ExitCode)
+}
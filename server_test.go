@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is an ssh server with sftp and commands standing in for the
+// machine.  Remote paths are paths on the local filesystem.
+type testServer struct {
+	t      testing.TB
+	config *ssh.ServerConfig
+	addr   string
+
+	mu    sync.Mutex
+	ln    net.Listener
+	conns []net.Conn
+	// delay holds back sftp requests on their way to the server like the
+	// latency of a slow link, so transfers take long enough to interrupt.
+	delay time.Duration
+}
+
+func startTestServer(t testing.TB) *testServer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{
+		t: t,
+		// any client is let in
+		config: &ssh.ServerConfig{NoClientAuth: true},
+		addr:   "127.0.0.1:0",
+	}
+	s.config.AddHostKey(signer)
+	s.restore()
+
+	return s
+}
+
+// restore starts accepting connections again on the same address.
+func (s *testServer) restore() {
+	var ln net.Listener
+	var err error
+	// the port may take a moment to be released after kill
+	for i := 0; i < 50; i++ {
+		if ln, err = net.Listen("tcp", s.addr); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	s.ln = ln
+	s.addr = ln.Addr().String()
+	s.mu.Unlock()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go s.handle(conn)
+		}
+	}()
+}
+
+// kill drops every connection and stops accepting new ones, as if the
+// machine went away.
+func (s *testServer) kill() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ln.Close()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testServer) setDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.delay = d
+}
+
+func (s *testServer) getDelay() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.delay
+}
+
+func (s *testServer) handle(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go s.session(ch, reqs)
+	}
+}
+
+func (s *testServer) session(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+
+	for req := range reqs {
+		switch req.Type {
+		case "subsystem":
+			if string(req.Payload[4:]) != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			server, err := sftp.NewServer(newSlowChannel(ch, s))
+			if err != nil {
+				return
+			}
+			server.Serve()
+			return
+		case "exec":
+			req.Reply(true, nil)
+			n := binary.BigEndian.Uint32(req.Payload)
+			cmd := exec.Command("sh", "-c", string(req.Payload[4:4+n]))
+			cmd.Stdin = ch
+			cmd.Stdout = ch
+			cmd.Stderr = ch.Stderr()
+			status := uint32(0)
+			if err := cmd.Run(); err != nil {
+				status = 1
+				if exitErr, ok := err.(*exec.ExitError); ok {
+					status = uint32(exitErr.ExitCode())
+				}
+			}
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		default:
+			// env and pty requests are accepted and ignored
+			req.Reply(req.Type == "env", nil)
+		}
+	}
+}
+
+// slowChannel delays what is read from the channel by the server's delay
+// after it arrived.  Requests sent together arrive together, so like a
+// real link it adds latency without limiting throughput.
+type slowChannel struct {
+	ssh.Channel
+	s      *testServer
+	chunks chan slowChunk
+	buf    []byte
+	err    error
+}
+
+type slowChunk struct {
+	data []byte
+	at   time.Time
+	err  error
+}
+
+func newSlowChannel(ch ssh.Channel, s *testServer) *slowChannel {
+	c := &slowChannel{Channel: ch, s: s, chunks: make(chan slowChunk, 1024)}
+	go func() {
+		for {
+			b := make([]byte, 64*1024)
+			n, err := ch.Read(b)
+			c.chunks <- slowChunk{b[:n], time.Now(), err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return c
+}
+
+func (c *slowChannel) Read(b []byte) (int, error) {
+	if len(c.buf) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		chunk := <-c.chunks
+		time.Sleep(time.Until(chunk.at.Add(c.s.getDelay())))
+		c.buf, c.err = chunk.data, chunk.err
+	}
+
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	if len(c.buf) == 0 && n == 0 {
+		return 0, c.err
+	}
+
+	return n, nil
+}
+
+// connectTestServer connects the globals used to reach the machine to s.
+func connectTestServer(t testing.TB, s *testServer, opts ...sftp.ClientOption) {
+	client, err := ssh.Dial("tcp", s.addr, &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ftp, err := sftp.NewClient(client, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rssh = client
+	rsftp = ftp
+	remoteStats.flush()
+	connEvents.up(client)
+}
+
+// requireExec skips tests running commands on the machine where the test
+// server can't run them.
+func requireExec(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands on the machine need sh")
+	}
+}
+
+// testTree creates a directory to sync with a source and destination in
+// it and changes to it, since local paths are relative to where
+// machine-sync runs.  It returns the destination and a function restoring
+// the working directory and removing the tree.
+func testTree(t testing.TB) (string, func()) {
+	dir, err := ioutil.TempDir("", "machine-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the temporary directory may be behind a symlink
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	srcPath = "src"
+	destPath = filepath.ToSlash(filepath.Join(dir, "dst"))
+	if err := os.Mkdir(destPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return destPath, func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+func writeTestFile(t testing.TB, p string, data []byte) {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// compareTrees fails the test unless every file under local has the same
+// content under remote.
+func compareTrees(t *testing.T, local, remote string) {
+	err := filepath.Walk(local, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		want, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		got, err := ioutil.ReadFile(filepath.Join(remote, p))
+		if err != nil {
+			t.Errorf("%s was not synced: %s", p, err)
+			return nil
+		}
+		if string(got) != string(want) {
+			t.Errorf("%s differs on the machine", p)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// remoteEnv holds the KEY=VALUE pairs from --remote-env that are set
+	// for every command run on the machine.
+	remoteEnv []string
+	// rejectedEnv records variables the server refused so each is only
+	// warned about once.
+	rejectedEnv   = map[string]bool{}
+	rejectedEnvMu sync.Mutex
+)
+
+func parseRemoteEnv(vars []string) error {
+	for _, v := range vars {
+		if i := strings.Index(v, "="); i < 1 {
+			return fmt.Errorf("invalid remote env %s: must be KEY=VALUE", v)
+		}
+	}
+
+	return nil
+}
+
+// newSession opens a session for running a command on the machine with
+// remoteEnv set.  The server only accepts variables allowed by AcceptEnv
+// in its sshd_config; others are skipped with a warning.
+func newSession() (*ssh.Session, error) {
+	session, err := rssh.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range remoteEnv {
+		kv := strings.SplitN(v, "=", 2)
+		if err := session.Setenv(kv[0], kv[1]); err != nil {
+			rejectedEnvMu.Lock()
+			if !rejectedEnv[kv[0]] {
+				rejectedEnv[kv[0]] = true
+				log.Warnf("the machine rejected %s from --remote-env; it must be allowed by AcceptEnv in sshd_config", kv[0])
+			}
+			rejectedEnvMu.Unlock()
+		}
+	}
+
+	return session, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+// setupKeyBits is the size of the rsa keys generated by setup-key.
+const setupKeyBits = 4096
+
+// setupKey generates a key for the machine if it doesn't have one and
+// installs it in the user's authorized_keys on the machine, logging in
+// with a password, so later runs can use key auth.
+func setupKey(c *cli.Context) {
+	machineName = c.GlobalString("machine")
+	machineUser = c.GlobalString("user")
+	machineConfigPath = c.GlobalString("machine-path")
+	machineIPCommand = c.GlobalString("machine-ip-command")
+	assumeYes = c.GlobalBool("yes")
+	configureDialer(c)
+	if machineName == "" {
+		log.Fatal("you must specify a machine")
+	}
+	if machineConfigPath == "" {
+		p, err := detectMachinePath()
+		if err != nil {
+			p = machineStorePaths()[0]
+		}
+		machineConfigPath = p
+	}
+
+	machineConfig, err := loadConfig()
+	if err != nil {
+		if machineIPCommand == "" {
+			log.Fatal(err)
+		}
+		machineConfig = &MachineConfig{}
+	}
+
+	keyPath := getSSHKeyPath(machineConfig)
+	signer, err := loadOrGenerateKey(keyPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	addr, err := machineAddr(machineConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sshConfig := &ssh.ClientConfig{
+		User:            machineUser,
+		Auth:            []ssh.AuthMethod{ssh.PasswordCallback(promptPassword)},
+		HostKeyCallback: checkHostKey,
+	}
+	sshConfig.Ciphers, _ = parseAlgorithms("cipher", c.GlobalString("ssh-ciphers"), validCiphers)
+	sshConfig.KeyExchanges, _ = parseAlgorithms("key exchange", c.GlobalString("ssh-kex"), validKexAlgorithms)
+
+	client, err := dialSSH(addr, sshConfig)
+	if err != nil {
+		log.Fatalf("unable to log in to %s with a password: %s", machineName, err)
+	}
+	defer client.Close()
+
+	if err := installKey(client, signer.PublicKey()); err != nil {
+		log.Fatal(err)
+	}
+
+	// make sure the key works before claiming success
+	sshConfig.Auth = []ssh.AuthMethod{ssh.PublicKeys(signer)}
+	check, err := dialSSH(addr, sshConfig)
+	if err != nil {
+		log.Fatalf("installed %s.pub but logging in with it failed: %s", keyPath, err)
+	}
+	check.Close()
+
+	log.Infof("installed %s.pub for %s on %s; key auth is ready", keyPath, machineUser, machineName)
+}
+
+// loadOrGenerateKey loads the private key at keyPath, generating it and
+// its .pub first when it doesn't exist.
+func loadOrGenerateKey(keyPath string) (ssh.Signer, error) {
+	if data, err := ioutil.ReadFile(keyPath); err == nil {
+		return ssh.ParsePrivateKey(data)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	log.Infof("generating %s", keyPath)
+	key, err := rsa.GenerateKey(rand.Reader, setupKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(keyPath, data, 0600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(keyPath+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644); err != nil {
+		return nil, err
+	}
+
+	return signer, nil
+}
+
+// installKey adds key to authorized_keys on the machine unless it is there
+// already.  sshd ignores keys when ~/.ssh or the file is writable by
+// others so their modes are set as well.
+func installKey(client *ssh.Client, key ssh.PublicKey) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	line := shellQuote(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
+	cmd := strings.Join([]string{
+		"umask 077",
+		"mkdir -p ~/.ssh",
+		"chmod 700 ~/.ssh",
+		"touch ~/.ssh/authorized_keys",
+		"chmod 600 ~/.ssh/authorized_keys",
+		fmt.Sprintf("(grep -qxF %s ~/.ssh/authorized_keys || echo %s >> ~/.ssh/authorized_keys)", line, line),
+	}, " && ")
+
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	if err := session.Run(cmd); err != nil {
+		return fmt.Errorf("unable to install the key on %s: %s: %s", machineName, err, strip(stderr.String()))
+	}
+
+	return nil
+}
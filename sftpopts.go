@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/pkg/sftp"
+)
+
+// sftpMaxCheckedPacket is the largest packet every sftp server is required
+// to accept.
+const sftpMaxCheckedPacket = 32768
+
+// sftp client tuning.  Larger packets and more requests in flight per file
+// keep a link with a high bandwidth-delay product busy at the cost of more
+// memory per transfer; packets over 32K are not accepted by every server.
+// Concurrent writes are faster over such links but may leave a partly
+// written file out of order if the transfer fails.
+var (
+	sftpPacketSize       = sftpMaxCheckedPacket
+	sftpRequests         = 64
+	sftpConcurrentWrites bool
+)
+
+// sftpOptions returns the client options for the tuning flags.
+func sftpOptions() []sftp.ClientOption {
+	packet := sftp.MaxPacketChecked(sftpPacketSize)
+	if sftpPacketSize > sftpMaxCheckedPacket {
+		packet = sftp.MaxPacketUnchecked(sftpPacketSize)
+	}
+
+	return []sftp.ClientOption{
+		packet,
+		sftp.MaxConcurrentRequestsPerFile(sftpRequests),
+		sftp.UseConcurrentWrites(sftpConcurrentWrites),
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// BenchmarkSFTPOptions uploads a large file with each of the tuning
+// settings.  The machine answers each read after a delay standing in for
+// the round trip of a slow link, which is where the settings matter.
+func BenchmarkSFTPOptions(b *testing.B) {
+	settings := []struct {
+		packet     int
+		requests   int
+		concurrent bool
+	}{
+		{sftpMaxCheckedPacket, 1, false},
+		{sftpMaxCheckedPacket, 64, false},
+		{sftpMaxCheckedPacket, 64, true},
+		{128 * 1024, 64, false},
+		{128 * 1024, 64, true},
+	}
+
+	s := startTestServer(b)
+	defer s.kill()
+	_, cleanup := testTree(b)
+	defer cleanup()
+	s.setDelay(2 * time.Millisecond)
+
+	data := randomData(8, 8<<20)
+	defer func(packet, requests int, concurrent bool) {
+		sftpPacketSize, sftpRequests, sftpConcurrentWrites = packet, requests, concurrent
+	}(sftpPacketSize, sftpRequests, sftpConcurrentWrites)
+
+	for _, setting := range settings {
+		name := fmt.Sprintf("packet=%dK/requests=%d/concurrent=%v", setting.packet/1024, setting.requests, setting.concurrent)
+		b.Run(name, func(b *testing.B) {
+			sftpPacketSize, sftpRequests, sftpConcurrentWrites = setting.packet, setting.requests, setting.concurrent
+			connectTestServer(b, s, sftpOptions()...)
+			defer rssh.Close()
+
+			filePath := filepath.ToSlash(filepath.Join(destPath, "large"))
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := writeRemote(filePath, data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+package main
+
+import (
+	"os"
+)
+
+// windows has no SIGUSR1; use the status endpoint to pause and resume
+func notifyPauseSignal(c chan os.Signal) {}
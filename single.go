@@ -0,0 +1,32 @@
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/howeyc/fsnotify"
+)
+
+// singleFile is set when --directory is a regular file.  Its parent
+// directory is watched, only the file itself is synced and it is written
+// to destPath directly.
+var singleFile string
+
+// singleFileEvent reports whether ev should be handled in single file
+// mode and reschedules removals of the file.  Editors often save by
+// renaming a new file over the old one, so the file may only be missing
+// for a moment; its state is checked again once that has settled.
+func singleFileEvent(ev *fsnotify.FileEvent) bool {
+	if filepath.Clean(ev.Name) != singleFile {
+		return false
+	}
+
+	if isRemoval(ev) {
+		time.AfterFunc(requeueDelay, func() {
+			dispatch(&fsnotify.FileEvent{Name: ev.Name})
+		})
+		return false
+	}
+
+	return true
+}
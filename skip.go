@@ -0,0 +1,38 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+// skipReason says why a path wasn't synced.
+type skipReason string
+
+const (
+	skipExcluded    skipReason = "excluded"
+	skipOld         skipReason = "not modified within --skip-older-than"
+	skipNotSince    skipReason = "not modified since --since"
+	skipTransferred skipReason = "already transferred"
+	skipGrowing     skipReason = "keeps growing"
+	skipPermission  skipReason = "permission denied"
+	skipTransform   skipReason = "transform failed"
+	skipSpecial     skipReason = "not a regular file or directory"
+	skipNoDelete    skipReason = "deletes are disabled"
+	skipRecreated   skipReason = "exists again"
+	skipBusy        skipReason = "busy on the machine"
+)
+
+// logSkips logs skipped paths at info instead of debug.
+var logSkips bool
+
+// logSkip records that p was skipped and why.
+func logSkip(p string, reason skipReason) {
+	entry := log.WithFields(log.Fields{
+		"path":   p,
+		"reason": string(reason),
+	})
+	if logSkips {
+		entry.Info("skipped")
+	} else {
+		entry.Debug("skipped")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/howeyc/fsnotify"
+)
+
+// spillEvents sends events that don't fit in the worker queues to a file
+// on disk instead of blocking the watcher.
+var (
+	spillEvents bool
+	spill       *spillQueue
+)
+
+// spillQueue is a file of paths waiting to be synced.  Only the path is
+// kept; when an entry is read back it is synced according to the current
+// state of the local file, so a path missing locally is deleted.
+type spillQueue struct {
+	mu      sync.Mutex
+	f       *os.File
+	r       *bufio.Reader
+	offset  int64
+	pending int
+	ready   chan struct{}
+}
+
+func newSpillQueue() (*spillQueue, error) {
+	f, err := ioutil.TempFile("", "machine-sync-spill")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &spillQueue{
+		f:     f,
+		ready: make(chan struct{}, 1),
+	}
+	s.r = bufio.NewReader(io.NewSectionReader(f, 0, 1<<62))
+
+	go s.run()
+
+	return s, nil
+}
+
+// push appends p to the queue.
+func (s *spillQueue) push(p string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending == 0 {
+		log.Debugf("worker queues are full; spilling events to %s", s.f.Name())
+	}
+
+	// quoted so names containing newlines survive
+	if _, err := fmt.Fprintln(s.f, strconv.Quote(p)); err != nil {
+		return err
+	}
+	s.pending++
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// len returns the number of spilled events.
+func (s *spillQueue) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.pending
+}
+
+// next returns the oldest spilled path.  The file is emptied once
+// everything in it has been read.
+func (s *spillQueue) next() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending == 0 {
+		return "", false
+	}
+
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		log.Errorf("unable to read spilled events: %s", err)
+		s.reset()
+		return "", false
+	}
+	s.pending--
+	if s.pending == 0 {
+		s.reset()
+	}
+
+	p, err := strconv.Unquote(line[:len(line)-1])
+	if err != nil {
+		log.Errorf("invalid spilled event %q: %s", line, err)
+		return "", false
+	}
+
+	return p, true
+}
+
+func (s *spillQueue) reset() {
+	s.pending = 0
+	if err := s.f.Truncate(0); err != nil {
+		log.Errorf("unable to truncate %s: %s", s.f.Name(), err)
+	}
+	s.f.Seek(0, io.SeekStart)
+	s.r.Reset(io.NewSectionReader(s.f, 0, 1<<62))
+}
+
+// run feeds spilled events back to the workers as they have room.
+func (s *spillQueue) run() {
+	for range s.ready {
+		for {
+			p, ok := s.next()
+			if !ok {
+				break
+			}
+			queueFor(p) <- &fsnotify.FileEvent{Name: p}
+		}
+	}
+}
+
+func (s *spillQueue) close() {
+	s.f.Close()
+	os.Remove(s.f.Name())
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// remoteStatTTL bounds how long a cached stat is trusted, in case the file
+// is changed on the machine by something else.
+const remoteStatTTL = 30 * time.Second
+
+var remoteStats = &statCache{entries: map[string]statEntry{}}
+
+type statEntry struct {
+	info    os.FileInfo
+	fetched time.Time
+}
+
+// statCache remembers the metadata of remote files so hot files don't cost
+// a round trip on every event.  Entries are invalidated whenever the file
+// is changed by the sync and everything is flushed when connecting.
+type statCache struct {
+	mu      sync.Mutex
+	entries map[string]statEntry
+}
+
+// stat returns the cached metadata for filePath or fetches it from the
+// machine.  Missing files are not cached.
+func (c *statCache) stat(filePath string) (os.FileInfo, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[filePath]
+	c.mu.Unlock()
+	if ok && time.Since(entry.fetched) < remoteStatTTL {
+		return entry.info, nil
+	}
+
+	var fi os.FileInfo
+	if err := timeOp("stat", filePath, func() (err error) {
+		fi, err = rsftp.Stat(filePath)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.entries[filePath] = statEntry{info: fi, fetched: time.Now()}
+	c.mu.Unlock()
+
+	return fi, nil
+}
+
+func (c *statCache) invalidate(filePath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, filePath)
+}
+
+func (c *statCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = map[string]statEntry{}
+}
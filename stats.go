@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxRecent is how many of the latest transfers are kept for display.
+const maxRecent = 10
+
+var syncStats = &transferStats{}
+
+type transfer struct {
+	Path string    `json:"path"`
+	Time time.Time `json:"time"`
+	Err  string    `json:"error,omitempty"`
+}
+
+// transferStats counts the work done since startup.
+type transferStats struct {
+	mu        sync.Mutex
+	Files     int64      `json:"files"`
+	Bytes     int64      `json:"bytes"`
+	Errors    int64      `json:"errors"`
+	LastError string     `json:"last_error,omitempty"`
+	Recent    []transfer `json:"recent"`
+}
+
+func (s *transferStats) addBytes(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Bytes += n
+}
+
+// record counts a finished transfer of filePath.
+func (s *transferStats) record(filePath string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := transfer{
+		Path: filePath,
+		Time: time.Now(),
+	}
+	if err != nil {
+		s.Errors++
+		s.LastError = err.Error()
+		t.Err = err.Error()
+	} else {
+		s.Files++
+	}
+
+	s.Recent = append(s.Recent, t)
+	if len(s.Recent) > maxRecent {
+		s.Recent = s.Recent[len(s.Recent)-maxRecent:]
+	}
+}
+
+func (s *transferStats) snapshot() *transferStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return &transferStats{
+		Files:     s.Files,
+		Bytes:     s.Bytes,
+		Errors:    s.Errors,
+		LastError: s.LastError,
+		Recent:    append([]transfer{}, s.Recent...),
+	}
+}
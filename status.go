@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type syncStatus struct {
+	Machine     string         `json:"machine"`
+	Source      string         `json:"source"`
+	Destination string         `json:"destination"`
+	Paused      bool           `json:"paused"`
+	Gated       bool           `json:"gated"`
+	Queued      int            `json:"queued"`
+	HeldDeletes int            `json:"held_deletes"`
+	Breaker     string         `json:"breaker"`
+	Watches     int            `json:"watches"`
+	Transfers   *transferStats `json:"transfers"`
+	// LastProgress is when a worker last finished an event.
+	LastProgress time.Time `json:"last_progress"`
+}
+
+func currentStatus() *syncStatus {
+	paused, queued := syncPause.state()
+
+	return &syncStatus{
+		Machine:      machineName,
+		Source:       srcPath,
+		Destination:  destPath,
+		Paused:       paused,
+		Gated:        syncPause.isGated(),
+		Queued:       queued,
+		HeldDeletes:  deleteGuard.heldCount(),
+		Breaker:      transferBreaker.currentState(),
+		Watches:      watched.count(),
+		Transfers:    syncStats.snapshot(),
+		LastProgress: workerProgress.lastProgress(),
+	}
+}
+
+// serveStatus serves the status and pause control endpoints on addr.
+func serveStatus(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(currentStatus())
+	})
+	mux.HandleFunc("/pause", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		pauseSync()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/deletes/release", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		releaseDeletes(true)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/deletes/drop", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		releaseDeletes(false)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		resumeSync()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return http.ListenAndServe(addr, mux)
+}
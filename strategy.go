@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	strategyUpload = "upload"
+	strategyDelta  = "delta"
+)
+
+var (
+	// autoStrategy picks tar, delta or a plain upload from the paths being
+	// synced instead of --tar and --delta.
+	autoStrategy bool
+	// autoTarFiles and autoTarAvgSize are how many files, no larger than
+	// autoTarAvgSize on average, make the initial sync go as a tar archive.
+	autoTarFiles   int
+	autoTarAvgSize int64
+	// autoDeltaSize is the smallest existing file sent as a delta.
+	autoDeltaSize int64
+)
+
+// chooseTar reports whether the initial sync of paths is sent as a tar
+// archive.  Archives save a round trip per file so pay off for many small
+// files; a few large ones gain nothing over sftp.
+func chooseTar(paths []string) bool {
+	if !autoStrategy {
+		return useTar
+	}
+	// encrypted files can't be extracted on the machine
+	if encryptionKey != nil {
+		return false
+	}
+
+	var files int
+	var total int64
+	for _, p := range paths {
+		fi, err := os.Lstat(p)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		files++
+		total += fi.Size()
+	}
+
+	avg := int64(0)
+	if files > 0 {
+		avg = total / int64(files)
+	}
+	tar := files >= autoTarFiles && avg <= autoTarAvgSize
+	strategy := "sftp"
+	if tar {
+		strategy = "tar"
+	}
+	log.Infof("initial sync strategy: %s (%d files, %s on average)", strategy, files, formatBytes(avg))
+
+	return tar
+}
+
+// chooseStrategy returns how data is written to filePath.  Only large
+// files that already exist on the machine are worth comparing block by
+// block; anything else is uploaded whole.
+func chooseStrategy(filePath string, size int64) string {
+	if !autoStrategy {
+		if deltaUploads {
+			return strategyDelta
+		}
+		return strategyUpload
+	}
+
+	strategy := strategyUpload
+	// a fresh nonce changes every block of an encrypted file
+	if size >= autoDeltaSize && encryptionKey == nil {
+		if fi, err := remoteStats.stat(filePath); err == nil && fi.Mode().IsRegular() {
+			strategy = strategyDelta
+		}
+	}
+	log.Debugf("strategy for %s: %s (%s)", filePath, strategy, formatBytes(size))
+
+	return strategy
+}
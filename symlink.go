@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// remoteSymlink is the link:target pair set with --remote-symlink.
+var remoteSymlink string
+
+func parseRemoteSymlink(s string) (string, string, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid remote symlink %s: must be link:target", s)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// updateRemoteSymlink points the link from --remote-symlink at its target
+// on the machine.  A link that is already correct is left alone and an
+// existing path that isn't a symlink is never replaced.
+func updateRemoteSymlink() error {
+	if remoteSymlink == "" {
+		return nil
+	}
+
+	link, target, err := parseRemoteSymlink(remoteSymlink)
+	if err != nil {
+		return err
+	}
+	link = chrootPath(link)
+	if path.IsAbs(target) {
+		target = chrootPath(target)
+	}
+
+	fi, err := rsftp.Lstat(link)
+	switch {
+	case err == nil && fi.Mode()&os.ModeSymlink == 0:
+		return fmt.Errorf("unable to create symlink %s: path exists and is not a symlink", link)
+	case err == nil:
+		current, err := rsftp.ReadLink(link)
+		if err != nil {
+			return err
+		}
+		if current == target {
+			log.Debugf("symlink %s already points to %s", link, target)
+			return nil
+		}
+		if err := rsftp.Remove(link); err != nil {
+			return fmt.Errorf("unable to replace symlink %s: %s", link, err)
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	log.Infof("linking %s -> %s", link, target)
+	if err := rsftp.Symlink(target, link); err != nil {
+		if isUnsupported(err) {
+			return fmt.Errorf("unable to create symlink %s: the sftp server on %s doesn't support symlinks", link, machineName)
+		}
+		return fmt.Errorf("unable to create symlink %s: %s", link, err)
+	}
+
+	current, err := rsftp.ReadLink(link)
+	if err != nil {
+		return fmt.Errorf("unable to validate symlink %s: %s", link, err)
+	}
+	if current != target {
+		return fmt.Errorf("symlink %s points to %s instead of %s", link, current, target)
+	}
+
+	return nil
+}
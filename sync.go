@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// skipOlderThan excludes files not modified within the duration from the
+// initial sync.  Live events are always synced.
+var skipOlderThan time.Duration
+
+// initialConcurrency is how many files the initial sync uploads at once.
+var initialConcurrency = 1
+
+// syncSince excludes files not modified after it from a one-shot sync.
+var syncSince time.Time
+
+// sinceLayouts are the absolute time formats accepted by --since.
+var sinceLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseSince parses an absolute local time or a duration before now.
+func parseSince(v string) (time.Time, error) {
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	for _, layout := range sinceLayouts {
+		if t, err := time.ParseInLocation(layout, v, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time %s: must be a duration (e.g. 1h) or a time (e.g. 2006-01-02 15:04)", v)
+}
+
+// ensureDestPath creates destPath on the machine, along with any missing
+// parents, so there is always a base to upload into.  When syncing a single
+// file destPath is the file so only its parent is created.
+func ensureDestPath() error {
+	dir := destPath
+	if singleFile != "" {
+		dir = path.Dir(destPath)
+	}
+
+	if err := timeOp("mkdir", dir, func() error {
+		return remoteMkdirAll(dir)
+	}); err != nil {
+		if os.IsPermission(err) {
+			return fmt.Errorf("unable to create destination %s: permission denied for user %s on %s%s", destPath, machineUser, machineName, chrootHint())
+		}
+		return fmt.Errorf("unable to create destination %s: %s", destPath, err)
+	}
+	checkCaseSensitivity(dir)
+
+	return nil
+}
+
+// initialSync uploads every file and directory under srcPath to the
+// machine.  When tar mode is enabled, or --auto-strategy picks it, and the
+// machine has tar available the whole tree is sent as a single archive,
+// otherwise each path is transferred over sftp.
+func initialSync() error {
+	paths, err := syncPaths()
+	if err != nil {
+		return err
+	}
+
+	if err := checkTreeSize(paths); err != nil {
+		return err
+	}
+
+	if err := checkFreeInodes(paths); err != nil {
+		return err
+	}
+
+	paths = orderPaths(paths)
+	// a single file is written to destPath itself, which tar can't
+	// extract into
+	tarSync := singleFile == "" && chooseTar(paths)
+
+	if resumeInitialSync && !tarSync {
+		if journal, err = openJournal(journalPath()); err != nil {
+			return err
+		}
+		defer func() {
+			journal.close()
+			journal = nil
+		}()
+	}
+
+	if showProgress {
+		initialProgress = startProgress(paths)
+		defer func() {
+			initialProgress.stop()
+			initialProgress = nil
+		}()
+	}
+
+	// the archive is extracted in one place
+	if tarSync && !destMarkers.empty() {
+		log.Warnf("%s files set other destinations; uploading over sftp instead of tar", destMarkerName)
+	} else if tarSync && len(extRoutes) > 0 {
+		log.Warn("--route sets other destinations; uploading over sftp instead of tar")
+	} else if tarSync {
+		if tarAvailable() {
+			log.Debugf("uploading %d paths as tar archive", len(paths))
+			if err := uploadTar(paths); err != nil {
+				return err
+			}
+			for _, p := range paths {
+				applyXattrs(p, remotePath(p))
+				applyOwner(p, remotePath(p))
+			}
+			return verifyInitialSync(paths)
+		}
+		log.Warn("tar is not available on the machine; falling back to sftp")
+	}
+
+	// directories come first and are created in order; files are
+	// uploaded by initialConcurrency at a time
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		sem      = make(chan struct{}, initialConcurrency)
+	)
+	failed := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr
+	}
+	for _, p := range paths {
+		if err := failed(); err != nil {
+			break
+		}
+
+		fi, err := os.Lstat(p)
+		if err != nil {
+			wg.Wait()
+			return err
+		}
+
+		if fi.IsDir() {
+			if err := initialSyncPath(p, fi); err != nil {
+				wg.Wait()
+				return err
+			}
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(p string, fi os.FileInfo) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := initialSyncPath(p, fi); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(p, fi)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if err := verifyInitialSync(paths); err != nil {
+		return err
+	}
+	journal.finish()
+
+	return nil
+}
+
+// initialSyncPath uploads or creates a single path of the initial sync.
+func initialSyncPath(p string, fi os.FileInfo) error {
+	filePath := remotePath(p)
+	switch {
+	case fi.IsDir():
+		if err := timeOp("mkdir", filePath, func() error {
+			return remoteMkdirAll(filePath)
+		}); err != nil {
+			if isConnectionLost(err) && reconnects.recover(err) {
+				return initialSyncPath(p, fi)
+			}
+			return err
+		}
+		applyOwner(p, filePath)
+	case fi.Mode().IsRegular():
+		if journal.done(p, fi) {
+			logSkip(p, skipTransferred)
+			initialProgress.add(fi.Size())
+			return nil
+		}
+		if hardlinks.link(p, filePath) {
+			initialProgress.add(fi.Size())
+			return nil
+		}
+		log.Infof("updating %s", filePath)
+		start := time.Now()
+		err := retry(func() error {
+			return uploadFile(p, filePath)
+		}, func(err error) bool {
+			return isTooManyOpenFiles(err) || err == errFileChanged
+		})
+		// only this file is sent again; the rest carry on once reconnected
+		if isConnectionLost(err) && reconnects.recover(err) {
+			return initialSyncPath(p, fi)
+		}
+		syncEvents.emit("upload", p, filePath, fi.Size(), start, err)
+		syncStats.record(filePath, err)
+		initialProgress.add(fi.Size())
+		if err != nil {
+			if isTransformError(err) {
+				log.Error(err)
+				logSkip(p, skipTransform)
+				return nil
+			}
+			if isPermissionDenied(err) && onPermissionDenied == "skip" {
+				log.Warnf("skipping %s: permission denied for %s", filePath, machineUser)
+				logSkip(p, skipPermission)
+				return nil
+			}
+			return err
+		}
+		journal.record(p, fi)
+	default:
+		logSkip(p, skipSpecial)
+	}
+
+	return nil
+}
+
+// syncPaths walks srcPath and returns the paths the initial sync would
+// transfer.
+func syncPaths() ([]string, error) {
+	if singleFile != "" {
+		return []string{singleFile}, nil
+	}
+
+	walk := func(fn filepath.WalkFunc) error {
+		return walkTree(srcPath, fn)
+	}
+	if len(watchList) > 0 {
+		walk = watchListPaths
+	}
+
+	paths := []string{}
+	if err := walk(func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if isExcluded(p, fi.IsDir()) {
+			logSkip(p, skipExcluded)
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if skipOlderThan > 0 && !fi.IsDir() && time.Since(fi.ModTime()) > skipOlderThan {
+			logSkip(p, skipOld)
+			return nil
+		}
+		if !syncSince.IsZero() && !fi.IsDir() && !fi.ModTime().After(syncSince) {
+			logSkip(p, skipNotSince)
+			return nil
+		}
+		paths = append(paths, p)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return paths, nil
+}
+
+// orderPaths puts directories, parents first, ahead of everything else so
+// the tree exists before files are uploaded into it.  The walk order is
+// kept otherwise so the sync is deterministic.
+func orderPaths(paths []string) []string {
+	dirs := []string{}
+	files := []string{}
+	for _, p := range paths {
+		if fi, err := os.Lstat(p); err == nil && fi.IsDir() {
+			dirs = append(dirs, p)
+			continue
+		}
+		files = append(files, p)
+	}
+
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return pathDepth(dirs[i]) < pathDepth(dirs[j])
+	})
+
+	return append(dirs, files...)
+}
+
+func verifyInitialSync(paths []string) error {
+	if !verifyUploads {
+		return nil
+	}
+
+	log.Infof("verifying %s", destPath)
+	return verifyPaths(paths)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// openFiles returns how many files the process has open, or -1 where that
+// can't be told.
+func openFiles() int {
+	entries, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
+
+// TestSyncThousandsOfFiles syncs a tree of thousands of files and checks
+// that no handles are left open on either side.
+func TestSyncThousandsOfFiles(t *testing.T) {
+	if testing.Short() {
+		t.Skip("stress test")
+	}
+
+	s := startTestServer(t)
+	defer s.kill()
+	dest, cleanup := testTree(t)
+	defer cleanup()
+	connectTestServer(t, s)
+
+	const n = 3000
+	for i := 0; i < n; i++ {
+		writeTestFile(t, filepath.Join("src", fmt.Sprintf("d%d", i%30), fmt.Sprintf("f%d", i)), []byte(fmt.Sprintf("file %d\n", i)))
+	}
+
+	defer func(n int) { initialConcurrency = n }(initialConcurrency)
+	initialConcurrency = 64
+
+	before, failed := openFiles(), syncStats.snapshot().Errors
+	if err := initialSync(); err != nil {
+		t.Fatal(err)
+	}
+	compareTrees(t, "src", dest)
+
+	// the server runs in this process so its handles are counted too
+	if after := openFiles(); before >= 0 && after > before+8 {
+		t.Errorf("%d files open after the sync, %d before", after, before)
+	}
+	if n := syncStats.snapshot().Errors - failed; n > 0 {
+		t.Errorf("%d errors syncing", n)
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	before := time.Now()
+	got, err := parseSince("90m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := before.Add(-90 * time.Minute); got.Before(want) || got.After(time.Now().Add(-90*time.Minute)) {
+		t.Errorf("parseSince(90m) = %s, want about %s", got, want)
+	}
+
+	tests := []struct {
+		v    string
+		want time.Time
+	}{
+		{"2017-03-04T05:06:07Z", time.Date(2017, 3, 4, 5, 6, 7, 0, time.UTC)},
+		{"2017-03-04 05:06:07", time.Date(2017, 3, 4, 5, 6, 7, 0, time.Local)},
+		{"2017-03-04 05:06", time.Date(2017, 3, 4, 5, 6, 0, 0, time.Local)},
+		{"2017-03-04", time.Date(2017, 3, 4, 0, 0, 0, 0, time.Local)},
+	}
+	for _, test := range tests {
+		got, err := parseSince(test.v)
+		if err != nil {
+			t.Errorf("parseSince(%q): %s", test.v, err)
+			continue
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("parseSince(%q) = %s, want %s", test.v, got, test.want)
+		}
+	}
+
+	for _, v := range []string{"", "yesterday", "2017-13-01", "04/03/2017"} {
+		if _, err := parseSince(v); err == nil {
+			t.Errorf("parseSince(%q) succeeded", v)
+		}
+	}
+}
+
+func TestOrderPaths(t *testing.T) {
+	_, cleanup := testTree(t)
+	defer cleanup()
+
+	for _, p := range []string{"src/a.txt", "src/b/c/d.txt", "src/b/e.txt"} {
+		writeTestFile(t, filepath.FromSlash(p), nil)
+	}
+	if err := os.Mkdir(filepath.Join("src", "z"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	walked := []string{"src", "src/a.txt", "src/b", "src/b/c", "src/b/c/d.txt", "src/b/e.txt", "src/gone", "src/z"}
+	want := []string{"src", "src/b", "src/z", "src/b/c", "src/a.txt", "src/b/c/d.txt", "src/b/e.txt", "src/gone"}
+	for i := range walked {
+		walked[i] = filepath.FromSlash(walked[i])
+		want[i] = filepath.FromSlash(want[i])
+	}
+
+	if got := orderPaths(walked); !reflect.DeepEqual(got, want) {
+		t.Errorf("orderPaths = %v, want %v", got, want)
+	}
+}
+
+// TestInitialSyncSingleFileWithTar syncs a single file with --tar, where
+// the destination is the file rather than a directory to extract into.
+func TestInitialSyncSingleFileWithTar(t *testing.T) {
+	s := startTestServer(t)
+	defer s.kill()
+	dest, cleanup := testTree(t)
+	defer cleanup()
+	connectTestServer(t, s)
+
+	defer func(tar bool, single, dst string) {
+		useTar, singleFile, destPath = tar, single, dst
+	}(useTar, singleFile, destPath)
+	useTar = true
+	singleFile = filepath.Join("src", "file")
+	destPath = filepath.ToSlash(filepath.Join(dest, "copy"))
+	writeTestFile(t, singleFile, []byte("data"))
+
+	if err := initialSync(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(dest, "copy")); err != nil || string(got) != "data" {
+		t.Errorf("the machine has %q, %v; want %q", got, err, "data")
+	}
+}
+
+// BenchmarkInitialSync syncs a tree of many small files at several initial
+// concurrency levels.  The machine answers after a delay standing in for
+// the round trip of a real link, which is what parallel uploads hide.
+func BenchmarkInitialSync(b *testing.B) {
+	s := startTestServer(b)
+	defer s.kill()
+	_, cleanup := testTree(b)
+	defer cleanup()
+	connectTestServer(b, s)
+	s.setDelay(time.Millisecond)
+
+	const n, size = 500, 4 * 1024
+	for i := 0; i < n; i++ {
+		writeTestFile(b, filepath.Join("src", fmt.Sprintf("d%d", i%10), fmt.Sprintf("f%d", i)), randomData(int64(i), size))
+	}
+
+	defer func(n int) { initialConcurrency = n }(initialConcurrency)
+	for _, c := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("concurrency=%d", c), func(b *testing.B) {
+			initialConcurrency = c
+			b.SetBytes(n * size)
+			for i := 0; i < b.N; i++ {
+				if err := initialSync(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import "fmt"
+
+// syncError is a failed sync operation with the paths on both sides and
+// the machine, so path mapping problems can be seen in logs, stats and
+// events.
+type syncError struct {
+	op     string
+	local  string
+	remote string
+	err    error
+}
+
+func (e *syncError) Error() string {
+	return fmt.Sprintf("error during %s of %s to %s:%s: %s", e.op, e.local, machineName, e.remote, e.err)
+}
+
+func (e *syncError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// tarAvailable reports whether the machine has a tar binary that can be
+// used to extract uploaded archives.
+func tarAvailable() bool {
+	session, err := newSession()
+	if err != nil {
+		return false
+	}
+	defer session.Close()
+
+	return session.Run("command -v tar >/dev/null") == nil
+}
+
+// uploadTar streams the local paths to the machine as a single gzipped tar
+// archive and extracts it under destPath.  File modes and modification
+// times are carried in the archive headers.
+func uploadTar(paths []string) error {
+	session, err := newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+
+	if err := session.Start(fmt.Sprintf("tar -xpzf - -C %s", shellQuote(destPath))); err != nil {
+		return err
+	}
+
+	gw := gzip.NewWriter(stdin)
+	tw := tar.NewWriter(gw)
+	links := map[fileKey]string{}
+	for _, p := range paths {
+		if err := addToTar(tw, p, links); err != nil {
+			stdin.Close()
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	stdin.Close()
+
+	// the archive may have replaced any file
+	remoteStats.flush()
+	if err := session.Wait(); err != nil {
+		return fmt.Errorf("error extracting archive: %s: %s", err, strip(stderr.String()))
+	}
+
+	return nil
+}
+
+// addToTar writes p to the archive.  Files with more than one link are
+// written once and recorded in links so later paths are added as hardlinks.
+func addToTar(tw *tar.Writer, p string, links map[fileKey]string) error {
+	name := strings.TrimLeft(filepath.ToSlash(p), "/")
+	if name == "." || name == "" {
+		return nil
+	}
+
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+
+	link := ""
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(p); err != nil {
+			return err
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+
+	if !fi.Mode().IsRegular() {
+		return tw.WriteHeader(hdr)
+	}
+	initialProgress.add(fi.Size())
+
+	if fileMode != 0 {
+		hdr.Mode = int64(fileMode)
+	}
+
+	if key, ok := hardlinkKey(p); ok {
+		if target, ok := links[key]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = target
+			hdr.Size = 0
+			return tw.WriteHeader(hdr)
+		}
+		links[key] = name
+	}
+
+	if !hasContentChanges() {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = copyBuffer(tw, f)
+		return err
+	}
+
+	// transforms can change the size so the content has to be read before
+	// the header is written
+	data, err := uploadContent(p)
+	if err != nil {
+		if isTransformError(err) {
+			log.Error(err)
+			logSkip(p, skipTransform)
+			return nil
+		}
+		return err
+	}
+	hdr.Size = int64(len(data))
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// throttleInterval is how often power and load are checked.
+	throttleInterval = 30 * time.Second
+	// highLoadPerCPU is the load average per cpu considered high.
+	highLoadPerCPU = 0.9
+)
+
+var (
+	transferLimiter = newLimiter(1)
+	throttleDelay   time.Duration
+	throttled       bool
+	throttleMu      sync.Mutex
+)
+
+// limiter bounds how many transfers run at once.  The limit can be changed
+// while transfers are running.
+type limiter struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+	held   bool
+}
+
+func newLimiter(n int) *limiter {
+	l := &limiter{
+		limit: n,
+	}
+	l.cond = sync.NewCond(&l.mu)
+
+	return l
+}
+
+func (l *limiter) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for l.held || l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+}
+
+// hold waits for running transfers to finish and keeps new ones from
+// starting until unhold is called.
+func (l *limiter) hold() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for l.held || l.active > 0 {
+		l.cond.Wait()
+	}
+	l.held = true
+}
+
+func (l *limiter) unhold() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.held = false
+	l.cond.Broadcast()
+}
+
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active--
+	l.cond.Broadcast()
+}
+
+func (l *limiter) setLimit(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limit = n
+	l.cond.Broadcast()
+}
+
+// throttleWait delays a transfer while throttled so bursts of changes are
+// handled at a gentler pace.
+func throttleWait() {
+	throttleMu.Lock()
+	t := throttled
+	throttleMu.Unlock()
+
+	if t {
+		time.Sleep(throttleDelay)
+	}
+}
+
+// monitorResources throttles transfers to one at a time, each after
+// throttleDelay, while running on battery or under high load.  Where
+// neither can be detected it does nothing.
+func monitorResources() {
+	for {
+		battery, batteryKnown := onBattery()
+		load, loadKnown := highLoad()
+		if !batteryKnown && !loadKnown {
+			log.Warn("unable to detect battery or load; --throttle-on-battery has no effect")
+			return
+		}
+
+		throttle := battery || load
+
+		throttleMu.Lock()
+		changed := throttle != throttled
+		throttled = throttle
+		throttleMu.Unlock()
+
+		if changed {
+			if throttle {
+				log.Infof("throttling transfers (battery=%v high load=%v)", battery, load)
+				transferLimiter.setLimit(1)
+			} else {
+				log.Info("no longer throttling transfers")
+				transferLimiter.setLimit(concurrency)
+			}
+		}
+
+		time.Sleep(throttleInterval)
+	}
+}
+
+// shutdownWait is how long shutting down waits for transfers in flight.
+const shutdownWait = 30 * time.Second
+
+// finishTransfers waits for the transfers in flight to finish and keeps
+// new ones from starting, giving up after shutdownWait.
+func finishTransfers() {
+	finished := make(chan struct{})
+	go func() {
+		transferLimiter.hold()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(shutdownWait):
+		log.Warnf("transfers still running after %s; exiting anyway", shutdownWait)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// TransformFunc rewrites the content of the local file at path before it
+// is uploaded, e.g. to render templates or inject secrets.
+type TransformFunc func(path string, r io.Reader) (io.Reader, error)
+
+// transforms are applied in order to every uploaded file.  They see the
+// original local content; line ending normalization runs on their output
+// and any compression applies to the final result.  --transform adds a
+// command for each use.
+var transforms []TransformFunc
+
+// commandTransform runs command with the content on stdin and uploads what
+// it writes to stdout instead.  The local path is in MACHINE_SYNC_PATH.  A
+// command that fails aborts the upload of that file only.
+func commandTransform(command string) TransformFunc {
+	return func(p string, r io.Reader) (io.Reader, error) {
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("cmd", "/C", command)
+		} else {
+			cmd = exec.Command("sh", "-c", command)
+		}
+		cmd.Env = append(os.Environ(), "MACHINE_SYNC_PATH="+p)
+		cmd.Stdin = r
+
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			if msg := strip(stderr.String()); msg != "" {
+				return nil, fmt.Errorf("%s: %s: %s", command, err, msg)
+			}
+			return nil, fmt.Errorf("%s: %s", command, err)
+		}
+
+		return &stdout, nil
+	}
+}
+
+// transformError is returned when a transform fails.  It only aborts the
+// upload of that file.
+type transformError struct {
+	path string
+	err  error
+}
+
+func (e *transformError) Error() string {
+	return fmt.Sprintf("error transforming %s: %s", e.path, e.err)
+}
+
+func isTransformError(err error) bool {
+	_, ok := err.(*transformError)
+	return ok
+}
+
+// hasContentChanges reports whether uploaded content may differ from the
+// local file.
+func hasContentChanges() bool {
+	return len(transforms) > 0 || normalizeEOL
+}
+
+// uploadContent returns the content to upload for localPath after running
+// it through the transforms and line ending normalization.
+func uploadContent(localPath string) ([]byte, error) {
+	// this can probably be more efficient
+	f, err := os.Open(localPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	for _, transform := range transforms {
+		if r, err = transform(localPath, r); err != nil {
+			return nil, &transformError{localPath, err}
+		}
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		if len(transforms) > 0 {
+			return nil, &transformError{localPath, err}
+		}
+		return nil, err
+	}
+
+	return convertEOL(localPath, data), nil
+}
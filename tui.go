@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func isTerminal() bool {
+	return terminal.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// runTUI redraws a live view of the sync on stdout every second.
+func runTUI() {
+	var lastBytes int64
+	ticker := time.NewTicker(time.Second)
+	for range ticker.C {
+		stats := syncStats.snapshot()
+		rate := stats.Bytes - lastBytes
+		lastBytes = stats.Bytes
+
+		drawTUI(stats, rate)
+	}
+}
+
+func drawTUI(stats *transferStats, rate int64) {
+	status := "connected"
+	if state := transferBreaker.currentState(); state != breakerClosed {
+		status = "unreachable (breaker " + state + ")"
+	}
+	if paused, queued := syncPause.state(); paused {
+		status = fmt.Sprintf("paused (%d queued)", queued)
+	}
+
+	var buf bytes.Buffer
+	// move to the top left and clear the screen
+	buf.WriteString("\033[H\033[2J")
+	fmt.Fprintf(&buf, "machine-sync  %s -> %s:%s\n\n", srcPath, machineName, destPath)
+	fmt.Fprintf(&buf, "status:  %s\n", status)
+	fmt.Fprintf(&buf, "synced:  %d files, %s (%s/s)\n", stats.Files, formatBytes(stats.Bytes), formatBytes(rate))
+	fmt.Fprintf(&buf, "errors:  %d\n", stats.Errors)
+	if stats.LastError != "" {
+		fmt.Fprintf(&buf, "         last: %s\n", stats.LastError)
+	}
+	buf.WriteString("\nrecent:\n")
+	for i := len(stats.Recent) - 1; i >= 0; i-- {
+		t := stats.Recent[i]
+		result := "ok"
+		if t.Err != "" {
+			result = "error"
+		}
+		fmt.Fprintf(&buf, "  %s  %-5s  %s\n", t.Time.Format("15:04:05"), result, t.Path)
+	}
+
+	os.Stdout.Write(buf.Bytes())
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// underDir namespaces the sync under a directory of the destination so
+// several trees can share one (--under).
+var underDir string
+
+// parseUnder checks --under names a directory below the destination.
+func parseUnder(v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+
+	dir := path.Clean(v)
+	if path.IsAbs(dir) || dir == "." || dir == ".." || strings.HasPrefix(dir, "../") {
+		return "", fmt.Errorf("--under %s must be a relative path below the destination", v)
+	}
+
+	return dir, nil
+}
+
+// underDest returns dest with underDir added.  When syncing a single file
+// dest is the file so the directory goes before its name.
+func underDest(dest string) string {
+	if underDir == "" {
+		return dest
+	}
+	if singleFile != "" {
+		return path.Join(path.Dir(dest), underDir, path.Base(dest))
+	}
+
+	return path.Join(dest, underDir)
+}
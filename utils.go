@@ -1,13 +1,47 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"golang.org/x/crypto/ssh"
 )
 
+// binarySniffLen is how much of a file is sampled when deciding whether it
+// is binary.
+const binarySniffLen = 8000
+
+var (
+	binaryCache = &fileClassCache{entries: map[string]fileClass{}}
+
+	// textExts and binaryExts are extensions classified by --text-ext and
+	// --binary-ext instead of by sampling the content.
+	textExts   = map[string]bool{}
+	binaryExts = map[string]bool{}
+)
+
+type fileClass struct {
+	size    int64
+	modTime time.Time
+	binary  bool
+}
+
+// fileClassCache remembers the classification of each path until the file
+// changes.
+type fileClassCache struct {
+	mu      sync.Mutex
+	entries map[string]fileClass
+}
+
 func strip(v string) string {
 	return strings.TrimSpace(strings.Trim(v, "\n"))
 }
@@ -42,3 +76,145 @@ func (k *keychain) loadPEM(file string) error {
 	k.key = key
 	return nil
 }
+
+// shellQuote quotes v for use as a single argument in a remote shell command.
+func shellQuote(v string) string {
+	return "'" + strings.Replace(v, "'", `'\''`, -1) + "'"
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// parseSize parses a byte count with an optional K, M, G or T suffix
+// (e.g. 512M).
+func parseSize(v string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(v)), "B")
+
+	mult := int64(1)
+	if s != "" {
+		if i := strings.IndexByte("KMGT", s[len(s)-1]); i != -1 {
+			mult = int64(1) << (10 * uint(i+1))
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %s", v)
+	}
+
+	return n * mult, nil
+}
+
+// writeFull writes all of data to w, continuing after short writes.
+func writeFull(w io.Writer, data []byte) error {
+	for len(data) > 0 {
+		n, err := w.Write(data)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		data = data[n:]
+	}
+
+	return nil
+}
+
+// isBinary treats data as binary if it contains a NUL byte or is not valid
+// utf-8.  Only the first binarySniffLen bytes are inspected.
+func isBinary(data []byte) bool {
+	if len(data) >= binarySniffLen {
+		data = data[:binarySniffLen]
+
+		// the sample may end part way through a character
+		for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(data[i]) {
+				if !utf8.FullRune(data[i:]) {
+					data = data[:i]
+				}
+				break
+			}
+		}
+	}
+
+	return bytes.IndexByte(data, 0) != -1 || !utf8.Valid(data)
+}
+
+// extSet normalizes extensions given with or without the leading dot.
+func extSet(exts []string) map[string]bool {
+	set := map[string]bool{}
+	for _, ext := range exts {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		set[ext] = true
+	}
+
+	return set
+}
+
+// isBinaryFile classifies the file at p by its extension when it is listed
+// in textExts or binaryExts, otherwise with isBinary.  Sampled results are
+// cached until the file's size or modification time changes.
+func isBinaryFile(p string) (bool, error) {
+	ext := strings.ToLower(filepath.Ext(p))
+	if textExts[ext] {
+		return false, nil
+	}
+	if binaryExts[ext] {
+		return true, nil
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return false, err
+	}
+
+	binaryCache.mu.Lock()
+	entry, ok := binaryCache.entries[p]
+	binaryCache.mu.Unlock()
+	if ok && entry.size == fi.Size() && entry.modTime.Equal(fi.ModTime()) {
+		return entry.binary, nil
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, binarySniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	binary := isBinary(buf[:n])
+
+	binaryCache.mu.Lock()
+	binaryCache.entries[p] = fileClass{
+		size:    fi.Size(),
+		modTime: fi.ModTime(),
+		binary:  binary,
+	}
+	binaryCache.mu.Unlock()
+
+	return binary, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// shortWriter accepts at most max bytes per write.
+type shortWriter struct {
+	buf    bytes.Buffer
+	max    int
+	writes int
+}
+
+func (w *shortWriter) Write(b []byte) (int, error) {
+	w.writes++
+	if len(b) > w.max {
+		b = b[:w.max]
+	}
+	return w.buf.Write(b)
+}
+
+func TestWriteFullShortWrites(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	w := &shortWriter{max: 333}
+
+	if err := writeFull(w, data); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(w.buf.Bytes(), data) {
+		t.Errorf("wrote %d bytes, want %d", w.buf.Len(), len(data))
+	}
+	if want := (len(data) + w.max - 1) / w.max; w.writes != want {
+		t.Errorf("%d writes, want %d", w.writes, want)
+	}
+}
+
+func TestWriteFullNoProgress(t *testing.T) {
+	if err := writeFull(&shortWriter{max: 0}, []byte("data")); err != io.ErrShortWrite {
+		t.Errorf("got %v, want %v", err, io.ErrShortWrite)
+	}
+}
+
+type failingWriter struct{}
+
+var errWrite = errors.New("write failed")
+
+func (failingWriter) Write(b []byte) (int, error) {
+	return len(b) / 2, errWrite
+}
+
+func TestWriteFullError(t *testing.T) {
+	if err := writeFull(failingWriter{}, []byte("data")); err != errWrite {
+		t.Errorf("got %v, want %v", err, errWrite)
+	}
+}
+
+func TestIsBinary(t *testing.T) {
+	// a multi-byte character split by the end of the sample
+	split := strings.Repeat("a", binarySniffLen-1) + "é"
+
+	tests := []struct {
+		name   string
+		data   []byte
+		binary bool
+	}{
+		{"empty", nil, false},
+		{"ascii", []byte("hello\nworld\n"), false},
+		{"utf-8", []byte("café 日本語\n"), false},
+		{"crlf", []byte("line\r\nline\r\n"), false},
+		{"nul byte", []byte("text\x00more"), true},
+		{"invalid utf-8", []byte{'a', 0xff, 0xfe, 'b'}, true},
+		{"png header", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), true},
+		{"gzip header", []byte{0x1f, 0x8b, 0x08, 0x00}, true},
+		{"character split by the sample", []byte(split), false},
+		{"nul after the sample", append(bytes.Repeat([]byte("a"), binarySniffLen), 0), false},
+	}
+
+	for _, test := range tests {
+		if got := isBinary(test.data); got != test.binary {
+			t.Errorf("%s: isBinary = %v, want %v", test.name, got, test.binary)
+		}
+	}
+}
+
+func TestIsBinaryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "classify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(text, binary map[string]bool) {
+		textExts, binaryExts = text, binary
+	}(textExts, binaryExts)
+	textExts = extSet([]string{"svg"})
+	binaryExts = extSet([]string{".dat"})
+
+	tests := []struct {
+		name   string
+		data   []byte
+		binary bool
+	}{
+		{"notes.txt", []byte("plain text\n"), false},
+		{"image.bin", []byte{0x00, 0x01, 0x02}, true},
+		// listed extensions win over the content
+		{"icon.svg", []byte{0x00, 0x01}, false},
+		{"table.dat", []byte("looks like text"), true},
+	}
+
+	for _, test := range tests {
+		p := filepath.Join(dir, test.name)
+		if err := ioutil.WriteFile(p, test.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := isBinaryFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.binary {
+			t.Errorf("%s: isBinaryFile = %v, want %v", test.name, got, test.binary)
+		}
+	}
+
+	// the cached class is dropped when the file changes
+	p := filepath.Join(dir, "notes.txt")
+	if err := ioutil.WriteFile(p, []byte("now\x00binary"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if binary, err := isBinaryFile(p); err != nil || !binary {
+		t.Errorf("notes.txt after changing: isBinaryFile = %v, %v; want true", binary, err)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// hashBatchSize is the maximum number of files hashed by a single remote
+// sha256sum invocation.
+const hashBatchSize = 100
+
+var (
+	verifyUploads      bool
+	sha256sumOnce      sync.Once
+	sha256sumAvailable bool
+)
+
+// verifyError is returned when uploaded files don't match the local
+// content.
+type verifyError struct {
+	paths []string
+}
+
+func (e *verifyError) Error() string {
+	return fmt.Sprintf("verification failed for %s", strings.Join(e.paths, ", "))
+}
+
+func isVerifyError(err error) bool {
+	_, ok := err.(*verifyError)
+	return ok
+}
+
+// localHash returns the sha256 of the content uploaded for localPath.
+func localHash(localPath string) (string, error) {
+	data, err := uploadContent(localPath)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// verifyRemote checks that each remote path has the expected sha256.
+func verifyRemote(expected map[string]string) error {
+	filePaths := make([]string, 0, len(expected))
+	for p := range expected {
+		filePaths = append(filePaths, p)
+	}
+
+	actual, err := remoteHashes(filePaths)
+	if err != nil {
+		return err
+	}
+
+	mismatched := []string{}
+	for p, hash := range expected {
+		if actual[p] != hash {
+			log.Debugf("verify %s: expected %s got %s", p, hash, actual[p])
+			mismatched = append(mismatched, p)
+		}
+	}
+
+	if len(mismatched) > 0 {
+		return &verifyError{mismatched}
+	}
+
+	return nil
+}
+
+// remoteHashes returns the sha256 of each remote path.  The hashes are
+// computed on the machine with sha256sum when it is available, otherwise
+// each file is read back over sftp.
+func remoteHashes(filePaths []string) (map[string]string, error) {
+	sha256sumOnce.Do(func() {
+		session, err := newSession()
+		if err != nil {
+			return
+		}
+		defer session.Close()
+
+		sha256sumAvailable = session.Run("command -v sha256sum >/dev/null") == nil
+		if !sha256sumAvailable {
+			log.Warn("sha256sum is not available on the machine; verifying by reading files back")
+		}
+	})
+
+	hashes := map[string]string{}
+	if !sha256sumAvailable {
+		for _, p := range filePaths {
+			hash, err := readBackHash(p)
+			if err != nil {
+				return nil, err
+			}
+			hashes[p] = hash
+		}
+		return hashes, nil
+	}
+
+	for len(filePaths) > 0 {
+		n := len(filePaths)
+		if n > hashBatchSize {
+			n = hashBatchSize
+		}
+		if err := sha256sumBatch(filePaths[:n], hashes); err != nil {
+			return nil, err
+		}
+		filePaths = filePaths[n:]
+	}
+
+	return hashes, nil
+}
+
+func sha256sumBatch(filePaths []string, hashes map[string]string) error {
+	session, err := newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	args := make([]string, len(filePaths))
+	for i, p := range filePaths {
+		args[i] = shellQuote(p)
+	}
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err := session.Run("sha256sum -- " + strings.Join(args, " ")); err != nil {
+		return fmt.Errorf("error hashing files on machine: %s: %s", err, strip(stderr.String()))
+	}
+
+	// sha256sum prints one line per file in argument order
+	i := 0
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() && i < len(filePaths) {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		// names needing escapes are flagged with a leading backslash
+		hashes[filePaths[i]] = strings.TrimPrefix(fields[0], "\\")
+		i++
+	}
+
+	return scanner.Err()
+}
+
+func readBackHash(filePath string) (string, error) {
+	f, err := rsftp.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := copyBuffer(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyPaths verifies the uploaded copies of the local paths in batches.
+func verifyPaths(localPaths []string) error {
+	expected := map[string]string{}
+	for _, p := range localPaths {
+		if fi, err := os.Lstat(p); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+
+		hash, err := localHash(p)
+		if err != nil {
+			return err
+		}
+		expected[remotePath(p)] = hash
+	}
+
+	if len(expected) == 0 {
+		return nil
+	}
+
+	return verifyRemote(expected)
+}
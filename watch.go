@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/howeyc/fsnotify"
+)
+
+// watchLimitWarning is the fraction of the inotify watch limit in use at
+// which a warning is logged.
+const watchLimitWarning = 0.9
+
+var (
+	// maxDepth limits how many directory levels below srcPath are watched
+	// and synced.  0 means no limit.
+	maxDepth       int
+	watched        = &watchedDirs{dirs: map[string]bool{}}
+	watchLimitOnce sync.Once
+)
+
+// watchedDirs tracks the directories with a registered watch.
+type watchedDirs struct {
+	mu   sync.Mutex
+	dirs map[string]bool
+}
+
+func (w *watchedDirs) add(p string) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.dirs[p] = true
+	return len(w.dirs)
+}
+
+// remove forgets p, whose watch the kernel drops when it is deleted.
+func (w *watchedDirs) remove(p string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.dirs, p)
+}
+
+func (w *watchedDirs) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.dirs)
+}
+
+// pathDepth returns how many levels below srcPath p is.
+func pathDepth(p string) int {
+	rel, err := filepath.Rel(srcPath, p)
+	if err != nil || rel == "." {
+		return 0
+	}
+
+	return len(strings.Split(rel, string(filepath.Separator)))
+}
+
+// walkTree walks root like filepath.Walk but doesn't descend into
+// directories at --max-depth.
+func walkTree(root string, fn filepath.WalkFunc) error {
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return fn(p, fi, err)
+		}
+		if err := fn(p, fi, nil); err != nil {
+			return err
+		}
+
+		if fi.IsDir() && maxDepth > 0 && pathDepth(p) >= maxDepth {
+			log.Warnf("not descending into %s: deeper than --max-depth %d", p, maxDepth)
+			return filepath.SkipDir
+		}
+
+		return nil
+	})
+}
+
+// watchTree registers a watch for root and every directory below it.
+func watchTree(w *fsnotify.Watcher, root string) error {
+	return walkTree(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		if isExcluded(p, true) {
+			logSkip(p, skipExcluded)
+			return filepath.SkipDir
+		}
+		// nothing below this depth is synced so there is no need to
+		// watch it
+		if maxDepth > 0 && pathDepth(p) >= maxDepth {
+			return nil
+		}
+
+		log.Debugf("watching %s", p)
+		if err := w.Watch(p); err != nil {
+			return watchLimitError(err)
+		}
+		checkWatchLimit(watched.add(p))
+
+		return nil
+	})
+}
+
+// checkWatchLimit warns once when n watches is close to the limit.
+func checkWatchLimit(n int) {
+	limit, ok := maxUserWatches()
+	if !ok || float64(n) < float64(limit)*watchLimitWarning {
+		return
+	}
+
+	watchLimitOnce.Do(func() {
+		log.Warnf("%d of %d inotify watches in use; raise fs.inotify.max_user_watches or use --max-depth", n, limit)
+	})
+}
+
+// dispatchTree queues everything below a new directory.  Whatever was in
+// it before the watch was added, such as from cp -r, tar x or a git
+// checkout, produces no events of its own.
+func dispatchTree(root string) {
+	err := walkTree(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// removed again while walking
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		if isExcluded(p, fi.IsDir()) {
+			logSkip(p, skipExcluded)
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		ev := &fsnotify.FileEvent{Name: p}
+		if !syncPause.hold(ev) {
+			dispatch(ev)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("unable to sync the contents of %s: %s", root, err)
+	}
+}
+
+func isDir(p string) bool {
+	fi, err := os.Lstat(p)
+	return err == nil && fi.IsDir()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// watchdogTimeout is how long the workers may go without finishing an
+// event while there is work waiting before the watchdog steps in.  0
+// disables it.
+var watchdogTimeout time.Duration
+
+// progressChunk is the most written at once between progress updates, so
+// a large upload on a slow link still shows progress to the watchdog.
+const progressChunk = 4 << 20
+
+var workerProgress = &progressTracker{last: time.Now()}
+
+// progressTracker records when a worker last finished an event or sent
+// part of a file, and how many are handling one now.
+type progressTracker struct {
+	mu     sync.Mutex
+	last   time.Time
+	active int32
+}
+
+func (p *progressTracker) start() {
+	atomic.AddInt32(&p.active, 1)
+}
+
+func (p *progressTracker) done() {
+	atomic.AddInt32(&p.active, -1)
+
+	p.mu.Lock()
+	p.last = time.Now()
+	p.mu.Unlock()
+}
+
+// advance records that a transfer sent data.
+func (p *progressTracker) advance() {
+	p.mu.Lock()
+	p.last = time.Now()
+	p.mu.Unlock()
+}
+
+// progressWriter writes in chunks of at most progressChunk, recording
+// progress after each.
+type progressWriter struct {
+	w io.Writer
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > progressChunk {
+			n = progressChunk
+		}
+		n, err := w.w.Write(b[:n])
+		written += n
+		workerProgress.advance()
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+// progressReader records progress as data is read from r to be sent.
+type progressReader struct {
+	r io.Reader
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		workerProgress.advance()
+	}
+
+	return n, err
+}
+
+func (p *progressTracker) lastProgress() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.last
+}
+
+// pending reports whether there are events waiting or being handled.
+func (p *progressTracker) pending() bool {
+	if atomic.LoadInt32(&p.active) > 0 {
+		return true
+	}
+	if spill != nil && spill.len() > 0 {
+		return true
+	}
+	for _, q := range eventQueues {
+		if len(q) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runWatchdog checks the workers are making progress and reconnects to
+// the machine when they aren't, which unblocks a transfer stuck on a dead
+// connection.
+func runWatchdog() {
+	ticker := time.NewTicker(watchdogTimeout / 4)
+	defer ticker.Stop()
+
+	recovered := time.Time{}
+	for range ticker.C {
+		if paused, _ := syncPause.state(); paused {
+			continue
+		}
+		// waiting out an open breaker isn't a hang
+		if transferBreaker.currentState() != breakerClosed {
+			continue
+		}
+		last := workerProgress.lastProgress()
+		if !workerProgress.pending() || time.Since(last) < watchdogTimeout {
+			continue
+		}
+
+		if recovered.After(last) {
+			// reconnecting didn't help; don't keep reconnecting
+			if time.Since(recovered) >= watchdogTimeout {
+				log.Errorf("no sync progress since %s even after reconnecting; restart machine-sync", last.Format(time.RFC3339))
+				recovered = time.Now()
+			}
+			continue
+		}
+
+		stalled := fmt.Errorf("no sync progress for %s with work pending", time.Since(last).Round(time.Second))
+		log.Warnf("%s; reconnecting to %s", stalled, machineName)
+		recovered = time.Now()
+
+		// closing the connection fails whatever is stuck on it, which is
+		// requeued once reconnected
+		reconnects.recover(stalled)
+	}
+}
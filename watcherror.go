@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/howeyc/fsnotify"
+)
+
+// watchErrorLimit is how many watch errors within watchErrorWindow are
+// reported as a persistent problem.
+const (
+	watchErrorLimit  = 5
+	watchErrorWindow = time.Minute
+)
+
+var watchErrors = &watchErrorTracker{}
+
+// watchErrorTracker keeps the times of recent watch errors.
+type watchErrorTracker struct {
+	mu    sync.Mutex
+	times []time.Time
+}
+
+// add records an error and returns how many happened within the window.
+func (t *watchErrorTracker) add() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	recent := t.times[:0]
+	for _, ts := range t.times {
+		if now.Sub(ts) < watchErrorWindow {
+			recent = append(recent, ts)
+		}
+	}
+	t.times = append(recent, now)
+
+	return len(t.times)
+}
+
+// isBrokenWatch reports whether err means watches were lost, as opposed to
+// a failed read that the watcher recovers from on its own.
+func isBrokenWatch(err error) bool {
+	if e, ok := err.(*os.SyscallError); ok {
+		err = e.Err
+	}
+	if err == syscall.EBADF || err == syscall.EINVAL {
+		return true
+	}
+
+	return strings.Contains(err.Error(), "closed")
+}
+
+// handleWatchError re-establishes the watches and resyncs the tree when
+// err means they were lost, so the sync doesn't silently go deaf.
+func handleWatchError(w *fsnotify.Watcher, err error) {
+	if n := watchErrors.add(); n >= watchErrorLimit {
+		log.Errorf("%d file watch errors in the last %s; changes may be missed: %s", n, watchErrorWindow, err)
+	}
+
+	if !isBrokenWatch(err) {
+		log.Warnf("file watch error: %s", err)
+		return
+	}
+
+	log.Errorf("file watch broken: %s; watching %s again", err, srcPath)
+	if err := rewatch(w); err != nil {
+		log.Errorf("unable to watch %s again; changes are no longer synced: %s", srcPath, err)
+		return
+	}
+
+	reconcileWatch()
+}
+
+// rewatch registers the watches for the synced paths again.
+func rewatch(w *fsnotify.Watcher) error {
+	if singleFile != "" {
+		return w.Watch(srcPath)
+	}
+	if len(watchList) > 0 {
+		return watchWatchList(w)
+	}
+
+	return watchTree(w, srcPath)
+}
+
+// reconcileWatch queues every path for upload to catch up on changes made
+// while the watch was broken.
+func reconcileWatch() {
+	paths, err := syncPaths()
+	if err != nil {
+		log.Errorf("unable to resync %s: %s", srcPath, err)
+		return
+	}
+
+	log.Infof("resyncing %d paths", len(paths))
+	for _, p := range orderPaths(paths) {
+		dispatch(&fsnotify.FileEvent{Name: p})
+	}
+}
+
+// stopWatching reports that the watcher closed, which short of a shutdown
+// means nothing more will be synced.
+func stopWatching(done chan bool) {
+	select {
+	case <-done:
+	default:
+		log.Error("file watcher stopped; changes are no longer synced, restart machine-sync")
+	}
+}
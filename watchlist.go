@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/howeyc/fsnotify"
+)
+
+// watchList holds the paths given with --watch-list.  When set only they,
+// and the directories leading to them, are watched and synced instead of
+// the whole directory.
+var watchList []string
+
+// parseWatchList resolves the --watch-list paths against srcPath.  Each
+// must exist and be below it so it maps onto the destination.
+func parseWatchList(paths []string) ([]string, error) {
+	list := []string{}
+	for _, p := range paths {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(srcPath, p)
+		}
+		p = filepath.Clean(p)
+
+		rel, err := filepath.Rel(srcPath, p)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("watch list path %s is not under %s", p, srcPath)
+		}
+		if _, err := os.Lstat(p); err != nil {
+			return nil, fmt.Errorf("watch list path %s: %s", p, err)
+		}
+
+		list = append(list, p)
+	}
+
+	return list, nil
+}
+
+// outsideWatchList reports whether p is neither one of the listed paths,
+// below one, nor a directory leading to one.
+func outsideWatchList(p string) bool {
+	if len(watchList) == 0 {
+		return false
+	}
+
+	p = filepath.Clean(p)
+	sep := string(filepath.Separator)
+	for _, w := range watchList {
+		if p == w || strings.HasPrefix(p, w+sep) || strings.HasPrefix(w, p+sep) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// watchListPaths walks each listed path and returns the paths to sync.
+func watchListPaths(fn filepath.WalkFunc) error {
+	for _, w := range watchList {
+		if err := walkTree(w, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// watchWatchList registers a watch for each listed directory and below,
+// and for the parent of each listed file, which is where its events are
+// reported.
+func watchWatchList(w *fsnotify.Watcher) error {
+	for _, p := range watchList {
+		if isDir(p) {
+			if err := watchTree(w, p); err != nil {
+				return err
+			}
+			continue
+		}
+
+		dir := filepath.Dir(p)
+		log.Debugf("watching %s", dir)
+		if err := w.Watch(dir); err != nil {
+			return watchLimitError(err)
+		}
+		checkWatchLimit(watched.add(dir))
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	preserveXattrs    bool
+	setfattrOnce      sync.Once
+	setfattrAvailable bool
+)
+
+// applyXattrs copies the extended attributes of localPath onto filePath on
+// the machine.  sftp has no way to set them so they are applied with
+// setfattr; when the machine doesn't have it this is a no-op.
+func applyXattrs(localPath, filePath string) {
+	if !preserveXattrs {
+		return
+	}
+
+	attrs, err := localXattrs(localPath)
+	if err != nil {
+		log.Warnf("unable to read extended attributes of %s: %s", localPath, err)
+		return
+	}
+	if len(attrs) == 0 {
+		return
+	}
+
+	setfattrOnce.Do(func() {
+		session, err := newSession()
+		if err != nil {
+			return
+		}
+		defer session.Close()
+
+		setfattrAvailable = session.Run("command -v setfattr >/dev/null") == nil
+		if !setfattrAvailable {
+			log.Warn("setfattr is not available on the machine; extended attributes will not be preserved")
+		}
+	})
+	if !setfattrAvailable {
+		return
+	}
+
+	cmds := []string{}
+	for name, value := range attrs {
+		cmds = append(cmds, fmt.Sprintf("setfattr -n %s -v 0x%s %s", shellQuote(name), hex.EncodeToString(value), shellQuote(filePath)))
+	}
+
+	session, err := newSession()
+	if err != nil {
+		log.Warnf("unable to set extended attributes on %s: %s", filePath, err)
+		return
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	if err := session.Run(strings.Join(cmds, " && ")); err != nil {
+		log.Warnf("unable to set extended attributes on %s: %s", filePath, strip(stderr.String()))
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"syscall"
+)
+
+// localXattrs returns the extended attributes set on p.
+func localXattrs(p string) (map[string][]byte, error) {
+	size, err := syscall.Listxattr(p, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+
+	buf := make([]byte, size)
+	if size, err = syscall.Listxattr(p, buf); err != nil {
+		return nil, err
+	}
+
+	attrs := map[string][]byte{}
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+
+		n, err := syscall.Getxattr(p, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, n)
+		if n, err = syscall.Getxattr(p, string(name), value); err != nil {
+			return nil, err
+		}
+		attrs[string(name)] = value[:n]
+	}
+
+	return attrs, nil
+}
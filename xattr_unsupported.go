@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// localXattrs is only implemented on linux; elsewhere there is nothing to
+// preserve.
+func localXattrs(p string) (map[string][]byte, error) {
+	return nil, nil
+}